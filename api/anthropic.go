@@ -0,0 +1,633 @@
+package api
+
+import (
+	"augment2api/pkg/logger"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// AnthropicRequest Anthropic Messages API请求结构
+type AnthropicRequest struct {
+	Model         string             `json:"model"`
+	System        interface{}        `json:"system,omitempty"` // 字符串或文本块数组
+	Messages      []AnthropicMessage `json:"messages"`
+	MaxTokens     int                `json:"max_tokens"`
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+	Stream        bool               `json:"stream,omitempty"`
+	Temperature   float64            `json:"temperature,omitempty"`
+	Tools         []AnthropicTool    `json:"tools,omitempty"`
+	ToolChoice    interface{}        `json:"tool_choice,omitempty"`
+}
+
+// AnthropicMessage Anthropic消息结构，content为字符串或内容块数组
+type AnthropicMessage struct {
+	Role    string      `json:"role"`
+	Content interface{} `json:"content"`
+}
+
+// AnthropicTool Anthropic工具定义
+type AnthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema,omitempty"`
+}
+
+// AnthropicContentBlock Anthropic响应内容块
+type AnthropicContentBlock struct {
+	Type  string          `json:"type"`
+	Text  string          `json:"text,omitempty"`
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+}
+
+// AnthropicUsage Anthropic用量结构
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// AnthropicResponse Anthropic非流式响应结构
+type AnthropicResponse struct {
+	ID           string                  `json:"id"`
+	Type         string                  `json:"type"`
+	Role         string                  `json:"role"`
+	Model        string                  `json:"model"`
+	Content      []AnthropicContentBlock `json:"content"`
+	StopReason   string                  `json:"stop_reason"`
+	StopSequence *string                 `json:"stop_sequence"`
+	Usage        AnthropicUsage          `json:"usage"`
+}
+
+// AnthropicMessagesHandler 处理Anthropic Messages API兼容的请求
+func AnthropicMessagesHandler(c *gin.Context) {
+	var req AnthropicRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeAnthropicError(c, http.StatusBadRequest, "invalid_request_error", "无效的请求数据")
+		cleanupRequestStatus(c)
+		return
+	}
+
+	if _, err := requestModel(c, req.Model); err != nil {
+		writeAnthropicError(c, http.StatusNotFound, "not_found_error", err.Error())
+		cleanupRequestStatus(c)
+		return
+	}
+
+	augmentReq, err := convertToAugmentRequest(c, req.toOpenAIRequest(), requestAPIKey(c))
+	if err != nil {
+		writeAnthropicError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		cleanupRequestStatus(c)
+		return
+	}
+	trimContext(c, req.Model, &augmentReq)
+
+	handleAnthropicRequest(c, req, augmentReq)
+}
+
+// systemText 提取顶层system字段中的文本
+func (r AnthropicRequest) systemText() string {
+	switch v := r.System.(type) {
+	case string:
+		return v
+	case []interface{}:
+		var parts []string
+		for _, item := range v {
+			if block, ok := item.(map[string]interface{}); ok {
+				if text, ok := block["text"].(string); ok && text != "" {
+					parts = append(parts, text)
+				}
+			}
+		}
+		return strings.Join(parts, "\n")
+	default:
+		return ""
+	}
+}
+
+// toOpenAIRequest 将Anthropic请求转换为OpenAI请求，复用OpenAI到Augment的转换逻辑
+func (r AnthropicRequest) toOpenAIRequest() OpenAIRequest {
+	openAIReq := OpenAIRequest{
+		Model:       r.Model,
+		Stream:      r.Stream,
+		Temperature: r.Temperature,
+		MaxTokens:   r.MaxTokens,
+		ToolChoice:  anthropicToolChoice(r.ToolChoice),
+	}
+
+	for _, tool := range r.Tools {
+		openAIReq.Tools = append(openAIReq.Tools, OpenAITool{
+			Type: "function",
+			Function: OpenAIToolFunction{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.InputSchema,
+			},
+		})
+	}
+
+	// 顶层system作为system消息，由对话整理逻辑合并到用户指南
+	if system := r.systemText(); system != "" {
+		openAIReq.Messages = append(openAIReq.Messages, ChatMessage{Role: "system", Content: system})
+	}
+
+	for _, msg := range r.Messages {
+		openAIReq.Messages = append(openAIReq.Messages, anthropicMessageToOpenAI(msg)...)
+	}
+
+	return openAIReq
+}
+
+// anthropicToolChoice 将Anthropic的tool_choice转换为OpenAI格式
+func anthropicToolChoice(toolChoice interface{}) interface{} {
+	choice, ok := toolChoice.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	switch choice["type"] {
+	case "none":
+		return "none"
+	case "auto":
+		return "auto"
+	case "any":
+		return "required"
+	case "tool":
+		return map[string]interface{}{
+			"type":     "function",
+			"function": map[string]interface{}{"name": choice["name"]},
+		}
+	}
+	return nil
+}
+
+// anthropicMessageToOpenAI 将一条Anthropic消息转换为一条或多条OpenAI消息
+// tool_result块转换为role为tool的消息，tool_use块转换为助手消息的tool_calls
+func anthropicMessageToOpenAI(msg AnthropicMessage) []ChatMessage {
+	blocks, ok := msg.Content.([]interface{})
+	if !ok {
+		return []ChatMessage{{Role: msg.Role, Content: msg.Content}}
+	}
+
+	var messages []ChatMessage
+	var parts []interface{}
+	var toolCalls []ToolCall
+
+	for _, item := range blocks {
+		block, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		switch block["type"] {
+		case "text":
+			text, _ := block["text"].(string)
+			parts = append(parts, map[string]interface{}{"type": "text", "text": text})
+		case "image":
+			if imageURL := anthropicImageURL(block); imageURL != "" {
+				parts = append(parts, map[string]interface{}{
+					"type":      "image_url",
+					"image_url": map[string]interface{}{"url": imageURL},
+				})
+			}
+		case "tool_use":
+			id, _ := block["id"].(string)
+			name, _ := block["name"].(string)
+			arguments, _ := json.Marshal(block["input"])
+			toolCalls = append(toolCalls, ToolCall{
+				ID:   id,
+				Type: "function",
+				Function: ToolCallFunction{
+					Name:      name,
+					Arguments: string(arguments),
+				},
+			})
+		case "tool_result":
+			toolUseID, _ := block["tool_use_id"].(string)
+			messages = append(messages, ChatMessage{
+				Role:       "tool",
+				ToolCallID: toolUseID,
+				Content:    block["content"],
+			})
+		}
+	}
+
+	if len(parts) > 0 || len(toolCalls) > 0 {
+		messages = append(messages, ChatMessage{
+			Role:      msg.Role,
+			Content:   parts,
+			ToolCalls: toolCalls,
+		})
+	}
+
+	return messages
+}
+
+// anthropicImageURL 将Anthropic图片块的source转换为URL（base64数据转为data URL）
+func anthropicImageURL(block map[string]interface{}) string {
+	source, ok := block["source"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	switch source["type"] {
+	case "base64":
+		mediaType, _ := source["media_type"].(string)
+		data, _ := source["data"].(string)
+		return "data:" + mediaType + ";base64," + data
+	case "url":
+		imageURL, _ := source["url"].(string)
+		return imageURL
+	}
+	return ""
+}
+
+// writeAnthropicError 返回Anthropic格式的错误响应
+func writeAnthropicError(c *gin.Context, status int, errType, message string) {
+	errBody := gin.H{
+		"type": "error",
+		"error": gin.H{
+			"type":    errType,
+			"message": message,
+		},
+	}
+	// 流式响应已发送过心跳时只能以error事件返回
+	if c.Writer.Written() {
+		if jsonData, err := json.Marshal(errBody); err == nil {
+			fmt.Fprintf(c.Writer, "event: error\ndata: %s\n\n", jsonData)
+			c.Writer.Flush()
+		}
+		return
+	}
+	c.JSON(status, errBody)
+}
+
+// anthropicErrorType 根据HTTP状态码返回Anthropic错误类型
+func anthropicErrorType(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return "authentication_error"
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status >= 500:
+		return "api_error"
+	default:
+		return "invalid_request_error"
+	}
+}
+
+// stopSequenceMatcher 在流式输出中检测stop_sequences
+// 为避免把停止序列的前半段发给客户端，会暂存末尾可能构成停止序列前缀的内容
+type stopSequenceMatcher struct {
+	sequences []string
+	holdback  int
+	pending   string
+}
+
+func newStopSequenceMatcher(sequences []string) *stopSequenceMatcher {
+	m := &stopSequenceMatcher{}
+	for _, seq := range sequences {
+		if seq == "" {
+			continue
+		}
+		m.sequences = append(m.sequences, seq)
+		if len(seq)-1 > m.holdback {
+			m.holdback = len(seq) - 1
+		}
+	}
+	return m
+}
+
+// push 追加文本，返回可以安全输出的文本，命中停止序列时返回该序列
+func (m *stopSequenceMatcher) push(text string) (string, string) {
+	if len(m.sequences) == 0 {
+		return text, ""
+	}
+
+	m.pending += text
+	matchIndex, matched := -1, ""
+	for _, seq := range m.sequences {
+		if idx := strings.Index(m.pending, seq); idx >= 0 && (matchIndex < 0 || idx < matchIndex) {
+			matchIndex, matched = idx, seq
+		}
+	}
+	if matchIndex >= 0 {
+		out := m.pending[:matchIndex]
+		m.pending = ""
+		return out, matched
+	}
+
+	cut := len(m.pending) - m.holdback
+	if cut <= 0 {
+		return "", ""
+	}
+	for cut > 0 && !utf8.RuneStart(m.pending[cut]) {
+		cut--
+	}
+	out := m.pending[:cut]
+	m.pending = m.pending[cut:]
+	return out, ""
+}
+
+// flush 返回暂存的剩余文本
+func (m *stopSequenceMatcher) flush() string {
+	out := m.pending
+	m.pending = ""
+	return out
+}
+
+// anthropicOutput 收集Anthropic响应内容并判断停止原因
+type anthropicOutput struct {
+	maxTokens    int
+	matcher      *stopSequenceMatcher
+	toolCalls    *toolCallCollector
+	text         string
+	tokens       int // 已输出文本的token数，逐段累加避免每次重新计算全文
+	stopReason   string
+	stopSequence *string
+}
+
+func newAnthropicOutput(req AnthropicRequest) *anthropicOutput {
+	return &anthropicOutput{
+		maxTokens:  req.MaxTokens,
+		matcher:    newStopSequenceMatcher(req.StopSequences),
+		toolCalls:  newToolCallCollector(),
+		stopReason: "end_turn",
+	}
+}
+
+// add 处理一条Augment响应，返回本次可输出的文本、新的工具调用以及是否应停止
+func (o *anthropicOutput) add(augmentResp AugmentResponse) (string, []ToolCall, bool) {
+	text, matched := o.matcher.push(augmentResp.Text)
+	if matched == "" && augmentResp.Done {
+		text += o.matcher.flush()
+	}
+	o.text += text
+	o.tokens += estimateTokenCount(text)
+
+	newToolCalls := o.toolCalls.collect(augmentResp.Nodes)
+	if len(newToolCalls) > 0 {
+		o.stopReason = "tool_use"
+	}
+
+	if matched != "" {
+		o.stopReason = "stop_sequence"
+		o.stopSequence = &matched
+		return text, newToolCalls, true
+	}
+	if o.maxTokens > 0 && o.tokens >= o.maxTokens {
+		o.stopReason = "max_tokens"
+		return text, newToolCalls, true
+	}
+	return text, newToolCalls, augmentResp.Done
+}
+
+// finish 上游结束后输出暂存的文本
+func (o *anthropicOutput) finish() string {
+	if o.stopSequence != nil {
+		return ""
+	}
+	text := o.matcher.flush()
+	o.text += text
+	return text
+}
+
+// handleAnthropicRequest 请求Augment并以Anthropic格式返回
+func handleAnthropicRequest(c *gin.Context, req AnthropicRequest, augmentReq AugmentRequest) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Log.WithFields(logrus.Fields{
+				"error": r,
+				"model": req.Model,
+			}).Error("处理Anthropic请求时发生panic")
+			writeAnthropicError(c, http.StatusInternalServerError, "api_error", "服务器内部错误")
+		}
+		// 函数返回时同步清理请求状态
+		cleanupRequestStatus(c)
+	}()
+
+	token, tenant := getRequestToken(c)
+	if token == "" || tenant == "" {
+		writeAnthropicError(c, http.StatusUnauthorized, "authentication_error", "无可用Token,请先在管理页面获取")
+		return
+	}
+
+	// 异步处理token使用计数
+	asyncIncrementTokenUsage(c, token, req.Model)
+
+	if req.Stream {
+		handleAnthropicStream(c, req, augmentReq, token)
+		return
+	}
+
+	output := newAnthropicOutput(req)
+	token, upstreamErr := forwardWithFailover(c, req.Model, augmentReq, func(augmentResp AugmentResponse) bool {
+		_, _, stop := output.add(augmentResp)
+		return !stop
+	})
+	if upstreamErr != nil && upstreamErr.Kind == upstreamCancelled {
+		handleClientCancel(c, token)
+		return
+	}
+	if upstreamErr != nil {
+		writeAnthropicError(c, upstreamErr.StatusCode, anthropicErrorType(upstreamErr.StatusCode), upstreamErr.Message)
+		return
+	}
+	output.finish()
+
+	usage := chatUsage(augmentReq, output.text)
+	asyncRecordTokenCounts(c, token, usage)
+
+	content := make([]AnthropicContentBlock, 0, 1+len(output.toolCalls.calls))
+	if output.text != "" {
+		content = append(content, AnthropicContentBlock{Type: "text", Text: output.text})
+	}
+	for _, call := range output.toolCalls.calls {
+		content = append(content, anthropicToolUseBlock(call))
+	}
+
+	c.JSON(http.StatusOK, AnthropicResponse{
+		ID:           "msg_" + strings.ReplaceAll(uuid.New().String(), "-", ""),
+		Type:         "message",
+		Role:         "assistant",
+		Model:        req.Model,
+		Content:      content,
+		StopReason:   output.stopReason,
+		StopSequence: output.stopSequence,
+		Usage: AnthropicUsage{
+			InputTokens:  usage.PromptTokens,
+			OutputTokens: usage.CompletionTokens,
+		},
+	})
+}
+
+// anthropicToolUseBlock 将工具调用转换为Anthropic的tool_use内容块
+func anthropicToolUseBlock(call ToolCall) AnthropicContentBlock {
+	input := json.RawMessage(call.Function.Arguments)
+	if !json.Valid(input) {
+		input = json.RawMessage("{}")
+	}
+	return AnthropicContentBlock{
+		Type:  "tool_use",
+		ID:    call.ID,
+		Name:  call.Function.Name,
+		Input: input,
+	}
+}
+
+// anthropicStreamWriter 按Anthropic的SSE事件格式输出内容块
+type anthropicStreamWriter struct {
+	c         *gin.Context
+	flusher   http.Flusher
+	started   bool
+	index     int
+	textOpen  bool
+	messageID string
+}
+
+func (w *anthropicStreamWriter) event(name string, data interface{}) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("序列化Anthropic事件失败")
+		return
+	}
+	fmt.Fprintf(w.c.Writer, "event: %s\ndata: %s\n\n", name, jsonData)
+	w.flusher.Flush()
+}
+
+// start 首次输出内容时发送message_start事件
+func (w *anthropicStreamWriter) start(model string, inputTokens int) {
+	if w.started {
+		return
+	}
+	w.started = true
+	setSSEHeaders(w.c)
+
+	w.event("message_start", gin.H{
+		"type": "message_start",
+		"message": gin.H{
+			"id":            w.messageID,
+			"type":          "message",
+			"role":          "assistant",
+			"model":         model,
+			"content":       []interface{}{},
+			"stop_reason":   nil,
+			"stop_sequence": nil,
+			"usage":         AnthropicUsage{InputTokens: inputTokens},
+		},
+	})
+	w.event("ping", gin.H{"type": "ping"})
+}
+
+func (w *anthropicStreamWriter) text(text string) {
+	if text == "" {
+		return
+	}
+	if !w.textOpen {
+		w.event("content_block_start", gin.H{
+			"type":          "content_block_start",
+			"index":         w.index,
+			"content_block": gin.H{"type": "text", "text": ""},
+		})
+		w.textOpen = true
+	}
+	w.event("content_block_delta", gin.H{
+		"type":  "content_block_delta",
+		"index": w.index,
+		"delta": gin.H{"type": "text_delta", "text": text},
+	})
+}
+
+func (w *anthropicStreamWriter) closeText() {
+	if !w.textOpen {
+		return
+	}
+	w.event("content_block_stop", gin.H{"type": "content_block_stop", "index": w.index})
+	w.textOpen = false
+	w.index++
+}
+
+func (w *anthropicStreamWriter) toolUse(call ToolCall) {
+	w.closeText()
+	block := anthropicToolUseBlock(call)
+	w.event("content_block_start", gin.H{
+		"type":          "content_block_start",
+		"index":         w.index,
+		"content_block": gin.H{"type": "tool_use", "id": block.ID, "name": block.Name, "input": gin.H{}},
+	})
+	w.event("content_block_delta", gin.H{
+		"type":  "content_block_delta",
+		"index": w.index,
+		"delta": gin.H{"type": "input_json_delta", "partial_json": string(block.Input)},
+	})
+	w.event("content_block_stop", gin.H{"type": "content_block_stop", "index": w.index})
+	w.index++
+}
+
+// handleAnthropicStream 以Anthropic SSE事件流式返回
+func handleAnthropicStream(c *gin.Context, req AnthropicRequest, augmentReq AugmentRequest, token string) {
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		writeAnthropicError(c, http.StatusInternalServerError, "api_error", "流式传输不支持")
+		return
+	}
+
+	inputTokens := estimatePromptTokens(augmentReq)
+	output := newAnthropicOutput(req)
+	writer := &anthropicStreamWriter{
+		c:         c,
+		flusher:   flusher,
+		messageID: "msg_" + strings.ReplaceAll(uuid.New().String(), "-", ""),
+	}
+
+	setStreamKeepalive(c, func() { writeSSEPing(c, flusher) })
+	token, upstreamErr := forwardWithFailover(c, req.Model, augmentReq, func(augmentResp AugmentResponse) bool {
+		writer.start(req.Model, inputTokens)
+		text, toolCalls, stop := output.add(augmentResp)
+		writer.text(text)
+		for _, call := range toolCalls {
+			writer.toolUse(call)
+		}
+		return !stop
+	})
+
+	if upstreamErr != nil && upstreamErr.Kind == upstreamCancelled {
+		handleClientCancel(c, token)
+		return
+	}
+	if upstreamErr != nil {
+		// 已开始输出时以error事件结束，不能让客户端把截断的回复当作正常结束
+		writeAnthropicError(c, upstreamErr.StatusCode, anthropicErrorType(upstreamErr.StatusCode), upstreamErr.Message)
+		if writer.started {
+			logger.Log.WithFields(logrus.Fields{
+				"error": upstreamErr.Message,
+				"model": req.Model,
+			}).Error("流式响应中断")
+		}
+		return
+	}
+
+	writer.start(req.Model, inputTokens)
+	writer.text(output.finish())
+	writer.closeText()
+
+	usage := chatUsage(augmentReq, output.text)
+	asyncRecordTokenCounts(c, token, usage)
+
+	writer.event("message_delta", gin.H{
+		"type": "message_delta",
+		"delta": gin.H{
+			"stop_reason":   output.stopReason,
+			"stop_sequence": output.stopSequence,
+		},
+		"usage": gin.H{"output_tokens": usage.CompletionTokens},
+	})
+	writer.event("message_stop", gin.H{"type": "message_stop"})
+}
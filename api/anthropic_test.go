@@ -0,0 +1,223 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// decodeTranscript 解析录制的chat-stream响应（每行一个JSON）
+func decodeTranscript(t *testing.T, transcript string) []AugmentResponse {
+	t.Helper()
+	var responses []AugmentResponse
+	scanner := bufio.NewScanner(strings.NewReader(transcript))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var resp AugmentResponse
+		if err := json.Unmarshal([]byte(line), &resp); err != nil {
+			t.Fatalf("解析录制的响应失败: %v: %s", err, line)
+		}
+		responses = append(responses, resp)
+	}
+	return responses
+}
+
+func TestAnthropicRequestToOpenAI(t *testing.T) {
+	tests := []struct {
+		name       string
+		request    string
+		messages   []ChatMessage
+		toolChoice interface{}
+		tools      []string
+	}{
+		{
+			name: "text",
+			request: `{"model":"claude-3.7","max_tokens":100,"system":[{"type":"text","text":"be brief"}],
+				"messages":[{"role":"user","content":"hi"},{"role":"assistant","content":[{"type":"text","text":"hello"}]}]}`,
+			messages: []ChatMessage{
+				{Role: "system", Content: "be brief"},
+				{Role: "user", Content: "hi"},
+				{Role: "assistant", Content: []interface{}{map[string]interface{}{"type": "text", "text": "hello"}}},
+			},
+		},
+		{
+			name: "tool_use",
+			request: `{"model":"claude-3.7","max_tokens":100,
+				"tools":[{"name":"get_weather","input_schema":{"type":"object"}}],
+				"tool_choice":{"type":"tool","name":"get_weather"},
+				"messages":[
+					{"role":"user","content":"weather?"},
+					{"role":"assistant","content":[{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{"city":"Paris"}}]},
+					{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":"sunny"}]}]}`,
+			messages: []ChatMessage{
+				{Role: "user", Content: "weather?"},
+				{Role: "assistant", Content: []interface{}(nil), ToolCalls: []ToolCall{{
+					ID:       "toolu_1",
+					Type:     "function",
+					Function: ToolCallFunction{Name: "get_weather", Arguments: `{"city":"Paris"}`},
+				}}},
+				{Role: "tool", ToolCallID: "toolu_1", Content: "sunny"},
+			},
+			toolChoice: map[string]interface{}{
+				"type":     "function",
+				"function": map[string]interface{}{"name": "get_weather"},
+			},
+			tools: []string{"get_weather"},
+		},
+		{
+			name:       "tool_choice any",
+			request:    `{"model":"claude-3.7","max_tokens":100,"tool_choice":{"type":"any"},"messages":[{"role":"user","content":"hi"}]}`,
+			messages:   []ChatMessage{{Role: "user", Content: "hi"}},
+			toolChoice: "required",
+		},
+		{
+			name:       "tool_choice auto",
+			request:    `{"model":"claude-3.7","max_tokens":100,"tool_choice":{"type":"auto"},"messages":[{"role":"user","content":"hi"}]}`,
+			messages:   []ChatMessage{{Role: "user", Content: "hi"}},
+			toolChoice: "auto",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req AnthropicRequest
+			if err := json.Unmarshal([]byte(tt.request), &req); err != nil {
+				t.Fatalf("解析请求失败: %v", err)
+			}
+			got := req.toOpenAIRequest()
+
+			if !reflect.DeepEqual(got.Messages, tt.messages) {
+				gotJSON, _ := json.Marshal(got.Messages)
+				wantJSON, _ := json.Marshal(tt.messages)
+				t.Errorf("messages = %s, want %s", gotJSON, wantJSON)
+			}
+			if !reflect.DeepEqual(got.ToolChoice, tt.toolChoice) {
+				t.Errorf("tool_choice = %#v, want %#v", got.ToolChoice, tt.toolChoice)
+			}
+			var tools []string
+			for _, tool := range got.Tools {
+				tools = append(tools, tool.Function.Name)
+			}
+			if !reflect.DeepEqual(tools, tt.tools) {
+				t.Errorf("tools = %v, want %v", tools, tt.tools)
+			}
+		})
+	}
+}
+
+func TestAnthropicOutput(t *testing.T) {
+	tests := []struct {
+		name          string
+		request       AnthropicRequest
+		transcript    string
+		text          string
+		stopReason    string
+		stopSequence  string
+		toolCalls     []string
+		stoppedBefore int // 应在第几条响应后停止读取，0表示读取全部
+	}{
+		{
+			name:    "text",
+			request: AnthropicRequest{MaxTokens: 1000},
+			transcript: `
+{"text":"Hello","done":false}
+{"text":", world","done":false}
+{"text":"!","done":true}`,
+			text:       "Hello, world!",
+			stopReason: "end_turn",
+		},
+		{
+			name:    "tool_use",
+			request: AnthropicRequest{MaxTokens: 1000},
+			transcript: `
+{"text":"Let me check.","done":false}
+{"text":"","done":false,"nodes":[{"id":1,"type":5,"tool_use":{"tool_use_id":"toolu_1","tool_name":"get_weather","input_json":"{\"city\":\"Paris\"}"}}]}
+{"text":"","done":false,"nodes":[{"id":1,"type":5,"tool_use":{"tool_use_id":"toolu_1","tool_name":"get_weather","input_json":"{\"city\":\"Paris\"}"}}]}
+{"text":"","done":true}`,
+			text:       "Let me check.",
+			stopReason: "tool_use",
+			toolCalls:  []string{"get_weather"},
+		},
+		{
+			name:    "stop_sequence split across chunks",
+			request: AnthropicRequest{MaxTokens: 1000, StopSequences: []string{"END"}},
+			transcript: `
+{"text":"one two E","done":false}
+{"text":"ND three","done":false}
+{"text":" four","done":true}`,
+			text:          "one two ",
+			stopReason:    "stop_sequence",
+			stopSequence:  "END",
+			stoppedBefore: 2,
+		},
+		{
+			name:    "stop_sequence not matched",
+			request: AnthropicRequest{MaxTokens: 1000, StopSequences: []string{"END"}},
+			transcript: `
+{"text":"the E","done":false}
+{"text":"N","done":false}
+{"text":"D is near","done":false}
+{"text":"","done":true}`,
+			text:          "the ",
+			stopReason:    "stop_sequence",
+			stopSequence:  "END",
+			stoppedBefore: 3,
+		},
+		{
+			name:    "stop_sequence absent",
+			request: AnthropicRequest{MaxTokens: 1000, StopSequences: []string{"STOP"}},
+			transcript: `
+{"text":"no stop ","done":false}
+{"text":"here ST","done":true}`,
+			text:       "no stop here ST",
+			stopReason: "end_turn",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := newAnthropicOutput(tt.request)
+			consumed := 0
+			for _, resp := range decodeTranscript(t, tt.transcript) {
+				consumed++
+				if _, _, stop := output.add(resp); stop {
+					break
+				}
+			}
+			output.finish()
+
+			if output.text != tt.text {
+				t.Errorf("text = %q, want %q", output.text, tt.text)
+			}
+			if output.stopReason != tt.stopReason {
+				t.Errorf("stop_reason = %q, want %q", output.stopReason, tt.stopReason)
+			}
+			stopSequence := ""
+			if output.stopSequence != nil {
+				stopSequence = *output.stopSequence
+			}
+			if stopSequence != tt.stopSequence {
+				t.Errorf("stop_sequence = %q, want %q", stopSequence, tt.stopSequence)
+			}
+			var toolCalls []string
+			for _, call := range output.toolCalls.calls {
+				toolCalls = append(toolCalls, call.Function.Name)
+				block := anthropicToolUseBlock(call)
+				if block.Type != "tool_use" || !json.Valid(block.Input) {
+					t.Errorf("tool_use块无效: %+v", block)
+				}
+			}
+			if !reflect.DeepEqual(toolCalls, tt.toolCalls) {
+				t.Errorf("tool calls = %v, want %v", toolCalls, tt.toolCalls)
+			}
+			if tt.stoppedBefore > 0 && consumed != tt.stoppedBefore {
+				t.Errorf("在第%d条响应后停止, want %d", consumed, tt.stoppedBefore)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// APIKeyRequest 创建/更新API Key的请求结构，更新时未传的字段保持原值
+type APIKeyRequest struct {
+	Key            string  `json:"key"`  // 创建时可选，为空则自动生成
+	Name           string  `json:"name"` // 创建时必填，更新时为空则保留原名称
+	PromptTemplate *string `json:"prompt_template"`
+	CacheTTL       *int    `json:"cache_ttl"`
+	Pool           *string `json:"pool"` // 为空时使用全部token
+	Enabled        *bool   `json:"enabled"`
+}
+
+// validate 校验请求中传入的token池是否存在
+func (r APIKeyRequest) validate() error {
+	if r.Pool != nil && *r.Pool != "" {
+		if _, err := config.GetTokenPool(*r.Pool); err != nil {
+			return fmt.Errorf("token池不存在: %s", *r.Pool)
+		}
+	}
+	return nil
+}
+
+// apply 将请求中传入的字段写入API Key
+func (r APIKeyRequest) apply(apiKey *config.APIKey) {
+	if r.Name != "" {
+		apiKey.Name = r.Name
+	}
+	if r.PromptTemplate != nil {
+		apiKey.PromptTemplate = *r.PromptTemplate
+	}
+	if r.CacheTTL != nil {
+		apiKey.CacheTTL = *r.CacheTTL
+	}
+	if r.Pool != nil {
+		apiKey.Pool = *r.Pool
+	}
+	if r.Enabled != nil {
+		apiKey.Enabled = *r.Enabled
+	}
+}
+
+// generateAPIKey 生成随机的API Key
+func generateAPIKey() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "sk-" + hex.EncodeToString(buf), nil
+}
+
+// requestAPIKey 获取当前请求使用的下游API Key配置，未使用API Key鉴权时返回空配置
+func requestAPIKey(c *gin.Context) config.APIKey {
+	if value, exists := c.Get("api_key"); exists {
+		if apiKey, ok := value.(config.APIKey); ok {
+			return apiKey
+		}
+	}
+	return config.APIKey{}
+}
+
+// GetAPIKeys 获取所有API Key配置
+func GetAPIKeys(c *gin.Context) {
+	apiKeys, err := config.GetAllAPIKeys()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取API Key失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"keys":   apiKeys,
+		"total":  len(apiKeys),
+	})
+}
+
+// CreateAPIKey 创建API Key
+func CreateAPIKey(c *gin.Context) {
+	var req APIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "请求数据格式错误: " + err.Error(),
+		})
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "名称不能为空",
+		})
+		return
+	}
+	if err := req.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	key := strings.TrimSpace(req.Key)
+	if key == "" {
+		var err error
+		key, err = generateAPIKey()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "error",
+				"error":  "生成API Key失败",
+			})
+			return
+		}
+	} else if _, err := config.GetAPIKey(key); err == nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "API Key已存在",
+		})
+		return
+	}
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+	apiKey := config.APIKey{
+		Key:       key,
+		Enabled:   true,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	req.apply(&apiKey)
+
+	if err := config.SetAPIKey(apiKey); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "保存API Key失败: " + err.Error(),
+		})
+		return
+	}
+
+	logger.Log.WithFields(logrus.Fields{
+		"name":     apiKey.Name,
+		"template": apiKey.PromptTemplate,
+	}).Info("创建API Key成功")
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"key":    apiKey,
+	})
+}
+
+// UpdateAPIKey 更新API Key的名称、提示词模板和启用状态
+func UpdateAPIKey(c *gin.Context) {
+	apiKey, err := config.GetAPIKey(c.Param("key"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  "API Key不存在",
+		})
+		return
+	}
+
+	var req APIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "请求数据格式错误: " + err.Error(),
+		})
+		return
+	}
+	if err := req.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	req.apply(&apiKey)
+	apiKey.UpdatedAt = time.Now().Format("2006-01-02 15:04:05")
+
+	if err := config.SetAPIKey(apiKey); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "更新API Key失败: " + err.Error(),
+		})
+		return
+	}
+
+	logger.Log.WithFields(logrus.Fields{
+		"name":    apiKey.Name,
+		"enabled": apiKey.Enabled,
+	}).Info("更新API Key成功")
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"key":    apiKey,
+	})
+}
+
+// DeleteAPIKey 删除API Key
+func DeleteAPIKey(c *gin.Context) {
+	key := c.Param("key")
+	apiKey, err := config.GetAPIKey(key)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  "API Key不存在",
+		})
+		return
+	}
+
+	if err := config.DeleteAPIKey(key); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "删除API Key失败: " + err.Error(),
+		})
+		return
+	}
+
+	logger.Log.WithFields(logrus.Fields{
+		"name": apiKey.Name,
+	}).Info("删除API Key成功")
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"augment2api/config"
+	"encoding/json"
+	"testing"
+)
+
+func TestAPIKeyRequestApply(t *testing.T) {
+	existing := config.APIKey{
+		Key:            "sk-test",
+		Name:           "team",
+		PromptTemplate: "concise",
+		CacheTTL:       60,
+		Pool:           "team-pool",
+		Enabled:        true,
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want config.APIKey
+	}{
+		{
+			name: "empty body keeps every field",
+			body: `{}`,
+			want: existing,
+		},
+		{
+			name: "only enabled is sent",
+			body: `{"enabled":false}`,
+			want: config.APIKey{Key: "sk-test", Name: "team", PromptTemplate: "concise", CacheTTL: 60, Pool: "team-pool"},
+		},
+		{
+			name: "explicit zero values clear fields",
+			body: `{"prompt_template":"","cache_ttl":0,"pool":""}`,
+			want: config.APIKey{Key: "sk-test", Name: "team", Enabled: true},
+		},
+		{
+			name: "name and cache ttl",
+			body: `{"name":"ops","cache_ttl":-1}`,
+			want: config.APIKey{Key: "sk-test", Name: "ops", PromptTemplate: "concise", CacheTTL: -1, Pool: "team-pool", Enabled: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req APIKeyRequest
+			if err := json.Unmarshal([]byte(tt.body), &req); err != nil {
+				t.Fatalf("解析请求失败: %v", err)
+			}
+			apiKey := existing
+			req.apply(&apiKey)
+			if apiKey != tt.want {
+				t.Errorf("api key = %+v, want %+v", apiKey, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIKeyRequestValidate(t *testing.T) {
+	newFakeRedis(t)
+	if err := config.SetTokenPool(config.TokenPool{Name: "team-pool"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		body    string
+		wantErr bool
+	}{
+		{name: "no pool", body: `{}`},
+		{name: "clear pool", body: `{"pool":""}`},
+		{name: "existing pool", body: `{"pool":"team-pool"}`},
+		{name: "unknown pool", body: `{"pool":"other"}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req APIKeyRequest
+			if err := json.Unmarshal([]byte(tt.body), &req); err != nil {
+				t.Fatal(err)
+			}
+			if err := req.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,489 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// augmentUserAgent 请求Augment接口时使用的客户端标识
+const augmentUserAgent = "augment.intellij/0.184.0 (Mac OS X; aarch64; 15.2) WebStorm/2024.3.5"
+
+// upstreamErrorKind 上游错误分类
+type upstreamErrorKind int
+
+const (
+	upstreamRequestFailed upstreamErrorKind = iota // 请求未能发出或连接失败
+	upstreamStatusError                            // 返回非200状态码
+	upstreamReadFailed                             // 读取响应流失败
+	upstreamBlocked                                // 响应包含block信息
+	upstreamCancelled                              // 客户端已断开连接
+)
+
+// upstreamError 请求Augment失败时返回的错误
+type upstreamError struct {
+	Kind       upstreamErrorKind
+	StatusCode int
+	Message    string
+	RetryAfter time.Duration // 上游Retry-After要求的等待时间，未返回时为0
+}
+
+func (e *upstreamError) Error() string {
+	return e.Message
+}
+
+// cancelledError 客户端断开连接时返回的错误
+func cancelledError() *upstreamError {
+	return &upstreamError{Kind: upstreamCancelled, StatusCode: statusClientClosedRequest, Message: "客户端已断开连接"}
+}
+
+// AugmentEventType 流式事件类型
+type AugmentEventType int
+
+const (
+	AugmentEventResponse AugmentEventType = iota // 收到一条响应
+	AugmentEventFallback                         // 切换到CHAT模式重新请求
+	AugmentEventError                            // 请求失败，随后通道关闭
+)
+
+// AugmentEvent Stream返回的流式事件
+type AugmentEvent struct {
+	Type     AugmentEventType
+	Response AugmentResponse // AugmentEventResponse时有效
+	Mode     string          // AugmentEventFallback时为切换后的模式
+	Err      *upstreamError  // AugmentEventError时有效
+}
+
+// AugmentClient 封装对租户接口的请求：统一请求头、错误分类、CHAT模式回退和流式解码
+type AugmentClient struct {
+	Token      string
+	Tenant     string
+	HTTPClient *http.Client
+	// RecordSession 请求成功后是否异步上报会话事件
+	RecordSession bool
+	// Fallback 判断失败后是否切换到CHAT模式重试，为nil时使用shouldFallbackToChat
+	Fallback func(augmentReq AugmentRequest, err *upstreamError) bool
+}
+
+// NewAugmentClient 创建使用全局HTTP配置的客户端
+func NewAugmentClient(token, tenant string) *AugmentClient {
+	return &AugmentClient{
+		Token:         token,
+		Tenant:        tenant,
+		HTTPClient:    createHTTPClient(tenant),
+		RecordSession: true,
+	}
+}
+
+// post 向租户的指定接口发送JSON请求，返回原始响应
+func (ac *AugmentClient) post(ctx context.Context, endpoint string, payload interface{}, requestID, sessionID string) (*http.Response, error) {
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("序列化请求失败: %v", err)
+	}
+
+	// 提取主机部分
+	parsedURL, err := url.Parse(ac.Tenant)
+	if err != nil {
+		return nil, fmt.Errorf("解析租户URL失败: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", ac.Tenant+endpoint, bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("创建请求失败: %v", err)
+	}
+
+	req.Header.Set("Host", parsedURL.Host)
+	req.Header.Set("Content-Length", fmt.Sprintf("%d", len(jsonData)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+ac.Token)
+	req.Header.Set("User-Agent", augmentUserAgent)
+	req.Header.Set("x-api-version", "2")
+	req.Header.Set("x-request-id", requestID)
+	req.Header.Set("x-request-session-id", sessionID)
+	req.Header.Set("Accept-Charset", "UTF-8")
+
+	return ac.HTTPClient.Do(req)
+}
+
+// Stream 请求chat-stream并将解码后的响应以事件形式发送到通道
+// 非CHAT模式在输出任何响应前失败（请求失败、读取失败或被block）时，切换到CHAT模式重试一次；
+// 检测到block时将token加入冷却。ctx取消后停止读取并关闭通道
+func (ac *AugmentClient) Stream(ctx context.Context, augmentReq AugmentRequest) <-chan AugmentEvent {
+	events := make(chan AugmentEvent)
+
+	go func() {
+		defer close(events)
+
+		send := func(event AugmentEvent) bool {
+			select {
+			case events <- event:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		delivered := false
+		for {
+			err := ac.streamOnce(ctx, augmentReq, func(augmentResp AugmentResponse) bool {
+				delivered = true
+				return send(AugmentEvent{Type: AugmentEventResponse, Response: augmentResp})
+			})
+			if err == nil {
+				return
+			}
+
+			if err.Kind == upstreamBlocked {
+				coolDownToken(ac.Token, augmentReq.Mode)
+			}
+
+			if !delivered && ac.shouldFallback(augmentReq, err) {
+				logger.Log.WithFields(logrus.Fields{
+					"mode":  augmentReq.Mode,
+					"error": err.Message,
+				}).Info("尝试切换到 CHAT 模式回复！")
+				fallbackToChatMode(&augmentReq)
+				if !send(AugmentEvent{Type: AugmentEventFallback, Mode: augmentReq.Mode}) {
+					return
+				}
+				continue
+			}
+
+			send(AugmentEvent{Type: AugmentEventError, Err: err})
+			return
+		}
+	}()
+
+	return events
+}
+
+func (ac *AugmentClient) shouldFallback(augmentReq AugmentRequest, err *upstreamError) bool {
+	if ac.Fallback != nil {
+		return ac.Fallback(augmentReq, err)
+	}
+	return shouldFallbackToChat(augmentReq, err)
+}
+
+// shouldFallbackToChat 默认的CHAT模式回退策略：只有非CHAT模式的连接、读取失败或被block才回退
+func shouldFallbackToChat(augmentReq AugmentRequest, err *upstreamError) bool {
+	if augmentReq.Mode == "CHAT" {
+		return false
+	}
+	switch err.Kind {
+	case upstreamRequestFailed, upstreamReadFailed, upstreamBlocked:
+		return true
+	}
+	return false
+}
+
+// streamOnce 发送一次chat-stream请求并逐行解码，handle返回false时停止读取
+// 等待首个响应超过upstream_first_byte_timeout、或两次响应间隔超过upstream_idle_timeout时中止请求
+func (ac *AugmentClient) streamOnce(ctx context.Context, augmentReq AugmentRequest, handle func(AugmentResponse) bool) *upstreamError {
+	requestID := uuid.New().String()
+	sessionID := uuid.New().String()
+
+	reqCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	watchdog := newUpstreamWatchdog(cancel)
+	defer watchdog.stop()
+	watchdog.reset(config.AppConfig.UpstreamFirstByteTimeout, "等待上游首个响应超时")
+
+	resp, err := ac.post(reqCtx, "chat-stream", augmentReq, requestID, sessionID)
+	if err != nil {
+		if ctx.Err() != nil {
+			return cancelledError()
+		}
+		if watchdog.expired() {
+			return watchdog.timeoutError(upstreamRequestFailed, augmentReq.Mode)
+		}
+		logger.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+			"mode":  augmentReq.Mode,
+		}).Error("请求失败")
+		return &upstreamError{Kind: upstreamRequestFailed, StatusCode: http.StatusInternalServerError, Message: "请求失败: " + err.Error()}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &upstreamError{
+			Kind:       upstreamStatusError,
+			StatusCode: resp.StatusCode,
+			Message:    readAugmentError(resp),
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+
+	if ac.RecordSession {
+		asyncRecordSessionEvent(ac.Token, ac.Tenant, requestID, sessionID)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		// 读取返回后立即停止计时并取得是否已超时，已读到的数据照常处理，读取失败时才按超时返回
+		expired := watchdog.stop()
+		if err != nil {
+			if ctx.Err() != nil {
+				return cancelledError()
+			}
+			if expired {
+				return watchdog.timeoutError(upstreamReadFailed, augmentReq.Mode)
+			}
+			if err == io.EOF {
+				return nil
+			}
+			logger.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+				"mode":  augmentReq.Mode,
+			}).Error("读取响应失败")
+			return &upstreamError{Kind: upstreamReadFailed, StatusCode: http.StatusInternalServerError, Message: "读取响应失败: " + err.Error()}
+		}
+
+		// 空行和无法解析的行不算上游输出，按原截止时间继续计时
+		line = strings.TrimSpace(line)
+		if line == "" {
+			watchdog.resume()
+			continue
+		}
+
+		var augmentResp AugmentResponse
+		if err := json.Unmarshal([]byte(line), &augmentResp); err != nil {
+			watchdog.resume()
+			continue
+		}
+
+		if strings.Contains(augmentResp.Text, errBlocked) {
+			return &upstreamError{Kind: upstreamBlocked, StatusCode: http.StatusTooManyRequests, Message: errBlocked}
+		}
+
+		// 交给handle处理期间（例如向较慢的客户端写入）不计入上游空闲时间
+		if !handle(augmentResp) || augmentResp.Done {
+			return nil
+		}
+		watchdog.reset(config.AppConfig.UpstreamIdleTimeout, "等待上游后续响应超时")
+	}
+}
+
+// upstreamWatchdog 在规定时间内没有收到上游响应时取消请求
+// 计时器回调与stop通过mu互斥，stop返回后不会再触发取消，返回值即请求是否已因超时被取消
+type upstreamWatchdog struct {
+	cancel   context.CancelFunc
+	timeout  time.Duration
+	reason   string
+	deadline time.Time // 当前计时的截止时间，不限制等待时间时为零值
+
+	mu    sync.Mutex
+	timer *time.Timer
+	fired bool
+}
+
+func newUpstreamWatchdog(cancel context.CancelFunc) *upstreamWatchdog {
+	return &upstreamWatchdog{cancel: cancel}
+}
+
+// reset 重新开始计时，timeout不大于0时不限制等待时间
+func (w *upstreamWatchdog) reset(timeout time.Duration, reason string) {
+	w.stop()
+	w.timeout = timeout
+	w.reason = reason
+	w.deadline = time.Time{}
+	if timeout <= 0 {
+		return
+	}
+	w.deadline = time.Now().Add(timeout)
+	w.start(timeout)
+}
+
+// resume 在stop之后按原截止时间继续计时
+func (w *upstreamWatchdog) resume() {
+	if w.deadline.IsZero() {
+		return
+	}
+	w.start(time.Until(w.deadline))
+}
+
+func (w *upstreamWatchdog) start(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		// 已被stop或reset的计时器不再取消请求
+		if w.timer != timer {
+			return
+		}
+		w.fired = true
+		w.cancel()
+	})
+	w.timer = timer
+}
+
+// stop 停止计时，返回请求是否已因超时被取消
+func (w *upstreamWatchdog) stop() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	return w.fired
+}
+
+// expired 判断请求是否因超时被取消
+func (w *upstreamWatchdog) expired() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.fired
+}
+
+func (w *upstreamWatchdog) timeoutError(kind upstreamErrorKind, mode string) *upstreamError {
+	message := fmt.Sprintf("%s（%s）", w.reason, w.timeout)
+	logger.Log.WithFields(logrus.Fields{
+		"timeout": w.timeout.String(),
+		"mode":    mode,
+	}).Error(message)
+	return &upstreamError{Kind: kind, StatusCode: http.StatusGatewayTimeout, Message: message}
+}
+
+// forwardAugmentStream 请求Augment并将每条响应交给handle处理，handle返回false时停止读取
+// ctx取消（客户端断开）时立即中止上游请求并返回upstreamCancelled错误；
+// 等待上游输出期间按heartbeat的间隔发送心跳，heartbeat为nil时不发送
+func forwardAugmentStream(ctx context.Context, client *AugmentClient, augmentReq AugmentRequest, heartbeat *streamHeartbeat, handle func(AugmentResponse) bool) *upstreamError {
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var upstreamErr *upstreamError
+	stopped := false
+	events := client.Stream(streamCtx, augmentReq)
+	for done := false; !done; {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				done = true
+				break
+			}
+			switch event.Type {
+			case AugmentEventResponse:
+				heartbeat.delay()
+				if !stopped && !handle(event.Response) {
+					// 停止读取，等待通道关闭
+					stopped = true
+					cancel()
+				}
+			case AugmentEventError:
+				upstreamErr = event.Err
+			}
+		case <-heartbeat.C():
+			if !stopped {
+				heartbeat.beat()
+			}
+		}
+	}
+
+	if ctx.Err() != nil {
+		return cancelledError()
+	}
+	if stopped {
+		return nil
+	}
+	return upstreamErr
+}
+
+// readAugmentError 读取Augment的非200响应并生成错误信息
+func readAugmentError(resp *http.Response) string {
+	body, err := io.ReadAll(resp.Body)
+	errMsg := "Augment response error"
+	if err != nil {
+		return errMsg
+	}
+
+	bodyStr := string(body)
+	// 检查是否是HTML错误页面（网关或负载均衡返回的错误页）
+	if strings.Contains(bodyStr, "<html>") || strings.Contains(bodyStr, "<!DOCTYPE") {
+		logger.Log.WithFields(logrus.Fields{
+			"status_code":      resp.StatusCode,
+			"response_preview": bodyStr[:min(200, len(bodyStr))],
+		}).Error("收到HTML错误页面，上游服务暂时不可用")
+		return fmt.Sprintf("Service temporarily unavailable (%d %s)", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	return errMsg + ": " + bodyStr
+}
+
+// parseRetryAfter 解析Retry-After响应头，支持秒数和HTTP日期两种格式
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// 异步记录用户会话事件
+func asyncRecordSessionEvent(token, tenantURL, requestID, sessionID string) {
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				logger.Log.WithFields(logrus.Fields{
+					"error":      r,
+					"token":      token,
+					"tenant_url": tenantURL,
+				}).Error("记录会话事件时发生panic")
+			}
+		}()
+
+		// 构建事件数据
+		currentTime := time.Now()
+		eventData := map[string]interface{}{
+			"events": []map[string]interface{}{
+				{
+					"event_name":      "used-chat",
+					"event_time_sec":  currentTime.Unix(),
+					"event_time_nsec": currentTime.UnixNano() % 1000000000,
+				},
+			},
+		}
+
+		client := NewAugmentClient(token, tenantURL)
+		resp, err := client.post(context.Background(), "record-onboarding-session-event", eventData, requestID, sessionID)
+		if err != nil {
+			logger.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("发送记录事件请求失败")
+			return
+		}
+		defer resp.Body.Close()
+
+		// 记录响应状态
+		logger.Log.WithFields(logrus.Fields{
+			"status_code": resp.StatusCode,
+			"tenant_url":  tenantURL,
+		}).Info("记录会话事件完成")
+	}()
+}
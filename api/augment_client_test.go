@@ -0,0 +1,321 @@
+package api
+
+import (
+	"augment2api/config"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeChatStream 模拟租户的chat-stream接口，记录每次请求的模式，按请求序号调用respond
+type fakeChatStream struct {
+	mu      sync.Mutex
+	modes   []string
+	respond func(attempt int, w http.ResponseWriter, r *http.Request)
+}
+
+func (f *fakeChatStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var augmentReq AugmentRequest
+	json.NewDecoder(r.Body).Decode(&augmentReq)
+
+	f.mu.Lock()
+	attempt := len(f.modes)
+	f.modes = append(f.modes, augmentReq.Mode)
+	f.mu.Unlock()
+
+	f.respond(attempt, w, r)
+}
+
+// newFakeClient 启动模拟接口并创建指向它的客户端
+func newFakeClient(t *testing.T, respond func(attempt int, w http.ResponseWriter, r *http.Request)) (*AugmentClient, *fakeChatStream) {
+	t.Helper()
+	fake := &fakeChatStream{respond: respond}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return &AugmentClient{
+		Token:      "test-token",
+		Tenant:     server.URL + "/",
+		HTTPClient: server.Client(),
+	}, fake
+}
+
+// writeLines 以NDJSON格式写出响应
+func writeLines(w http.ResponseWriter, lines ...string) {
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+		w.(http.Flusher).Flush()
+	}
+}
+
+// breakBody 声明比实际更长的响应体，客户端读取时得到unexpected EOF
+func breakBody(w http.ResponseWriter, lines ...string) {
+	w.Header().Set("Content-Length", "4096")
+	w.WriteHeader(http.StatusOK)
+	writeLines(w, lines...)
+}
+
+// withUpstreamTimeouts 在测试期间修改上游超时配置
+func withUpstreamTimeouts(t *testing.T, firstByte, idle time.Duration) {
+	t.Helper()
+	previous := config.AppConfig
+	config.AppConfig.UpstreamFirstByteTimeout = firstByte
+	config.AppConfig.UpstreamIdleTimeout = idle
+	t.Cleanup(func() { config.AppConfig = previous })
+}
+
+// collectEvents 读取Stream的全部事件
+func collectEvents(events <-chan AugmentEvent) []AugmentEvent {
+	var collected []AugmentEvent
+	for event := range events {
+		collected = append(collected, event)
+	}
+	return collected
+}
+
+func TestAugmentClientStreamFallback(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		respond func(attempt int, w http.ResponseWriter, r *http.Request)
+		modes   []string
+		events  []AugmentEventType
+		text    string
+	}{
+		{
+			name: "read failure before output falls back to CHAT",
+			mode: "AGENT",
+			respond: func(attempt int, w http.ResponseWriter, r *http.Request) {
+				if attempt == 0 {
+					breakBody(w)
+					return
+				}
+				writeLines(w, `{"text":"hello","done":false}`, `{"text":" world","done":true}`)
+			},
+			modes:  []string{"AGENT", "CHAT"},
+			events: []AugmentEventType{AugmentEventFallback, AugmentEventResponse, AugmentEventResponse},
+			text:   "hello world",
+		},
+		{
+			name: "read failure after output does not fall back",
+			mode: "AGENT",
+			respond: func(attempt int, w http.ResponseWriter, r *http.Request) {
+				breakBody(w, `{"text":"partial","done":false}`)
+			},
+			modes:  []string{"AGENT"},
+			events: []AugmentEventType{AugmentEventResponse, AugmentEventError},
+			text:   "partial",
+		},
+		{
+			name: "status error does not fall back",
+			mode: "AGENT",
+			respond: func(attempt int, w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+			},
+			modes:  []string{"AGENT"},
+			events: []AugmentEventType{AugmentEventError},
+		},
+		{
+			name: "CHAT mode does not fall back",
+			mode: "CHAT",
+			respond: func(attempt int, w http.ResponseWriter, r *http.Request) {
+				breakBody(w)
+			},
+			modes:  []string{"CHAT"},
+			events: []AugmentEventType{AugmentEventError},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withUpstreamTimeouts(t, 5*time.Second, 5*time.Second)
+			client, fake := newFakeClient(t, tt.respond)
+
+			augmentReq := newAugmentRequest(tt.mode, "", "")
+			augmentReq.ToolDefinitions = []ToolDefinition{{Name: "web-search"}}
+			events := collectEvents(client.Stream(context.Background(), augmentReq))
+
+			var types []AugmentEventType
+			text := ""
+			for _, event := range events {
+				types = append(types, event.Type)
+				text += event.Response.Text
+				if event.Type == AugmentEventFallback && event.Mode != "CHAT" {
+					t.Errorf("fallback mode = %q, want CHAT", event.Mode)
+				}
+			}
+			if fmt.Sprint(types) != fmt.Sprint(tt.events) {
+				t.Errorf("events = %v, want %v", types, tt.events)
+			}
+			if fmt.Sprint(fake.modes) != fmt.Sprint(tt.modes) {
+				t.Errorf("upstream modes = %v, want %v", fake.modes, tt.modes)
+			}
+			if text != tt.text {
+				t.Errorf("text = %q, want %q", text, tt.text)
+			}
+		})
+	}
+}
+
+func TestAugmentClientErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		firstByte  time.Duration
+		idle       time.Duration
+		respond    func(attempt int, w http.ResponseWriter, r *http.Request)
+		kind       upstreamErrorKind
+		status     int
+		message    string
+		retryAfter time.Duration
+	}{
+		{
+			name: "rate limited",
+			respond: func(attempt int, w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Retry-After", "7")
+				http.Error(w, "slow down", http.StatusTooManyRequests)
+			},
+			kind:       upstreamStatusError,
+			status:     http.StatusTooManyRequests,
+			message:    "Augment response error: slow down\n",
+			retryAfter: 7 * time.Second,
+		},
+		{
+			name: "html error page",
+			respond: func(attempt int, w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadGateway)
+				fmt.Fprint(w, "<html><body>bad gateway</body></html>")
+			},
+			kind:    upstreamStatusError,
+			status:  http.StatusBadGateway,
+			message: "Service temporarily unavailable (502 Bad Gateway)",
+		},
+		{
+			name: "broken stream",
+			respond: func(attempt int, w http.ResponseWriter, r *http.Request) {
+				breakBody(w, `{"text":"partial","done":false}`)
+			},
+			kind:    upstreamReadFailed,
+			status:  http.StatusInternalServerError,
+			message: "读取响应失败: unexpected EOF",
+		},
+		{
+			name:      "first byte timeout",
+			firstByte: 50 * time.Millisecond,
+			respond: func(attempt int, w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+			},
+			kind:    upstreamRequestFailed,
+			status:  http.StatusGatewayTimeout,
+			message: "等待上游首个响应超时（50ms）",
+		},
+		{
+			name:      "blank lines do not extend the first byte timeout",
+			firstByte: 100 * time.Millisecond,
+			respond: func(attempt int, w http.ResponseWriter, r *http.Request) {
+				for {
+					select {
+					case <-r.Context().Done():
+						return
+					case <-time.After(20 * time.Millisecond):
+						writeLines(w, "")
+					}
+				}
+			},
+			kind:    upstreamReadFailed,
+			status:  http.StatusGatewayTimeout,
+			message: "等待上游首个响应超时（100ms）",
+		},
+		{
+			name: "idle timeout",
+			idle: 50 * time.Millisecond,
+			respond: func(attempt int, w http.ResponseWriter, r *http.Request) {
+				writeLines(w, `{"text":"partial","done":false}`)
+				<-r.Context().Done()
+			},
+			kind:    upstreamReadFailed,
+			status:  http.StatusGatewayTimeout,
+			message: "等待上游后续响应超时（50ms）",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withUpstreamTimeouts(t, tt.firstByte, tt.idle)
+			client, _ := newFakeClient(t, tt.respond)
+
+			err := client.streamOnce(context.Background(), newAugmentRequest("CHAT", "", ""), func(AugmentResponse) bool {
+				return true
+			})
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if err.Kind != tt.kind || err.StatusCode != tt.status || err.Message != tt.message || err.RetryAfter != tt.retryAfter {
+				t.Errorf("error = %+v, want kind=%d status=%d message=%q retry_after=%s",
+					*err, tt.kind, tt.status, tt.message, tt.retryAfter)
+			}
+		})
+	}
+}
+
+func TestAugmentClientCancel(t *testing.T) {
+	withUpstreamTimeouts(t, 5*time.Second, 5*time.Second)
+	client, _ := newFakeClient(t, func(attempt int, w http.ResponseWriter, r *http.Request) {
+		writeLines(w, `{"text":"partial","done":false}`)
+		<-r.Context().Done()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err := forwardAugmentStream(ctx, client, newAugmentRequest("AGENT", "", ""), nil, func(AugmentResponse) bool {
+		cancel()
+		return true
+	})
+	if err == nil || err.Kind != upstreamCancelled {
+		t.Errorf("error = %v, want upstreamCancelled", err)
+	}
+}
+
+func TestUpstreamWatchdog(t *testing.T) {
+	t.Run("stop before timeout", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		watchdog := newUpstreamWatchdog(cancel)
+		watchdog.reset(20*time.Millisecond, "timeout")
+		if watchdog.stop() {
+			t.Fatal("stop() = true before the timeout")
+		}
+		time.Sleep(50 * time.Millisecond)
+		if ctx.Err() != nil || watchdog.expired() {
+			t.Error("stopped watchdog cancelled the request")
+		}
+	})
+
+	t.Run("stop after timeout", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		watchdog := newUpstreamWatchdog(cancel)
+		watchdog.reset(10*time.Millisecond, "timeout")
+		<-ctx.Done()
+		if !watchdog.stop() {
+			t.Error("stop() = false after the request was cancelled")
+		}
+	})
+
+	t.Run("resume keeps the deadline", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		watchdog := newUpstreamWatchdog(cancel)
+		start := time.Now()
+		watchdog.reset(60*time.Millisecond, "timeout")
+		time.Sleep(40 * time.Millisecond)
+		watchdog.stop()
+		watchdog.resume()
+		<-ctx.Done()
+		if elapsed := time.Since(start); elapsed > 95*time.Millisecond {
+			t.Errorf("cancelled after %s, want about 60ms", elapsed)
+		}
+	})
+}
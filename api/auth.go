@@ -20,6 +20,10 @@ func AuthMiddleware() gin.HandlerFunc {
 		}
 
 		authHeader := c.GetHeader("Authorization")
+		if authHeader == "" {
+			// Anthropic客户端使用x-api-key头传递密钥
+			authHeader = c.GetHeader("x-api-key")
+		}
 		if authHeader == "" {
 			logger.Log.Error("Authorization is empty")
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header is required"})
@@ -31,6 +35,19 @@ func AuthMiddleware() gin.HandlerFunc {
 		token := strings.TrimPrefix(authHeader, "Bearer ")
 		token = strings.TrimSpace(token)
 
+		// 下游API Key验证通过后记录到上下文，用于选择提示词模板
+		if apiKey, err := config.GetAPIKey(token); err == nil {
+			if !apiKey.Enabled {
+				logger.Log.Error(fmt.Sprintf("Disabled API key: %s", apiKey.Name))
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "API key is disabled"})
+				c.Abort()
+				return
+			}
+			c.Set("api_key", apiKey)
+			c.Next()
+			return
+		}
+
 		// 如果设置了固定的AuthToken，则验证token是否匹配
 		if config.AppConfig.AuthToken != "" {
 			if token != config.AppConfig.AuthToken {
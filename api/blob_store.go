@@ -0,0 +1,101 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// 已上传到租户的blob记录键前缀，每个租户一个哈希表，字段为blob名称
+const tenantBlobsPrefix = "tenant_blobs:"
+
+// Blob 需要上传到租户上下文引擎的文件内容
+type Blob struct {
+	BlobName string `json:"blob_name"`
+	Path     string `json:"path"`
+	Content  string `json:"content"`
+}
+
+// BlobStore 将文件上传到token所属租户的blob存储，上传后聊天请求通过AddedBlobs引用blob名称
+type BlobStore interface {
+	Upload(ctx context.Context, token, tenantURL string, blobs []Blob) *upstreamError
+}
+
+// currentBlobStore 根据file_blob_store配置选择blob存储
+func currentBlobStore() BlobStore {
+	if config.AppConfig.FileBlobStore == "local" {
+		return localBlobStore{}
+	}
+	return augmentBlobStore{}
+}
+
+// blobName 计算Augment使用的blob名称：路径和内容的SHA-256
+func blobName(path, content string) string {
+	hash := sha256.New()
+	hash.Write([]byte(path))
+	hash.Write([]byte(content))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// localBlobStore 不上传任何内容，用于本地测试
+type localBlobStore struct{}
+
+func (localBlobStore) Upload(ctx context.Context, token, tenantURL string, blobs []Blob) *upstreamError {
+	return nil
+}
+
+// augmentBlobStore 通过batch-upload接口上传到租户，同一租户已上传过的blob不再重复上传
+type augmentBlobStore struct{}
+
+func (augmentBlobStore) Upload(ctx context.Context, token, tenantURL string, blobs []Blob) *upstreamError {
+	uploaded := tenantBlobsPrefix + tenantURL
+	missing := make([]Blob, 0, len(blobs))
+	for _, blob := range blobs {
+		if exists, err := config.RedisHExists(uploaded, blob.BlobName); err == nil && exists {
+			continue
+		}
+		missing = append(missing, blob)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	client := NewAugmentClient(token, tenantURL)
+	resp, err := client.post(ctx, "batch-upload", map[string]interface{}{"blobs": missing}, uuid.New().String(), uuid.New().String())
+	if err != nil {
+		if ctx.Err() != nil {
+			return cancelledError()
+		}
+		return &upstreamError{Kind: upstreamRequestFailed, StatusCode: http.StatusInternalServerError, Message: "上传文件失败: " + err.Error()}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &upstreamError{
+			Kind:       upstreamStatusError,
+			StatusCode: resp.StatusCode,
+			Message:    readAugmentError(resp),
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+
+	for _, blob := range missing {
+		if err := config.RedisHSet(uploaded, blob.BlobName, blob.Path); err != nil {
+			logger.Log.WithFields(logrus.Fields{
+				"blob_name": blob.BlobName,
+				"error":     err.Error(),
+			}).Warn("记录已上传的blob失败")
+		}
+	}
+	logger.Log.WithFields(logrus.Fields{
+		"tenant_url": tenantURL,
+		"count":      len(missing),
+	}).Info("已上传文件到租户")
+	return nil
+}
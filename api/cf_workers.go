@@ -256,10 +256,9 @@ func TestCFWorker(c *gin.Context) {
 	// 构建测试URL
 	testURL := req.WorkerURL + testPath
 
-	// 发送测试请求
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
+	// 发送测试请求，使用该Worker的共享连接池
+	client := createHTTPClient(req.WorkerURL)
+	client.Timeout = 10 * time.Second
 
 	resp, err := client.Get(testURL)
 	if err != nil {
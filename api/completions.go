@@ -0,0 +1,413 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// CompletionRequest OpenAI兼容的文本补全请求，同时用于FIM代码补全
+type CompletionRequest struct {
+	Model       string      `json:"model"`
+	Prompt      interface{} `json:"prompt"` // 字符串或只含一个元素的字符串数组
+	Suffix      string      `json:"suffix,omitempty"`
+	Stream      bool        `json:"stream,omitempty"`
+	MaxTokens   int         `json:"max_tokens,omitempty"`
+	Temperature float64     `json:"temperature,omitempty"`
+	Stop        interface{} `json:"stop,omitempty"` // 字符串或字符串数组
+
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+	// 扩展字段：当前文件路径和语言，编辑器插件可选传入
+	Path     string `json:"path,omitempty"`
+	Language string `json:"language,omitempty"`
+}
+
+// CompletionChoice 文本补全结果
+type CompletionChoice struct {
+	Text         string      `json:"text"`
+	Index        int         `json:"index"`
+	Logprobs     interface{} `json:"logprobs"`
+	FinishReason *string     `json:"finish_reason"`
+}
+
+// CompletionResponse OpenAI兼容的文本补全响应
+type CompletionResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []CompletionChoice `json:"choices"`
+	Usage   *Usage             `json:"usage,omitempty"`
+}
+
+const (
+	// 代码补全指令，要求只返回插入到光标处的代码
+	fimInstruction = "Fill in the code at the cursor position between the prefix and the suffix. Reply with only the code to insert, without explanations or markdown code fences."
+	// 文本续写指令
+	completionInstruction = "Continue the text exactly where the prefix ends. Reply with only the continuation, without repeating the prefix or adding explanations."
+)
+
+// languageByExtension 根据文件扩展名推断语言
+var languageByExtension = map[string]string{
+	".go":    "Go",
+	".py":    "Python",
+	".js":    "JavaScript",
+	".jsx":   "JavaScript",
+	".ts":    "TypeScript",
+	".tsx":   "TypeScript",
+	".java":  "Java",
+	".kt":    "Kotlin",
+	".rs":    "Rust",
+	".c":     "C",
+	".h":     "C",
+	".cpp":   "C++",
+	".cc":    "C++",
+	".hpp":   "C++",
+	".cs":    "C#",
+	".php":   "PHP",
+	".rb":    "Ruby",
+	".swift": "Swift",
+	".html":  "HTML",
+	".css":   "CSS",
+	".md":    "Markdown",
+	".sql":   "SQL",
+	".sh":    "Shell",
+}
+
+// CompletionsHandler 处理OpenAI兼容的文本补全请求（/v1/completions）
+func CompletionsHandler(c *gin.Context) {
+	handleCompletionRequest(c, false)
+}
+
+// FIMCompletionsHandler 处理fill-in-the-middle代码补全请求，响应格式与聊天补全一致
+func FIMCompletionsHandler(c *gin.Context) {
+	handleCompletionRequest(c, true)
+}
+
+// promptText 获取prompt文本，暂不支持批量prompt
+func (r CompletionRequest) promptText() (string, error) {
+	switch v := r.Prompt.(type) {
+	case string:
+		return v, nil
+	case []interface{}:
+		if len(v) != 1 {
+			return "", fmt.Errorf("暂不支持批量prompt")
+		}
+		if text, ok := v[0].(string); ok {
+			return text, nil
+		}
+	case nil:
+		return "", fmt.Errorf("prompt不能为空")
+	}
+	return "", fmt.Errorf("无效的prompt")
+}
+
+// stopSequences 获取stop参数中的停止序列
+func (r CompletionRequest) stopSequences() []string {
+	switch v := r.Stop.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var sequences []string
+		for _, item := range v {
+			if seq, ok := item.(string); ok {
+				sequences = append(sequences, seq)
+			}
+		}
+		return sequences
+	}
+	return nil
+}
+
+// convertCompletionRequest 将补全请求转换为Augment请求，prompt和suffix分别作为光标前后的代码，
+// 模式由模型注册表决定
+func convertCompletionRequest(req CompletionRequest, model config.ModelConfig, prompt string, fim bool) AugmentRequest {
+	lang := req.Language
+	if lang == "" && req.Path != "" {
+		lang = languageByExtension[strings.ToLower(filepath.Ext(req.Path))]
+	}
+	if lang == "" {
+		lang = detectLanguage(prompt)
+	}
+
+	mode := model.Mode
+	if mode == "" {
+		mode = "CHAT"
+	}
+	augmentReq := newAugmentRequest(mode, lang, "")
+	augmentReq.Path = req.Path
+	augmentReq.Prefix = prompt
+	augmentReq.Suffix = req.Suffix
+	augmentReq.Message = completionInstruction
+	if fim || req.Suffix != "" {
+		augmentReq.Message = fimInstruction
+	}
+
+	return augmentReq
+}
+
+// completionOutput 收集补全输出，处理停止序列和max_tokens
+type completionOutput struct {
+	maxTokens    int
+	matcher      *stopSequenceMatcher
+	text         string
+	tokens       int // 已输出文本的token数，逐段累加避免每次重新计算全文
+	finishReason string
+}
+
+// add 处理一条Augment响应，返回本次可输出的文本以及是否应停止
+func (o *completionOutput) add(augmentResp AugmentResponse) (string, bool) {
+	text, matched := o.matcher.push(augmentResp.Text)
+	if matched == "" && augmentResp.Done {
+		text += o.matcher.flush()
+	}
+	o.text += text
+	o.tokens += estimateTokenCount(text)
+
+	if matched != "" {
+		return text, true
+	}
+	if o.maxTokens > 0 && o.tokens >= o.maxTokens {
+		o.finishReason = "length"
+		return text, true
+	}
+	return text, augmentResp.Done
+}
+
+// finish 上游结束后输出暂存的文本
+func (o *completionOutput) finish() string {
+	text := o.matcher.flush()
+	o.text += text
+	return text
+}
+
+// handleCompletionRequest 处理文本补全和FIM补全请求
+func handleCompletionRequest(c *gin.Context, fim bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Log.WithFields(logrus.Fields{
+				"error": r,
+			}).Error("处理补全请求时发生panic")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器内部错误"})
+		}
+		// 函数返回时同步清理请求状态
+		cleanupRequestStatus(c)
+	}()
+
+	var req CompletionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的请求数据"})
+		return
+	}
+
+	prompt, err := req.promptText()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	model, err := requestModel(c, req.Model)
+	if err != nil {
+		writeOpenAIError(c, http.StatusNotFound, err.Error(), "invalid_request_error", "model", "model_not_found")
+		return
+	}
+
+	token, tenant := getRequestToken(c)
+	if token == "" || tenant == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "无可用Token,请先在管理页面获取"})
+		return
+	}
+
+	// 异步处理token使用计数
+	asyncIncrementTokenUsage(c, token, req.Model)
+
+	augmentReq := convertCompletionRequest(req, model, prompt, fim)
+	output := &completionOutput{
+		maxTokens:    req.MaxTokens,
+		matcher:      newStopSequenceMatcher(req.stopSequences()),
+		finishReason: "stop",
+	}
+	promptTokens := estimateTokenCount(prompt) + estimateTokenCount(req.Suffix)
+	responseID := fmt.Sprintf("cmpl-%d", time.Now().UnixNano())
+
+	if !req.Stream {
+		var upstreamErr *upstreamError
+		token, upstreamErr = forwardWithFailover(c, req.Model, augmentReq, func(augmentResp AugmentResponse) bool {
+			_, stop := output.add(augmentResp)
+			return !stop
+		})
+		if upstreamErr != nil && upstreamErr.Kind == upstreamCancelled {
+			handleClientCancel(c, token)
+			return
+		}
+		if upstreamErr != nil {
+			c.JSON(upstreamErr.StatusCode, gin.H{"error": upstreamErr.Message})
+			return
+		}
+		output.finish()
+
+		usage := newUsage(promptTokens, estimateTokenCount(output.text))
+		asyncRecordTokenCounts(c, token, usage)
+		c.JSON(http.StatusOK, completionResponse(responseID, req.Model, fim, output.text, &output.finishReason, &usage))
+		return
+	}
+
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "流式传输不支持"})
+		return
+	}
+
+	started := false
+	writeChunk := func(text string, finishReason *string) {
+		if !started {
+			started = true
+			setSSEHeaders(c)
+		}
+		jsonResp, err := json.Marshal(completionChunk(responseID, req.Model, fim, text, finishReason))
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(c.Writer, "data: %s\n\n", jsonResp)
+		flusher.Flush()
+	}
+
+	setStreamKeepalive(c, func() { writeSSEPing(c, flusher) })
+	token, upstreamErr := forwardWithFailover(c, req.Model, augmentReq, func(augmentResp AugmentResponse) bool {
+		text, stop := output.add(augmentResp)
+		if text != "" {
+			writeChunk(text, nil)
+		}
+		return !stop
+	})
+	if upstreamErr != nil && upstreamErr.Kind == upstreamCancelled {
+		handleClientCancel(c, token)
+		return
+	}
+	if upstreamErr != nil {
+		// 已开始输出时以错误块结束，不发送finish_reason和[DONE]，客户端据此判断补全不完整
+		writeStreamError(c, upstreamErr.StatusCode, upstreamErr.Message)
+		flusher.Flush()
+		if started {
+			logger.Log.WithFields(logrus.Fields{
+				"error": upstreamErr.Message,
+				"model": req.Model,
+			}).Error("流式响应中断")
+		}
+		return
+	}
+
+	if text := output.finish(); text != "" {
+		writeChunk(text, nil)
+	}
+	writeChunk("", &output.finishReason)
+
+	usage := newUsage(promptTokens, estimateTokenCount(output.text))
+	asyncRecordTokenCounts(c, token, usage)
+	if req.StreamOptions != nil && req.StreamOptions.IncludeUsage {
+		if jsonResp, err := json.Marshal(completionUsageChunk(responseID, req.Model, fim, usage)); err == nil {
+			fmt.Fprintf(c.Writer, "data: %s\n\n", jsonResp)
+		}
+	}
+	fmt.Fprintf(c.Writer, "data: [DONE]\n\n")
+	flusher.Flush()
+}
+
+// completionResponse 构造非流式响应：FIM使用聊天补全格式，其他使用text_completion格式
+func completionResponse(id, model string, fim bool, text string, finishReason *string, usage *Usage) interface{} {
+	if fim {
+		return OpenAIResponse{
+			ID:      id,
+			Object:  "chat.completion",
+			Created: time.Now().Unix(),
+			Model:   model,
+			Choices: []Choice{
+				{
+					Index:        0,
+					Message:      ChatMessage{Role: "assistant", Content: text},
+					FinishReason: finishReason,
+				},
+			},
+			Usage: *usage,
+		}
+	}
+
+	return CompletionResponse{
+		ID:      id,
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: []CompletionChoice{
+			{
+				Text:         text,
+				Index:        0,
+				FinishReason: finishReason,
+			},
+		},
+		Usage: usage,
+	}
+}
+
+// completionChunk 构造流式响应块：FIM使用聊天补全格式，其他使用text_completion格式
+func completionChunk(id, model string, fim bool, text string, finishReason *string) interface{} {
+	if fim {
+		return OpenAIStreamResponse{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: time.Now().Unix(),
+			Model:   model,
+			Choices: []StreamChoice{
+				{
+					Index:        0,
+					Delta:        ChatMessage{Role: "assistant", Content: text},
+					FinishReason: finishReason,
+				},
+			},
+		}
+	}
+
+	return CompletionResponse{
+		ID:      id,
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: []CompletionChoice{
+			{
+				Text:         text,
+				Index:        0,
+				FinishReason: finishReason,
+			},
+		},
+	}
+}
+
+// completionUsageChunk 构造include_usage时最后发送的不含choices的用量块
+func completionUsageChunk(id, model string, fim bool, usage Usage) interface{} {
+	if fim {
+		return OpenAIStreamResponse{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: time.Now().Unix(),
+			Model:   model,
+			Choices: []StreamChoice{},
+			Usage:   &usage,
+		}
+	}
+
+	return CompletionResponse{
+		ID:      id,
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: []CompletionChoice{},
+		Usage:   &usage,
+	}
+}
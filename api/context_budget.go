@@ -0,0 +1,144 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// 使用summarize策略时为摘要预留的token数
+const contextSummaryReserve = 512
+
+const (
+	// 总结被裁剪对话时发送的消息，后面拼接对话内容
+	contextSummaryInstruction = "Summarize the following earlier part of a conversation between a user and an assistant. " +
+		"Keep facts, decisions, code identifiers and open questions that later messages may rely on. " +
+		"Reply with the summary only, in at most 300 words.\n\n"
+	// 摘要在历史记录中对应的用户消息
+	contextSummaryRequest = "Summarize our earlier conversation."
+)
+
+// contextBudget 按模型、全局配置的顺序确定上下文token上限，不大于0时不限制
+func contextBudget(c *gin.Context, model string) int {
+	if modelConfig, err := requestModel(c, model); err == nil && modelConfig.ContextBudget != 0 {
+		return modelConfig.ContextBudget
+	}
+	return config.AppConfig.ContextBudget
+}
+
+// historyTokens 估算一轮历史记录的token数量
+func historyTokens(history AugmentChatHistory) int {
+	return estimateTokenCount(history.RequestMessage) + estimateTokenCount(history.ResponseText)
+}
+
+// contextTokens 估算请求的上下文token数量：用户指南（含system消息）、历史记录和当前消息
+func contextTokens(augmentReq AugmentRequest) int {
+	return estimateTokenCount(augmentReq.UserGuideLines) + estimatePromptTokens(augmentReq)
+}
+
+// trimContext 上下文超出模型的token上限时从最早的对话开始裁剪，用户指南和当前消息始终保留，
+// summarize策略下被裁剪的对话由CHAT模式总结为一轮历史记录。裁剪结果写入X-Context-Trimmed响应头
+func trimContext(c *gin.Context, model string, augmentReq *AugmentRequest) {
+	budget := contextBudget(c, model)
+	if budget <= 0 || ResponseCacheHit(c) {
+		return
+	}
+	before := contextTokens(*augmentReq)
+	if before <= budget {
+		return
+	}
+
+	summarize := config.AppConfig.ContextTrimStrategy == "summarize"
+	limit := budget
+	if summarize {
+		limit -= contextSummaryReserve
+	}
+
+	total := before
+	dropped := 0
+	for dropped < len(augmentReq.ChatHistory) && total > limit {
+		total -= historyTokens(augmentReq.ChatHistory[dropped])
+		dropped++
+	}
+	// 只有当前消息时无法裁剪，由上游返回错误
+	if dropped == 0 {
+		return
+	}
+
+	strategy := "drop"
+	history := append([]AugmentChatHistory{}, augmentReq.ChatHistory[dropped:]...)
+	if summarize {
+		if summary, ok := summarizeHistory(c, model, augmentReq.ChatHistory[:dropped]); ok {
+			history = append([]AugmentChatHistory{summaryHistory(summary)}, history...)
+			strategy = "summarize"
+		}
+	}
+	augmentReq.ChatHistory = history
+
+	after := contextTokens(*augmentReq)
+	c.Header("X-Context-Trimmed", fmt.Sprintf("turns=%d; strategy=%s; tokens=%d->%d", dropped, strategy, before, after))
+	logger.Log.WithFields(logrus.Fields{
+		"model":    model,
+		"budget":   budget,
+		"turns":    dropped,
+		"strategy": strategy,
+		"before":   before,
+		"after":    after,
+	}).Info("上下文超出上限，已裁剪最早的对话")
+}
+
+// summarizeHistory 使用当前请求的token以CHAT模式总结被裁剪的对话，失败时返回false
+func summarizeHistory(c *gin.Context, model string, histories []AugmentChatHistory) (string, bool) {
+	token, tenant := getRequestToken(c)
+	if token == "" || tenant == "" {
+		return "", false
+	}
+
+	var transcript strings.Builder
+	for _, history := range histories {
+		transcript.WriteString("User: " + history.RequestMessage + "\n\n")
+		transcript.WriteString("Assistant: " + history.ResponseText + "\n\n")
+	}
+	summaryReq := newAugmentRequest("CHAT", "", "")
+	summaryReq.Message = contextSummaryInstruction + transcript.String()
+
+	// 总结请求也计入token使用次数
+	asyncIncrementTokenUsage(c, token, model)
+
+	var summary strings.Builder
+	client := NewAugmentClient(token, tenant)
+	upstreamErr := forwardAugmentStream(c.Request.Context(), client, summaryReq, nil, func(augmentResp AugmentResponse) bool {
+		summary.WriteString(augmentResp.Text)
+		return !augmentResp.Done
+	})
+	if upstreamErr != nil || strings.TrimSpace(summary.String()) == "" {
+		fields := logrus.Fields{"model": model}
+		if upstreamErr != nil {
+			fields["error"] = upstreamErr.Message
+		}
+		logger.Log.WithFields(fields).Warn("总结被裁剪的对话失败，直接丢弃")
+		return "", false
+	}
+	return strings.TrimSpace(summary.String()), true
+}
+
+// summaryHistory 将摘要作为一轮历史记录
+func summaryHistory(summary string) AugmentChatHistory {
+	return AugmentChatHistory{
+		RequestMessage: contextSummaryRequest,
+		ResponseText:   summary,
+		RequestID:      generateRequestID(),
+		RequestNodes:   make([]Node, 0),
+		ResponseNodes: []Node{
+			{
+				ID:      0,
+				Type:    responseNodeTypeRawResponse,
+				Content: summary,
+			},
+		},
+	}
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// 自动续写时发送的消息
+const continueInstruction = "Your previous reply was cut off. Continue exactly where it stopped, without repeating anything already written and without any preamble."
+
+// 截断原因
+const (
+	truncatedMissingDone = "missing_done" // 上游未返回done就结束
+	truncatedLength      = "length"       // 因长度限制停止
+	truncatedCodeFence   = "code_fence"   // 代码块未闭合
+)
+
+// forwardSegment 请求一段回复，测试时可替换
+var forwardSegment = forwardWithFailover
+
+// autoContinueMax 获取最大续写次数
+func autoContinueMax() int {
+	if config.AppConfig.AutoContinueMax < 0 {
+		return 0
+	}
+	return config.AppConfig.AutoContinueMax
+}
+
+// lengthStopReason 判断停止原因是否为长度限制
+func lengthStopReason(stopReason interface{}) bool {
+	reason, ok := stopReason.(string)
+	if !ok {
+		return false
+	}
+	reason = strings.ToLower(reason)
+	return strings.Contains(reason, "max_tokens") || strings.Contains(reason, "length")
+}
+
+// unbalancedCodeFence 判断回复中是否有未闭合的```代码块
+func unbalancedCodeFence(reply string) bool {
+	fences := 0
+	for _, line := range strings.Split(reply, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			fences++
+		}
+	}
+	return fences%2 == 1
+}
+
+// chatFinishReason 返回OpenAI格式的完成原因：产生过工具调用时为tool_calls，因长度限制停止时为length
+func chatFinishReason(toolCalls *toolCallCollector, stopReason interface{}) string {
+	finishReason := toolCalls.finishReason()
+	if finishReason == "stop" && lengthStopReason(stopReason) {
+		return "length"
+	}
+	return finishReason
+}
+
+// truncationReason 判断回复是否被截断，未截断时返回空字符串
+func truncationReason(reply string, done bool, stopReason interface{}) string {
+	switch {
+	case !done:
+		return truncatedMissingDone
+	case lengthStopReason(stopReason):
+		return truncatedLength
+	case unbalancedCodeFence(reply):
+		return truncatedCodeFence
+	}
+	return ""
+}
+
+// continuationRequest 将截断的回复加入历史，要求模型从中断处继续
+func continuationRequest(augmentReq AugmentRequest, reply string) AugmentRequest {
+	nextReq := augmentReq
+	nextReq.ChatHistory = append(append([]AugmentChatHistory{}, augmentReq.ChatHistory...), AugmentChatHistory{
+		RequestMessage: augmentReq.Message,
+		ResponseText:   reply,
+		RequestID:      generateRequestID(),
+		RequestNodes:   augmentReq.Nodes,
+		ResponseNodes: []Node{
+			{
+				ID:      0,
+				Type:    responseNodeTypeRawResponse,
+				Content: reply,
+			},
+		},
+	})
+	nextReq.Nodes = make([]Node, 0)
+	nextReq.Message = continueInstruction
+	return nextReq
+}
+
+// forwardWithContinuation 请求开启auto_continue时，回复被截断后继续请求，续写内容交给同一个handle，
+// 客户端看到的是一个完整的响应。每段回复的done都不交给handle，全部结束后再单独发送一次；
+// 达到续写次数上限时最后一段即使没有done也会发送done，停止原因为length。
+// 回复包含工具调用时不续写。是否截断按拼接后的完整回复判断，避免代码块跨段时误判。未开启时等同于forwardWithFailover
+func forwardWithContinuation(c *gin.Context, model string, augmentReq AugmentRequest, handle func(AugmentResponse) bool) (string, *upstreamError) {
+	if !c.GetBool("auto_continue") {
+		return forwardSegment(c, model, augmentReq, handle)
+	}
+
+	segmentReq := augmentReq
+	var stitched strings.Builder
+	for continuations := 0; ; continuations++ {
+		var reply strings.Builder
+		done := false
+		stopped := false
+		hasToolUse := false
+		var stopReason interface{}
+
+		token, upstreamErr := forwardSegment(c, model, segmentReq, func(augmentResp AugmentResponse) bool {
+			reply.WriteString(augmentResp.Text)
+			stitched.WriteString(augmentResp.Text)
+			for _, node := range augmentResp.Nodes {
+				if node.Type == responseNodeTypeToolUse {
+					hasToolUse = true
+				}
+			}
+			if augmentResp.StopReason != nil {
+				stopReason = augmentResp.StopReason
+			}
+			if augmentResp.Done {
+				done = true
+				augmentResp.Done = false
+			}
+			if !handle(augmentResp) {
+				stopped = true
+				return false
+			}
+			return true
+		})
+		if upstreamErr != nil || stopped {
+			return token, upstreamErr
+		}
+
+		reason := truncationReason(stitched.String(), done, stopReason)
+		if reason == "" || hasToolUse || continuations >= autoContinueMax() {
+			if !done {
+				stopReason = truncatedLength
+			}
+			handle(AugmentResponse{Done: true, StopReason: stopReason})
+			return token, nil
+		}
+
+		logger.Log.WithFields(logrus.Fields{
+			"model":        model,
+			"reason":       reason,
+			"continuation": fmt.Sprintf("%d/%d", continuations+1, autoContinueMax()),
+		}).Info("回复被截断，自动续写")
+
+		// 续写的每次请求都计入token使用次数
+		asyncIncrementTokenUsage(c, token, model)
+		segmentReq = continuationRequest(segmentReq, reply.String())
+	}
+}
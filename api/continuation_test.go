@@ -0,0 +1,170 @@
+package api
+
+import (
+	"augment2api/config"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// withSegments 在测试期间按顺序返回预设的各段回复，记录每段请求
+func withSegments(t *testing.T, segments ...[]AugmentResponse) *[]AugmentRequest {
+	t.Helper()
+	var requests []AugmentRequest
+	previous := forwardSegment
+	forwardSegment = func(c *gin.Context, model string, augmentReq AugmentRequest, handle func(AugmentResponse) bool) (string, *upstreamError) {
+		segment := segments[len(requests)]
+		requests = append(requests, augmentReq)
+		for _, augmentResp := range segment {
+			if !handle(augmentResp) {
+				break
+			}
+		}
+		return "token", nil
+	}
+	t.Cleanup(func() { forwardSegment = previous })
+	return &requests
+}
+
+// waitForUsageCount 等待异步记录的token总使用次数达到count
+func waitForUsageCount(t *testing.T, token string, count int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		value, _ := config.RedisGet("token_usage:" + token)
+		if value == strconv.Itoa(count) || (count == 0 && value == "") {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("token使用次数 = %q, want %d", value, count)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestForwardWithContinuation(t *testing.T) {
+	tests := []struct {
+		name       string
+		max        int
+		segments   [][]AugmentResponse
+		requests   int
+		text       string
+		stopReason interface{}
+	}{
+		{
+			name:       "complete reply is not continued",
+			max:        2,
+			segments:   [][]AugmentResponse{{{Text: "done."}, {Done: true, StopReason: "end_turn"}}},
+			requests:   1,
+			text:       "done.",
+			stopReason: "end_turn",
+		},
+		{
+			name: "missing done is continued",
+			max:  2,
+			segments: [][]AugmentResponse{
+				{{Text: "```go\nfunc main() {"}},
+				{{Text: "\n}\n```"}, {Done: true}},
+			},
+			requests: 2,
+			text:     "```go\nfunc main() {\n}\n```",
+		},
+		{
+			name: "cap reached without done",
+			max:  2,
+			segments: [][]AugmentResponse{
+				{{Text: "one "}},
+				{{Text: "two "}},
+				{{Text: "three"}},
+			},
+			requests:   3,
+			text:       "one two three",
+			stopReason: truncatedLength,
+		},
+		{
+			name: "cap reached with an open code fence",
+			max:  1,
+			segments: [][]AugmentResponse{
+				{{Text: "```go\n"}, {Done: true}},
+				{{Text: "x := 1\n"}, {Done: true, StopReason: "end_turn"}},
+			},
+			requests:   2,
+			text:       "```go\nx := 1\n",
+			stopReason: "end_turn",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newFakeRedis(t) // 续写时异步记录token使用次数
+			previous := config.AppConfig
+			config.AppConfig.AutoContinueMax = tt.max
+			t.Cleanup(func() { config.AppConfig = previous })
+			requests := withSegments(t, tt.segments...)
+
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Set("auto_continue", true)
+			var text string
+			var dones []AugmentResponse
+			augmentReq := newAugmentRequest("AGENT", "", "")
+			augmentReq.Message = "write main"
+			_, upstreamErr := forwardWithContinuation(c, "claude-3.7-agent", augmentReq, func(augmentResp AugmentResponse) bool {
+				text += augmentResp.Text
+				if augmentResp.Done {
+					dones = append(dones, augmentResp)
+				}
+				return true
+			})
+
+			if upstreamErr != nil {
+				t.Fatalf("upstream error: %v", upstreamErr)
+			}
+			if len(*requests) != tt.requests {
+				t.Errorf("requests = %d, want %d", len(*requests), tt.requests)
+			}
+			if text != tt.text {
+				t.Errorf("text = %q, want %q", text, tt.text)
+			}
+			if len(dones) != 1 {
+				t.Fatalf("done sent %d times, want 1", len(dones))
+			}
+			if !reflect.DeepEqual(dones[0].StopReason, tt.stopReason) {
+				t.Errorf("stop_reason = %v, want %v", dones[0].StopReason, tt.stopReason)
+			}
+			// 每次续写异步计入token使用次数，等待计数完成后再恢复Redis客户端
+			waitForUsageCount(t, "token", tt.requests-1)
+
+			// 续写请求带上之前的回复
+			for i, req := range (*requests)[1:] {
+				if req.Message != continueInstruction || len(req.ChatHistory) != i+1 {
+					t.Errorf("continuation %d: message = %q, history = %d", i+1, req.Message, len(req.ChatHistory))
+				}
+			}
+		})
+	}
+}
+
+func TestChatFinishReason(t *testing.T) {
+	withCalls := newToolCallCollector()
+	withCalls.collect([]Node{{Type: responseNodeTypeToolUse, ToolUse: ToolUse{ToolUseID: "toolu_1", ToolName: "get_weather"}}})
+
+	tests := []struct {
+		toolCalls  *toolCallCollector
+		stopReason interface{}
+		want       string
+	}{
+		{toolCalls: newToolCallCollector(), want: "stop"},
+		{toolCalls: newToolCallCollector(), stopReason: truncatedLength, want: "length"},
+		{toolCalls: newToolCallCollector(), stopReason: "max_tokens", want: "length"},
+		{toolCalls: withCalls, stopReason: truncatedLength, want: "tool_calls"},
+	}
+	for _, tt := range tests {
+		if got := chatFinishReason(tt.toolCalls, tt.stopReason); got != tt.want {
+			t.Errorf("chatFinishReason(%v) = %q, want %q", tt.stopReason, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"context"
+	"strings"
+)
+
+// conversationTurn 按角色整理后的一轮对话
+// Requests 为用户消息和工具结果，Replies 为紧随其后的助手回复
+type conversationTurn struct {
+	Requests []ChatMessage
+	Replies  []ChatMessage
+}
+
+// conversation 按角色整理后的完整对话
+type conversation struct {
+	System  string             // 所有system/developer消息合并后的内容
+	History []conversationTurn // 已有助手回复的历史轮次
+	Current conversationTurn   // 最后一轮待回复的用户请求
+}
+
+// 消息所属的对话方
+const (
+	sideRequest = iota
+	sideReply
+	sideSystem
+)
+
+// messageSide 根据角色判断消息属于请求方、回复方还是系统指令
+func messageSide(role string) int {
+	switch role {
+	case "system", "developer":
+		return sideSystem
+	case "assistant":
+		return sideReply
+	default:
+		// user、tool以及未知角色都视为请求方
+		return sideRequest
+	}
+}
+
+// normalizeConversation 按角色整理OpenAI消息列表
+// system消息单独合并；连续的同方消息合并为同一轮；助手回复与前面的请求配对；
+// 最后一轮没有回复的请求作为当前消息。以助手消息开头的对话会生成一个空请求轮次。
+func normalizeConversation(messages []ChatMessage) conversation {
+	var conv conversation
+	var systemParts []string
+	var turns []conversationTurn
+	var current *conversationTurn
+
+	for _, msg := range messages {
+		switch messageSide(msg.Role) {
+		case sideSystem:
+			if content := strings.TrimSpace(msg.GetContent()); content != "" {
+				systemParts = append(systemParts, content)
+			}
+		case sideRequest:
+			// 已有回复的轮次结束后，新请求开启下一轮
+			if current == nil || len(current.Replies) > 0 {
+				turns = append(turns, conversationTurn{})
+				current = &turns[len(turns)-1]
+			}
+			current.Requests = append(current.Requests, msg)
+		case sideReply:
+			if current == nil {
+				turns = append(turns, conversationTurn{})
+				current = &turns[len(turns)-1]
+			}
+			current.Replies = append(current.Replies, msg)
+		}
+	}
+
+	conv.System = strings.Join(systemParts, "\n\n")
+
+	if len(turns) > 0 && len(turns[len(turns)-1].Replies) == 0 {
+		conv.Current = turns[len(turns)-1]
+		turns = turns[:len(turns)-1]
+	}
+	conv.History = turns
+
+	return conv
+}
+
+// requestText 合并本轮所有用户消息的文本
+func (t conversationTurn) requestText() string {
+	var parts []string
+	for _, msg := range t.Requests {
+		if msg.Role == "tool" {
+			continue
+		}
+		if content := msg.GetContent(); content != "" {
+			parts = append(parts, content)
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// requestNodes 将本轮的工具结果和图片转换为请求节点
+func (t conversationTurn) requestNodes(ctx context.Context) ([]Node, error) {
+	nodes := make([]Node, 0)
+	for _, msg := range t.Requests {
+		if msg.Role == "tool" {
+			nodes = append(nodes, toolResultNode(msg, len(nodes)))
+			continue
+		}
+
+		imageNodes, err := messageImageNodes(ctx, msg, len(nodes))
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, imageNodes...)
+	}
+	return nodes, nil
+}
+
+// replyText 合并本轮所有助手回复的文本
+func (t conversationTurn) replyText() string {
+	var parts []string
+	for _, msg := range t.Replies {
+		if content := msg.GetContent(); content != "" {
+			parts = append(parts, content)
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// replyToolCalls 返回本轮助手回复中的所有工具调用
+func (t conversationTurn) replyToolCalls() []ToolCall {
+	var calls []ToolCall
+	for _, msg := range t.Replies {
+		calls = append(calls, msg.ToolCalls...)
+	}
+	return calls
+}
+
+// lastRequestContent 返回本轮最后一条用户消息的内容，用于语言检测
+func (t conversationTurn) lastRequestContent() string {
+	for i := len(t.Requests) - 1; i >= 0; i-- {
+		if t.Requests[i].Role != "tool" {
+			return t.Requests[i].GetContent()
+		}
+	}
+	return ""
+}
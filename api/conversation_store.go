@@ -0,0 +1,257 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// 服务端对话键前缀，值为Conversation的JSON，过期时间为conversation_ttl_seconds，每次更新后重新计算
+	conversationPrefix = "conversation:"
+	// 下游API Key的对话索引前缀，集合成员为对话ID，已过期的对话在列出时移除
+	conversationOwnerPrefix = "conversations:"
+)
+
+// Conversation 服务端保存的对话，聊天请求携带conversation_id时只需发送新的消息
+type Conversation struct {
+	ID           string        `json:"id"`
+	Object       string        `json:"object"`
+	CheckpointID string        `json:"checkpoint_id"` // 同一对话的所有请求使用相同的CheckpointID
+	Messages     []ChatMessage `json:"messages"`
+	Owner        string        `json:"owner,omitempty"` // 创建对话的下游API Key，只有该Key可以访问，不在响应中返回
+	CreatedAt    int64         `json:"created_at"`
+	UpdatedAt    int64         `json:"updated_at"`
+}
+
+// ConversationRequest 创建对话的请求结构，可以带上初始消息（如system消息）
+type ConversationRequest struct {
+	Messages []ChatMessage `json:"messages"`
+}
+
+// pendingConversation 本次请求需要追加到对话中的消息，收到完整回复后写入
+type pendingConversation struct {
+	conversation *Conversation
+	messages     []ChatMessage
+}
+
+func getConversation(id string) (*Conversation, error) {
+	data, err := config.RedisGet(conversationPrefix + id)
+	if err != nil {
+		return nil, err
+	}
+	var conv Conversation
+	if err := json.Unmarshal([]byte(data), &conv); err != nil {
+		return nil, err
+	}
+	return &conv, nil
+}
+
+func saveConversation(conv *Conversation) error {
+	data, err := json.Marshal(conv)
+	if err != nil {
+		return err
+	}
+	return config.RedisSet(conversationPrefix+conv.ID, string(data), config.AppConfig.ConversationTTL)
+}
+
+// requestConversation 获取当前请求的API Key可以访问的对话，不存在或属于其他Key时返回false
+func requestConversation(c *gin.Context, id string) (*Conversation, bool) {
+	conv, err := getConversation(id)
+	if err != nil || conv.Owner != requestAPIKey(c).Key {
+		return nil, false
+	}
+	return conv, true
+}
+
+// conversationResponse 去掉所属API Key后返回给客户端
+func conversationResponse(conv *Conversation) *Conversation {
+	resp := *conv
+	resp.Owner = ""
+	return &resp
+}
+
+func writeConversationNotFound(c *gin.Context) {
+	writeOpenAIError(c, http.StatusNotFound, "对话不存在或已过期", "invalid_request_error", "conversation_id", "conversation_not_found")
+}
+
+// applyConversation 请求携带conversation_id时，将服务端保存的历史放在本次消息之前
+// 本次消息在收到完整回复后由saveConversationReply追加到对话中
+func applyConversation(c *gin.Context, req *OpenAIRequest) (*Conversation, bool) {
+	if req.ConversationID == "" {
+		return nil, true
+	}
+	conv, ok := requestConversation(c, req.ConversationID)
+	if !ok {
+		return nil, false
+	}
+
+	c.Set("conversation", &pendingConversation{conversation: conv, messages: req.Messages})
+	req.Messages = append(append([]ChatMessage{}, conv.Messages...), req.Messages...)
+	return conv, true
+}
+
+// saveConversationReply 将本次请求的消息和助手回复追加到对话中，请求未携带conversation_id时不做任何处理
+func saveConversationReply(c *gin.Context, reply ChatMessage) {
+	value, exists := c.Get("conversation")
+	if !exists {
+		return
+	}
+	pending, ok := value.(*pendingConversation)
+	if !ok {
+		return
+	}
+
+	// 同一对话的并发请求在最新的消息后追加，不会覆盖其他请求写入的回复
+	id := pending.conversation.ID
+	err := config.RedisUpdate(conversationPrefix+id, config.AppConfig.ConversationTTL, func(current string) (string, error) {
+		var conv Conversation
+		if err := json.Unmarshal([]byte(current), &conv); err != nil {
+			return "", err
+		}
+		conv.Messages = append(append(conv.Messages, pending.messages...), reply)
+		conv.UpdatedAt = time.Now().Unix()
+		data, err := json.Marshal(conv)
+		return string(data), err
+	})
+	if err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"conversation_id": id,
+			"error":           err.Error(),
+		}).Error("保存对话失败")
+	}
+}
+
+// CreateConversationHandler 创建服务端对话
+func CreateConversationHandler(c *gin.Context) {
+	var req ConversationRequest
+	// 请求体可以为空
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			writeOpenAIError(c, http.StatusBadRequest, "无效的请求数据: "+err.Error(), "invalid_request_error", "", "")
+			return
+		}
+	}
+
+	now := time.Now().Unix()
+	conv := &Conversation{
+		ID:           "conv_" + strings.ReplaceAll(uuid.New().String(), "-", ""),
+		Object:       "conversation",
+		CheckpointID: generateCheckpointID(),
+		Messages:     req.Messages,
+		Owner:        requestAPIKey(c).Key,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	if conv.Messages == nil {
+		conv.Messages = make([]ChatMessage, 0)
+	}
+
+	if err := saveConversation(conv); err != nil {
+		writeOpenAIError(c, http.StatusInternalServerError, "保存对话失败: "+err.Error(), "api_error", "", "")
+		return
+	}
+	if err := config.RedisSAdd(conversationOwnerPrefix+conv.Owner, conv.ID); err != nil {
+		writeOpenAIError(c, http.StatusInternalServerError, "保存对话失败: "+err.Error(), "api_error", "", "")
+		return
+	}
+
+	logger.Log.WithFields(logrus.Fields{
+		"conversation_id": conv.ID,
+	}).Info("创建对话成功")
+
+	c.JSON(http.StatusOK, conversationResponse(conv))
+}
+
+// ListConversationsHandler 列出当前API Key的所有对话，按更新时间倒序
+func ListConversationsHandler(c *gin.Context) {
+	ownerKey := conversationOwnerPrefix + requestAPIKey(c).Key
+	ids, err := config.RedisSMembers(ownerKey)
+	if err != nil {
+		writeOpenAIError(c, http.StatusInternalServerError, "获取对话列表失败: "+err.Error(), "api_error", "", "")
+		return
+	}
+
+	conversations := make([]*Conversation, 0, len(ids))
+	for _, id := range ids {
+		conv, err := getConversation(id)
+		if err == redis.Nil {
+			// 对话已过期，从索引中移除
+			config.RedisSRem(ownerKey, id)
+			continue
+		}
+		if err != nil || conv.Owner != requestAPIKey(c).Key {
+			continue
+		}
+		conversations = append(conversations, conversationResponse(conv))
+	}
+
+	sort.Slice(conversations, func(i, j int) bool {
+		return conversations[i].UpdatedAt > conversations[j].UpdatedAt
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"data":   conversations,
+	})
+}
+
+// GetConversationHandler 获取对话及其完整消息
+func GetConversationHandler(c *gin.Context) {
+	conv, ok := requestConversation(c, c.Param("id"))
+	if !ok {
+		writeConversationNotFound(c)
+		return
+	}
+	c.JSON(http.StatusOK, conversationResponse(conv))
+}
+
+// DeleteConversationHandler 删除对话
+func DeleteConversationHandler(c *gin.Context) {
+	conv, ok := requestConversation(c, c.Param("id"))
+	if !ok {
+		writeConversationNotFound(c)
+		return
+	}
+
+	if err := config.RedisDel(conversationPrefix + conv.ID); err != nil {
+		writeOpenAIError(c, http.StatusInternalServerError, "删除对话失败: "+err.Error(), "api_error", "", "")
+		return
+	}
+	config.RedisSRem(conversationOwnerPrefix+conv.Owner, conv.ID)
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":      conv.ID,
+		"object":  "conversation.deleted",
+		"deleted": true,
+	})
+}
+
+// MigrateConversationIndex 将建立索引前保存的对话加入所属API Key的对话索引
+func MigrateConversationIndex() error {
+	keys, err := config.RedisKeys(conversationPrefix + "*")
+	if err != nil {
+		return fmt.Errorf("获取对话列表失败: %v", err)
+	}
+
+	for _, key := range keys {
+		conv, err := getConversation(strings.TrimPrefix(key, conversationPrefix))
+		if err != nil {
+			continue
+		}
+		if err := config.RedisSAdd(conversationOwnerPrefix+conv.Owner, conv.ID); err != nil {
+			return fmt.Errorf("写入对话索引失败: %v", err)
+		}
+	}
+	return nil
+}
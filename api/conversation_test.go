@@ -0,0 +1,161 @@
+package api
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// turnSummary 一轮对话的文本摘要，便于比较
+type turnSummary struct {
+	Request string
+	Reply   string
+	Tools   []string // 本轮工具结果的tool_call_id
+	Calls   []string // 本轮助手回复中工具调用的名称
+}
+
+func summarizeTurn(turn conversationTurn) turnSummary {
+	summary := turnSummary{Request: turn.requestText(), Reply: turn.replyText()}
+	for _, msg := range turn.Requests {
+		if msg.Role == "tool" {
+			summary.Tools = append(summary.Tools, msg.ToolCallID)
+		}
+	}
+	for _, call := range turn.replyToolCalls() {
+		summary.Calls = append(summary.Calls, call.Function.Name)
+	}
+	return summary
+}
+
+func TestNormalizeConversation(t *testing.T) {
+	weatherCall := ToolCall{ID: "call_1", Type: "function", Function: ToolCallFunction{Name: "get_weather", Arguments: `{"city":"Paris"}`}}
+
+	tests := []struct {
+		name     string
+		messages []ChatMessage
+		system   string
+		history  []turnSummary
+		current  turnSummary
+	}{
+		{
+			name:     "empty history",
+			messages: []ChatMessage{{Role: "user", Content: "hi"}},
+			current:  turnSummary{Request: "hi"},
+		},
+		{
+			name:     "no messages",
+			messages: nil,
+		},
+		{
+			name: "system messages are merged",
+			messages: []ChatMessage{
+				{Role: "system", Content: "be brief"},
+				{Role: "user", Content: "hi"},
+				{Role: "assistant", Content: "hello"},
+				{Role: "developer", Content: "use markdown"},
+				{Role: "user", Content: "how are you?"},
+			},
+			system:  "be brief\n\nuse markdown",
+			history: []turnSummary{{Request: "hi", Reply: "hello"}},
+			current: turnSummary{Request: "how are you?"},
+		},
+		{
+			name: "consecutive same-role messages are collapsed",
+			messages: []ChatMessage{
+				{Role: "user", Content: "first"},
+				{Role: "user", Content: "second"},
+				{Role: "assistant", Content: "one"},
+				{Role: "assistant", Content: "two"},
+				{Role: "user", Content: "third"},
+			},
+			history: []turnSummary{{Request: "first\n\nsecond", Reply: "one\n\ntwo"}},
+			current: turnSummary{Request: "third"},
+		},
+		{
+			name: "leading assistant message gets an empty request",
+			messages: []ChatMessage{
+				{Role: "assistant", Content: "How can I help?"},
+				{Role: "user", Content: "hi"},
+			},
+			history: []turnSummary{{Reply: "How can I help?"}},
+			current: turnSummary{Request: "hi"},
+		},
+		{
+			name: "tool results follow the tool call",
+			messages: []ChatMessage{
+				{Role: "user", Content: "weather in Paris?"},
+				{Role: "assistant", ToolCalls: []ToolCall{weatherCall}},
+				{Role: "tool", ToolCallID: "call_1", Content: "sunny"},
+			},
+			history: []turnSummary{{Request: "weather in Paris?", Calls: []string{"get_weather"}}},
+			current: turnSummary{Tools: []string{"call_1"}},
+		},
+		{
+			name: "tool results in history",
+			messages: []ChatMessage{
+				{Role: "user", Content: "weather in Paris?"},
+				{Role: "assistant", ToolCalls: []ToolCall{weatherCall}},
+				{Role: "tool", ToolCallID: "call_1", Content: "sunny"},
+				{Role: "assistant", Content: "It is sunny."},
+				{Role: "user", Content: "thanks"},
+			},
+			history: []turnSummary{
+				{Request: "weather in Paris?", Calls: []string{"get_weather"}},
+				{Tools: []string{"call_1"}, Reply: "It is sunny."},
+			},
+			current: turnSummary{Request: "thanks"},
+		},
+		{
+			name: "conversation ending with an assistant reply has no current turn",
+			messages: []ChatMessage{
+				{Role: "user", Content: "hi"},
+				{Role: "assistant", Content: "hello"},
+			},
+			history: []turnSummary{{Request: "hi", Reply: "hello"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conv := normalizeConversation(tt.messages)
+
+			if conv.System != tt.system {
+				t.Errorf("system = %q, want %q", conv.System, tt.system)
+			}
+			var history []turnSummary
+			for _, turn := range conv.History {
+				history = append(history, summarizeTurn(turn))
+			}
+			if !reflect.DeepEqual(history, tt.history) {
+				t.Errorf("history = %+v, want %+v", history, tt.history)
+			}
+			if current := summarizeTurn(conv.Current); !reflect.DeepEqual(current, tt.current) {
+				t.Errorf("current = %+v, want %+v", current, tt.current)
+			}
+		})
+	}
+}
+
+func TestConversationTurnRequestNodes(t *testing.T) {
+	turn := conversationTurn{Requests: []ChatMessage{
+		{Role: "tool", ToolCallID: "call_1", Content: "sunny"},
+		{Role: "tool", ToolCallID: "call_2", Content: "rainy"},
+		{Role: "user", Content: "summarize"},
+	}}
+
+	nodes, err := turn.requestNodes(context.Background())
+	if err != nil {
+		t.Fatalf("requestNodes: %v", err)
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("len(nodes) = %d, want 2", len(nodes))
+	}
+	for i, node := range nodes {
+		if node.ID != i || node.ToolResultNode == nil {
+			t.Errorf("node %d = %+v, want tool result with id %d", i, node, i)
+		}
+	}
+	if text := turn.requestText(); text != "summarize" {
+		t.Errorf("requestText = %q, want %q", text, "summarize")
+	}
+}
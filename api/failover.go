@@ -0,0 +1,266 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// upstreamAttempt 一次上游请求尝试
+type upstreamAttempt struct {
+	Token   string `json:"token"`
+	Outcome string `json:"outcome"`
+}
+
+// 切换token时最多尝试获取租约的次数，避免token池中的token都在使用时反复尝试
+const maxLeaseAttempts = 5
+
+// 上游尝试次数和结果的响应头，流式响应的最终值以同名trailer发送
+const (
+	headerAttempts = "X-Augment-Attempts"
+	headerOutcome  = "X-Augment-Outcome"
+)
+
+// errorOutcome 根据上游错误分类得到请求结果
+func errorOutcome(err *upstreamError) string {
+	switch err.Kind {
+	case upstreamBlocked:
+		return OutcomeBlocked
+	case upstreamCancelled:
+		return OutcomeCancelled
+	default:
+		return OutcomeError
+	}
+}
+
+// needsOtherToken 判断错误是否只能换用其他token解决：被block或鉴权失败
+func needsOtherToken(err *upstreamError) bool {
+	switch err.Kind {
+	case upstreamBlocked:
+		return true
+	case upstreamStatusError:
+		return err.StatusCode == http.StatusUnauthorized || err.StatusCode == http.StatusForbidden
+	}
+	return false
+}
+
+// canFailover 当前请求的token来自token池且未超过切换次数时才允许切换
+func canFailover(c *gin.Context, hops int) bool {
+	if hops >= config.AppConfig.FailoverMaxHops {
+		return false
+	}
+	pooled, _ := c.Get("token_pooled")
+	return pooled == true
+}
+
+// forwardWithFailover 使用上下文中的token请求Augment，返回最终使用的token
+// 尚未交给handle任何内容时：被block或鉴权失败换用token池中的其他token；
+// 连接失败、读取失败或重试策略中的状态码按退避时间重试，可配置为重试时换用其他token。
+// 可以切换token时，被block不再在原token上回退到CHAT模式。
+// 命中响应缓存时直接重放缓存的响应，不请求上游，返回的token为空
+func forwardWithFailover(c *gin.Context, model string, augmentReq AugmentRequest, handle func(AugmentResponse) bool) (string, *upstreamError) {
+	if responses, ok := cachedResponses(c); ok {
+		for _, augmentResp := range responses {
+			if !handle(augmentResp) {
+				break
+			}
+		}
+		return "", nil
+	}
+
+	declareAttemptTrailers(c)
+
+	ctx := c.Request.Context()
+	policy := config.AppConfig.Retry
+	token, tenant := getRequestToken(c)
+	tried := map[string]bool{}
+	hops := 0
+	heartbeat := newStreamHeartbeat(c)
+	defer heartbeat.stop()
+	caching := c.GetString("response_cache_key") != ""
+	memories := newMemoryCollector(c)
+
+	for attempt := 1; ; attempt++ {
+		tried[token] = true
+		failover := canFailover(c, hops)
+
+		client := NewAugmentClient(token, tenant)
+		if failover {
+			client.Fallback = func(augmentReq AugmentRequest, err *upstreamError) bool {
+				return err.Kind != upstreamBlocked && shouldFallbackToChat(augmentReq, err)
+			}
+		}
+
+		delivered := false
+		complete := true
+		started := time.Now()
+		var responses []AugmentResponse
+		// 引用的文件需要先上传到当前token的租户，上传失败与请求失败一样重试或切换token
+		upstreamErr := uploadContextFiles(ctx, c, token, tenant)
+		if upstreamErr == nil {
+			upstreamErr = forwardAugmentStream(ctx, client, augmentReq, heartbeat, func(augmentResp AugmentResponse) bool {
+				if !delivered {
+					// 开始输出前写入本次尝试的结果
+					delivered = true
+					recordAttempt(c, token, OutcomeSuccess)
+					asyncRecordTokenLatency(token, time.Since(started))
+				}
+				if caching {
+					responses = append(responses, augmentResp)
+				}
+				memories.collect(augmentResp.Nodes)
+				if !handle(augmentResp) {
+					complete = false
+					return false
+				}
+				return true
+			})
+		}
+
+		if upstreamErr == nil {
+			if !delivered {
+				recordAttempt(c, token, OutcomeSuccess)
+			}
+			// 只缓存完整读取的响应
+			if caching && complete {
+				storeResponseCache(c, model, responses)
+			}
+			return token, nil
+		}
+		if delivered {
+			// 输出中断时响应头已发送，最终结果通过trailer返回
+			writeAttemptHeaders(c, errorOutcome(upstreamErr))
+			return token, upstreamErr
+		}
+		recordAttempt(c, token, errorOutcome(upstreamErr))
+		if upstreamErr.Kind == upstreamCancelled {
+			return token, upstreamErr
+		}
+
+		var wait time.Duration
+		switched := false
+		switch {
+		case needsOtherToken(upstreamErr):
+			if !failover {
+				return token, upstreamErr
+			}
+			nextToken, nextTenant, ok := switchRequestToken(c, tried)
+			if !ok {
+				return token, upstreamErr
+			}
+			token, tenant = nextToken, nextTenant
+			hops++
+			switched = true
+
+		case retryableError(policy, upstreamErr) && attempt < policy.MaxAttempts:
+			wait = retryBackoff(policy, attempt)
+			if policy.RotateToken && failover {
+				if nextToken, nextTenant, ok := switchRequestToken(c, tried); ok {
+					token, tenant = nextToken, nextTenant
+					hops++
+					switched = true
+				}
+			}
+			// 在原token上重试时遵守上游的Retry-After，等待时间过长则不再重试
+			if !switched && upstreamErr.RetryAfter > 0 {
+				if upstreamErr.RetryAfter > policy.BackoffMax {
+					return token, upstreamErr
+				}
+				if upstreamErr.RetryAfter > wait {
+					wait = upstreamErr.RetryAfter
+				}
+			}
+
+		default:
+			return token, upstreamErr
+		}
+
+		logger.Log.WithFields(logrus.Fields{
+			"token":   token,
+			"attempt": attempt + 1,
+			"wait_ms": wait.Milliseconds(),
+			"error":   upstreamErr.Message,
+		}).Warn("上游请求失败，准备重试")
+
+		if !heartbeat.sleep(ctx, wait) {
+			return token, cancelledError()
+		}
+		if switched {
+			asyncIncrementTokenUsage(c, token, model)
+		}
+	}
+}
+
+// switchRequestToken 从token池中获取并锁定一个未尝试过的token，释放当前token的租约并更新上下文
+func switchRequestToken(c *gin.Context, tried map[string]bool) (string, string, bool) {
+	for i := 0; i < maxLeaseAttempts; i++ {
+		token, tenant := getAvailableTokenExcluding(tried, requestTokenPool(c))
+		if tenant == "" {
+			return "", "", false
+		}
+
+		lock, ok := tryAcquireTokenLease(token)
+		if !ok {
+			// 已被其他请求占用
+			tried[token] = true
+			continue
+		}
+
+		cleanupRequestStatus(c)
+
+		if err := IncrementTokenDailyUsage(token); err != nil {
+			logger.Log.WithFields(logrus.Fields{
+				"token": token,
+				"error": err,
+			}).Error("增加token每日使用计数失败")
+		}
+
+		c.Set("token", token)
+		c.Set("tenant_url", tenant)
+		c.Set("token_lock", lock)
+		bindTokenAffinity(c, token)
+		return token, tenant, true
+	}
+	return "", "", false
+}
+
+// recordAttempt 记录一次上游请求尝试的结果并写入响应头，客户端断开由handleClientCancel记录
+func recordAttempt(c *gin.Context, token, outcome string) {
+	attempts := append(requestAttempts(c), upstreamAttempt{Token: token, Outcome: outcome})
+	c.Set("upstream_attempts", attempts)
+	writeAttemptHeaders(c, outcome)
+
+	if outcome != OutcomeCancelled {
+		RecordRequestOutcome(token, outcome)
+	}
+}
+
+// declareAttemptTrailers 在写入响应前声明尝试次数和结果的trailer
+// 心跳或流式输出会提前发送响应头，之后的尝试结果只能通过trailer返回
+func declareAttemptTrailers(c *gin.Context) {
+	if !c.Writer.Written() {
+		c.Header("Trailer", headerAttempts+", "+headerOutcome)
+	}
+}
+
+// writeAttemptHeaders 写入当前的尝试次数和结果：响应头发送前写入响应头，
+// 发送后写入已声明的trailer，最后一次写入的值即为最终结果
+func writeAttemptHeaders(c *gin.Context, outcome string) {
+	c.Header(headerAttempts, strconv.Itoa(len(requestAttempts(c))))
+	c.Header(headerOutcome, outcome)
+}
+
+// requestAttempts 获取本次请求的所有上游尝试
+func requestAttempts(c *gin.Context) []upstreamAttempt {
+	if value, exists := c.Get("upstream_attempts"); exists {
+		if attempts, ok := value.([]upstreamAttempt); ok {
+			return attempts
+		}
+	}
+	return nil
+}
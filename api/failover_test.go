@@ -0,0 +1,80 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAttemptHeaders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name    string
+		handle  func(c *gin.Context)
+		header  [2]string // 响应头中的尝试次数和结果
+		trailer [2]string // trailer中的尝试次数和结果
+	}{
+		{
+			name: "result known before the response",
+			handle: func(c *gin.Context) {
+				c.Set("upstream_attempts", []upstreamAttempt{{Token: "a", Outcome: OutcomeError}, {Token: "b", Outcome: OutcomeSuccess}})
+				writeAttemptHeaders(c, OutcomeSuccess)
+				c.String(http.StatusOK, "ok")
+			},
+			header:  [2]string{"2", OutcomeSuccess},
+			trailer: [2]string{"2", OutcomeSuccess},
+		},
+		{
+			name: "heartbeat sent before the first attempt finished",
+			handle: func(c *gin.Context) {
+				writeSSEPing(c, c.Writer)
+				c.Set("upstream_attempts", []upstreamAttempt{{Token: "a", Outcome: OutcomeBlocked}})
+				writeAttemptHeaders(c, OutcomeBlocked)
+			},
+			trailer: [2]string{"1", OutcomeBlocked},
+		},
+		{
+			name: "stream interrupted after output",
+			handle: func(c *gin.Context) {
+				c.Set("upstream_attempts", []upstreamAttempt{{Token: "a", Outcome: OutcomeSuccess}})
+				writeAttemptHeaders(c, OutcomeSuccess)
+				writeSSEData(c, gin.H{"text": "partial"})
+				writeAttemptHeaders(c, OutcomeError)
+			},
+			header:  [2]string{"1", OutcomeSuccess},
+			trailer: [2]string{"1", OutcomeError},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.GET("/", func(c *gin.Context) {
+				declareAttemptTrailers(c)
+				tt.handle(c)
+			})
+			server := httptest.NewServer(router)
+			defer server.Close()
+
+			resp, err := http.Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			header := [2]string{resp.Header.Get(headerAttempts), resp.Header.Get(headerOutcome)}
+			if header != tt.header {
+				t.Errorf("header = %v, want %v", header, tt.header)
+			}
+			trailer := [2]string{resp.Trailer.Get(headerAttempts), resp.Trailer.Get(headerOutcome)}
+			if trailer != tt.trailer {
+				t.Errorf("trailer = %v, want %v", trailer, tt.trailer)
+			}
+		})
+	}
+}
@@ -0,0 +1,387 @@
+package api
+
+import (
+	"augment2api/config"
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// fakeRedisEntry 内存中的一个键，按写入的命令类型使用value、hash或set
+type fakeRedisEntry struct {
+	value  string
+	hash   map[string]string
+	set    map[string]bool
+	expire time.Time
+}
+
+// fakeRedis 实现测试用到的Redis命令，过期时间按advance推进的模拟时钟计算，未实现的命令会panic
+type fakeRedis struct {
+	redis.Cmdable
+
+	mu        sync.Mutex
+	now       time.Time
+	data      map[string]*fakeRedisEntry
+	pipelines int // 已执行的流水线数量
+}
+
+// newFakeRedis 在测试期间用fakeRedis替换config.RDB
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	f := &fakeRedis{now: time.Unix(1700000000, 0), data: map[string]*fakeRedisEntry{}}
+	previous := config.RDB
+	config.RDB = f
+	t.Cleanup(func() { config.RDB = previous })
+	return f
+}
+
+// advance 推进模拟时钟
+func (f *fakeRedis) advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
+// lookup 返回未过期的键，调用方需持有锁
+func (f *fakeRedis) lookup(key string) *fakeRedisEntry {
+	entry, ok := f.data[key]
+	if !ok {
+		return nil
+	}
+	if !entry.expire.IsZero() && !f.now.Before(entry.expire) {
+		delete(f.data, key)
+		return nil
+	}
+	return entry
+}
+
+// ensure 返回键，不存在时创建，调用方需持有锁
+func (f *fakeRedis) ensure(key string) *fakeRedisEntry {
+	entry := f.lookup(key)
+	if entry == nil {
+		entry = &fakeRedisEntry{hash: map[string]string{}, set: map[string]bool{}}
+		f.data[key] = entry
+	}
+	return entry
+}
+
+func (f *fakeRedis) Get(ctx context.Context, key string) *redis.StringCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entry := f.lookup(key)
+	if entry == nil {
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return redis.NewStringResult(entry.value, nil)
+}
+
+func (f *fakeRedis) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entry := &fakeRedisEntry{value: fmt.Sprint(value)}
+	if expiration > 0 {
+		entry.expire = f.now.Add(expiration)
+	}
+	f.data[key] = entry
+	return redis.NewStatusResult("OK", nil)
+}
+
+func (f *fakeRedis) MGet(ctx context.Context, keys ...string) *redis.SliceCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		if entry := f.lookup(key); entry != nil {
+			values[i] = entry.value
+		}
+	}
+	return redis.NewSliceResult(values, nil)
+}
+
+func (f *fakeRedis) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var deleted int64
+	for _, key := range keys {
+		if f.lookup(key) != nil {
+			delete(f.data, key)
+			deleted++
+		}
+	}
+	return redis.NewIntResult(deleted, nil)
+}
+
+func (f *fakeRedis) Rename(ctx context.Context, key, newKey string) *redis.StatusCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entry := f.lookup(key)
+	if entry == nil {
+		return redis.NewStatusResult("", fmt.Errorf("ERR no such key"))
+	}
+	delete(f.data, key)
+	f.data[newKey] = entry
+	return redis.NewStatusResult("OK", nil)
+}
+
+func (f *fakeRedis) Exists(ctx context.Context, keys ...string) *redis.IntCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var count int64
+	for _, key := range keys {
+		if f.lookup(key) != nil {
+			count++
+		}
+	}
+	return redis.NewIntResult(count, nil)
+}
+
+func (f *fakeRedis) Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entry := f.lookup(key)
+	if entry == nil {
+		return redis.NewBoolResult(false, nil)
+	}
+	entry.expire = f.now.Add(expiration)
+	return redis.NewBoolResult(true, nil)
+}
+
+func (f *fakeRedis) TTL(ctx context.Context, key string) *redis.DurationCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entry := f.lookup(key)
+	switch {
+	case entry == nil:
+		return redis.NewDurationResult(-2, nil)
+	case entry.expire.IsZero():
+		return redis.NewDurationResult(-1, nil)
+	}
+	return redis.NewDurationResult(entry.expire.Sub(f.now), nil)
+}
+
+func (f *fakeRedis) Keys(ctx context.Context, pattern string) *redis.StringSliceCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for key := range f.data {
+		if matched, _ := path.Match(pattern, key); matched && f.lookup(key) != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return redis.NewStringSliceResult(keys, nil)
+}
+
+func (f *fakeRedis) Incr(ctx context.Context, key string) *redis.IntCmd {
+	return f.IncrBy(ctx, key, 1)
+}
+
+func (f *fakeRedis) IncrBy(ctx context.Context, key string, value int64) *redis.IntCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entry := f.ensure(key)
+	var current int64
+	fmt.Sscan(entry.value, &current)
+	current += value
+	entry.value = fmt.Sprint(current)
+	return redis.NewIntResult(current, nil)
+}
+
+func (f *fakeRedis) HSet(ctx context.Context, key string, values ...interface{}) *redis.IntCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entry := f.ensure(key)
+	var added int64
+	set := func(field string, value interface{}) {
+		if _, ok := entry.hash[field]; !ok {
+			added++
+		}
+		entry.hash[field] = fmt.Sprint(value)
+	}
+	if len(values) == 1 {
+		switch m := values[0].(type) {
+		case map[string]interface{}:
+			for field, value := range m {
+				set(field, value)
+			}
+		case map[string]string:
+			for field, value := range m {
+				set(field, value)
+			}
+		}
+	}
+	for i := 0; i+1 < len(values); i += 2 {
+		set(fmt.Sprint(values[i]), values[i+1])
+	}
+	return redis.NewIntResult(added, nil)
+}
+
+func (f *fakeRedis) HSetNX(ctx context.Context, key, field string, value interface{}) *redis.BoolCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entry := f.ensure(key)
+	if _, ok := entry.hash[field]; ok {
+		return redis.NewBoolResult(false, nil)
+	}
+	entry.hash[field] = fmt.Sprint(value)
+	return redis.NewBoolResult(true, nil)
+}
+
+func (f *fakeRedis) HGet(ctx context.Context, key, field string) *redis.StringCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if entry := f.lookup(key); entry != nil {
+		if value, ok := entry.hash[field]; ok {
+			return redis.NewStringResult(value, nil)
+		}
+	}
+	return redis.NewStringResult("", redis.Nil)
+}
+
+func (f *fakeRedis) HMGet(ctx context.Context, key string, fields ...string) *redis.SliceCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	values := make([]interface{}, len(fields))
+	if entry := f.lookup(key); entry != nil {
+		for i, field := range fields {
+			if value, ok := entry.hash[field]; ok {
+				values[i] = value
+			}
+		}
+	}
+	return redis.NewSliceResult(values, nil)
+}
+
+func (f *fakeRedis) HGetAll(ctx context.Context, key string) *redis.StringStringMapCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	values := map[string]string{}
+	if entry := f.lookup(key); entry != nil {
+		for field, value := range entry.hash {
+			values[field] = value
+		}
+	}
+	return redis.NewStringStringMapResult(values, nil)
+}
+
+func (f *fakeRedis) HExists(ctx context.Context, key, field string) *redis.BoolCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if entry := f.lookup(key); entry != nil {
+		_, ok := entry.hash[field]
+		return redis.NewBoolResult(ok, nil)
+	}
+	return redis.NewBoolResult(false, nil)
+}
+
+func (f *fakeRedis) HIncrBy(ctx context.Context, key, field string, incr int64) *redis.IntCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entry := f.ensure(key)
+	var current int64
+	fmt.Sscan(entry.hash[field], &current)
+	current += incr
+	entry.hash[field] = fmt.Sprint(current)
+	return redis.NewIntResult(current, nil)
+}
+
+func (f *fakeRedis) HDel(ctx context.Context, key string, fields ...string) *redis.IntCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var deleted int64
+	if entry := f.lookup(key); entry != nil {
+		for _, field := range fields {
+			if _, ok := entry.hash[field]; ok {
+				delete(entry.hash, field)
+				deleted++
+			}
+		}
+	}
+	return redis.NewIntResult(deleted, nil)
+}
+
+func (f *fakeRedis) SAdd(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entry := f.ensure(key)
+	var added int64
+	for _, member := range members {
+		if !entry.set[fmt.Sprint(member)] {
+			entry.set[fmt.Sprint(member)] = true
+			added++
+		}
+	}
+	return redis.NewIntResult(added, nil)
+}
+
+func (f *fakeRedis) SRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var removed int64
+	if entry := f.lookup(key); entry != nil {
+		for _, member := range members {
+			if entry.set[fmt.Sprint(member)] {
+				delete(entry.set, fmt.Sprint(member))
+				removed++
+			}
+		}
+	}
+	return redis.NewIntResult(removed, nil)
+}
+
+func (f *fakeRedis) SMembers(ctx context.Context, key string) *redis.StringSliceCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var members []string
+	if entry := f.lookup(key); entry != nil {
+		for member := range entry.set {
+			members = append(members, member)
+		}
+	}
+	sort.Strings(members)
+	return redis.NewStringSliceResult(members, nil)
+}
+
+// Pipelined 依次执行fn加入的命令，与真实流水线一样返回第一个失败命令的错误
+func (f *fakeRedis) Pipelined(ctx context.Context, fn func(redis.Pipeliner) error) ([]redis.Cmder, error) {
+	f.mu.Lock()
+	f.pipelines++
+	f.mu.Unlock()
+
+	pipe := &fakePipeline{fake: f}
+	if err := fn(pipe); err != nil {
+		return nil, err
+	}
+	for _, cmd := range pipe.cmds {
+		if err := cmd.Err(); err != nil {
+			return pipe.cmds, err
+		}
+	}
+	return pipe.cmds, nil
+}
+
+// fakePipeline 流水线中的命令直接在fakeRedis上执行，结果在Pipelined返回前即可读取
+type fakePipeline struct {
+	redis.Pipeliner
+
+	fake *fakeRedis
+	cmds []redis.Cmder
+}
+
+func (p *fakePipeline) Get(ctx context.Context, key string) *redis.StringCmd {
+	cmd := p.fake.Get(ctx, key)
+	p.cmds = append(p.cmds, cmd)
+	return cmd
+}
+
+func (p *fakePipeline) HGet(ctx context.Context, key, field string) *redis.StringCmd {
+	cmd := p.fake.HGet(ctx, key, field)
+	p.cmds = append(p.cmds, cmd)
+	return cmd
+}
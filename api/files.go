@@ -0,0 +1,349 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// 上传文件的键前缀
+const (
+	// 文件元数据，值为File的JSON
+	filePrefix = "file:"
+	// 文件内容，与元数据分开保存，列出文件时不需要读取
+	fileContentPrefix = "file_content:"
+	// 每个下游API Key上传的文件ID集合，列出文件时不需要扫描所有文件
+	fileOwnerPrefix = "files:"
+)
+
+// 单个上传文件的大小上限
+const maxFileBytes = 512 * 1024
+
+// File 上传的上下文文件，聊天请求通过file_ids或workspace引用
+type File struct {
+	ID        string `json:"id"`
+	Object    string `json:"object"`
+	Filename  string `json:"filename"`
+	Path      string `json:"path"` // 上传到租户时使用的文件路径，默认为文件名
+	Bytes     int    `json:"bytes"`
+	Purpose   string `json:"purpose"`
+	Workspace string `json:"workspace,omitempty"`
+	BlobName  string `json:"blob_name"`
+	CreatedAt int64  `json:"created_at"`
+	Owner     string `json:"owner,omitempty"` // 上传文件的下游API Key，只有该Key可以访问，不在响应中返回
+}
+
+func getFile(id string) (*File, error) {
+	data, err := config.RedisGet(filePrefix + id)
+	if err != nil {
+		return nil, err
+	}
+	var file File
+	if err := json.Unmarshal([]byte(data), &file); err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// requestFile 获取当前请求的API Key可以访问的文件，不存在或属于其他Key时返回false
+func requestFile(c *gin.Context, id string) (*File, bool) {
+	file, err := getFile(id)
+	if err != nil || file.Owner != requestAPIKey(c).Key {
+		return nil, false
+	}
+	return file, true
+}
+
+// requestFiles 获取当前请求的API Key上传的所有文件的元数据
+func requestFiles(c *gin.Context) ([]*File, error) {
+	ownerKey := fileOwnerPrefix + requestAPIKey(c).Key
+	ids, err := config.RedisSMembers(ownerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*File, 0, len(ids))
+	for _, id := range ids {
+		file, err := getFile(id)
+		if err == redis.Nil {
+			// 文件已删除，从索引中移除
+			config.RedisSRem(ownerKey, id)
+			continue
+		}
+		if err != nil || file.Owner != requestAPIKey(c).Key {
+			continue
+		}
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].CreatedAt < files[j].CreatedAt
+	})
+	return files, nil
+}
+
+// fileResponse 去掉所属API Key后返回给客户端
+func fileResponse(file *File) *File {
+	resp := *file
+	resp.Owner = ""
+	return &resp
+}
+
+// saveFile 分别保存文件元数据和内容，并加入所属API Key的文件索引
+func saveFile(file *File, content string) error {
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	if err := config.RedisSet(fileContentPrefix+file.ID, content, 0); err != nil {
+		return err
+	}
+	if err := config.RedisSet(filePrefix+file.ID, string(data), 0); err != nil {
+		return err
+	}
+	return config.RedisSAdd(fileOwnerPrefix+file.Owner, file.ID)
+}
+
+// MigrateFileIndex 将旧版包含内容的文件拆分为元数据和内容，并建立每个API Key的文件索引
+func MigrateFileIndex() error {
+	keys, err := config.RedisKeys(filePrefix + "*")
+	if err != nil {
+		return fmt.Errorf("获取文件列表失败: %v", err)
+	}
+
+	for _, key := range keys {
+		data, err := config.RedisGet(key)
+		if err != nil {
+			continue
+		}
+		// 旧版的文件JSON中包含content字段
+		var legacy struct {
+			File
+			Content *string `json:"content"`
+		}
+		if err := json.Unmarshal([]byte(data), &legacy); err != nil {
+			continue
+		}
+		if legacy.Content != nil {
+			if err := saveFile(&legacy.File, *legacy.Content); err != nil {
+				return fmt.Errorf("迁移文件失败: %v", err)
+			}
+			continue
+		}
+		if err := config.RedisSAdd(fileOwnerPrefix+legacy.Owner, legacy.ID); err != nil {
+			return fmt.Errorf("写入文件索引失败: %v", err)
+		}
+	}
+	return nil
+}
+
+func writeFileNotFound(c *gin.Context, id string) {
+	writeOpenAIError(c, http.StatusNotFound, "文件不存在: "+id, "invalid_request_error", "file_id", "file_not_found")
+}
+
+// attachFiles 将请求通过file_ids和workspace引用的文件加入AddedBlobs，
+// 文件内容在每次请求上游前由uploadContextFiles上传到当前token的租户。引用的文件不存在时返回false
+func attachFiles(c *gin.Context, req OpenAIRequest, augmentReq *AugmentRequest) bool {
+	if len(req.FileIDs) == 0 && req.Workspace == "" {
+		return true
+	}
+
+	var files []*File
+	for _, id := range req.FileIDs {
+		file, ok := requestFile(c, id)
+		if !ok {
+			writeFileNotFound(c, id)
+			return false
+		}
+		files = append(files, file)
+	}
+	if req.Workspace != "" {
+		all, err := requestFiles(c)
+		if err != nil {
+			writeOpenAIError(c, http.StatusInternalServerError, "获取文件列表失败: "+err.Error(), "api_error", "", "")
+			return false
+		}
+		for _, file := range all {
+			if file.Workspace == req.Workspace {
+				files = append(files, file)
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	blobs := make([]Blob, 0, len(files))
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		if seen[file.BlobName] {
+			continue
+		}
+		seen[file.BlobName] = true
+		content, err := config.RedisGet(fileContentPrefix + file.ID)
+		if err != nil {
+			writeOpenAIError(c, http.StatusInternalServerError, "读取文件内容失败: "+err.Error(), "api_error", "", "")
+			return false
+		}
+		blobs = append(blobs, Blob{BlobName: file.BlobName, Path: file.Path, Content: content})
+		names = append(names, file.BlobName)
+	}
+
+	// 按名称排序，相同的文件集合生成相同的请求
+	sort.Strings(names)
+	for _, name := range names {
+		augmentReq.Blobs.AddedBlobs = append(augmentReq.Blobs.AddedBlobs, name)
+	}
+	c.Set("context_blobs", blobs)
+	return true
+}
+
+// uploadContextFiles 将请求引用的文件上传到token所属的租户，请求未引用文件时不做任何处理
+func uploadContextFiles(ctx context.Context, c *gin.Context, token, tenantURL string) *upstreamError {
+	value, exists := c.Get("context_blobs")
+	if !exists {
+		return nil
+	}
+	blobs, ok := value.([]Blob)
+	if !ok || len(blobs) == 0 {
+		return nil
+	}
+	return currentBlobStore().Upload(ctx, token, tenantURL, blobs)
+}
+
+// UploadFileHandler 上传上下文文件（multipart/form-data）
+// 表单字段：file为文件内容，可选purpose、workspace和path（上传到租户时使用的路径，默认为文件名）
+func UploadFileHandler(c *gin.Context) {
+	header, err := c.FormFile("file")
+	if err != nil {
+		writeOpenAIError(c, http.StatusBadRequest, "缺少上传的文件", "invalid_request_error", "file", "")
+		return
+	}
+	if header.Size > maxFileBytes {
+		writeOpenAIError(c, http.StatusBadRequest, fmt.Sprintf("文件大小不能超过%d字节", maxFileBytes), "invalid_request_error", "file", "")
+		return
+	}
+
+	src, err := header.Open()
+	if err != nil {
+		writeOpenAIError(c, http.StatusBadRequest, "读取文件失败: "+err.Error(), "invalid_request_error", "file", "")
+		return
+	}
+	defer src.Close()
+	data, err := io.ReadAll(io.LimitReader(src, maxFileBytes+1))
+	if err != nil {
+		writeOpenAIError(c, http.StatusBadRequest, "读取文件失败: "+err.Error(), "invalid_request_error", "file", "")
+		return
+	}
+	if len(data) > maxFileBytes {
+		writeOpenAIError(c, http.StatusBadRequest, fmt.Sprintf("文件大小不能超过%d字节", maxFileBytes), "invalid_request_error", "file", "")
+		return
+	}
+	// 上下文引擎只索引文本内容
+	if !utf8.Valid(data) {
+		writeOpenAIError(c, http.StatusBadRequest, "只支持UTF-8编码的文本文件", "invalid_request_error", "file", "")
+		return
+	}
+
+	path := strings.TrimSpace(c.PostForm("path"))
+	if path == "" {
+		path = header.Filename
+	}
+	purpose := c.PostForm("purpose")
+	if purpose == "" {
+		purpose = "assistants"
+	}
+	content := string(data)
+
+	file := &File{
+		ID:        "file-" + strings.ReplaceAll(uuid.New().String(), "-", ""),
+		Object:    "file",
+		Filename:  header.Filename,
+		Path:      path,
+		Bytes:     len(data),
+		Purpose:   purpose,
+		Workspace: strings.TrimSpace(c.PostForm("workspace")),
+		BlobName:  blobName(path, content),
+		CreatedAt: time.Now().Unix(),
+		Owner:     requestAPIKey(c).Key,
+	}
+
+	if err := saveFile(file, content); err != nil {
+		writeOpenAIError(c, http.StatusInternalServerError, "保存文件失败: "+err.Error(), "api_error", "", "")
+		return
+	}
+
+	logger.Log.WithFields(logrus.Fields{
+		"file_id":   file.ID,
+		"path":      file.Path,
+		"bytes":     file.Bytes,
+		"workspace": file.Workspace,
+	}).Info("上传文件成功")
+
+	c.JSON(http.StatusOK, fileResponse(file))
+}
+
+// ListFilesHandler 列出当前API Key上传的文件，可通过workspace参数过滤
+func ListFilesHandler(c *gin.Context) {
+	files, err := requestFiles(c)
+	if err != nil {
+		writeOpenAIError(c, http.StatusInternalServerError, "获取文件列表失败: "+err.Error(), "api_error", "", "")
+		return
+	}
+
+	workspace := c.Query("workspace")
+	data := make([]*File, 0, len(files))
+	for _, file := range files {
+		if workspace != "" && file.Workspace != workspace {
+			continue
+		}
+		data = append(data, fileResponse(file))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"data":   data,
+	})
+}
+
+// GetFileHandler 获取文件信息
+func GetFileHandler(c *gin.Context) {
+	file, ok := requestFile(c, c.Param("id"))
+	if !ok {
+		writeFileNotFound(c, c.Param("id"))
+		return
+	}
+	c.JSON(http.StatusOK, fileResponse(file))
+}
+
+// DeleteFileHandler 删除文件，已上传到租户的blob不受影响，之后的请求不再引用
+func DeleteFileHandler(c *gin.Context) {
+	file, ok := requestFile(c, c.Param("id"))
+	if !ok {
+		writeFileNotFound(c, c.Param("id"))
+		return
+	}
+
+	if err := config.RedisDel(filePrefix + file.ID); err != nil {
+		writeOpenAIError(c, http.StatusInternalServerError, "删除文件失败: "+err.Error(), "api_error", "", "")
+		return
+	}
+	config.RedisDel(fileContentPrefix + file.ID)
+	config.RedisSRem(fileOwnerPrefix+file.Owner, file.ID)
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":      file.ID,
+		"object":  "file",
+		"deleted": true,
+	})
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"augment2api/config"
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newFilesRouter 创建文件接口的路由，Authorization请求头作为下游API Key
+func newFilesRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("api_key", config.APIKey{Key: c.GetHeader("Authorization")})
+	})
+	router.GET("/v1/files", ListFilesHandler)
+	router.POST("/v1/files", UploadFileHandler)
+	router.DELETE("/v1/files/:id", DeleteFileHandler)
+	return router
+}
+
+func uploadFile(t *testing.T, router *gin.Engine, apiKey, filename, content string) File {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", filename)
+	part.Write([]byte(content))
+	form.WriteField("workspace", "repo")
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/files", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", apiKey)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("上传文件失败: %d %s", w.Code, w.Body.String())
+	}
+	var file File
+	json.Unmarshal(w.Body.Bytes(), &file)
+	return file
+}
+
+func listFiles(t *testing.T, router *gin.Engine, apiKey string) []string {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/v1/files", nil)
+	req.Header.Set("Authorization", apiKey)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if strings.Contains(w.Body.String(), "content") {
+		t.Errorf("文件列表包含文件内容: %s", w.Body.String())
+	}
+	var resp struct {
+		Data []File `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	var names []string
+	for _, file := range resp.Data {
+		names = append(names, file.Filename)
+	}
+	// 同一秒上传的文件顺序不确定
+	sort.Strings(names)
+	return names
+}
+
+func TestFilesOwnerIndex(t *testing.T) {
+	newFakeRedis(t)
+	router := newFilesRouter()
+
+	main := uploadFile(t, router, "key-a", "main.go", "package main")
+	uploadFile(t, router, "key-a", "util.go", "package util")
+	uploadFile(t, router, "key-b", "secret.go", "package secret")
+
+	if names := listFiles(t, router, "key-a"); strings.Join(names, ",") != "main.go,util.go" {
+		t.Errorf("key-a的文件 = %v", names)
+	}
+	if names := listFiles(t, router, "key-b"); strings.Join(names, ",") != "secret.go" {
+		t.Errorf("key-b的文件 = %v", names)
+	}
+
+	// 引用工作区时才读取文件内容
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Set("api_key", config.APIKey{Key: "key-a"})
+	var augmentReq AugmentRequest
+	if !attachFiles(c, OpenAIRequest{Workspace: "repo"}, &augmentReq) {
+		t.Fatal("attachFiles失败")
+	}
+	value, _ := c.Get("context_blobs")
+	contents := map[string]string{}
+	for _, blob := range value.([]Blob) {
+		contents[blob.Path] = blob.Content
+	}
+	if contents["main.go"] != "package main" || contents["util.go"] != "package util" || len(contents) != 2 {
+		t.Errorf("工作区文件内容 = %v", contents)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/v1/files/"+main.ID, nil)
+	req.Header.Set("Authorization", "key-a")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	if names := listFiles(t, router, "key-a"); strings.Join(names, ",") != "util.go" {
+		t.Errorf("删除后key-a的文件 = %v", names)
+	}
+	if members, _ := config.RedisSMembers(fileOwnerPrefix + "key-a"); len(members) != 1 {
+		t.Errorf("删除后的文件索引 = %v", members)
+	}
+	if exists, _ := config.RedisExists(fileContentPrefix + main.ID); exists {
+		t.Error("文件内容未删除")
+	}
+}
+
+func TestMigrateFileIndex(t *testing.T) {
+	newFakeRedis(t)
+	// 旧版的文件JSON包含内容
+	config.RedisSet(filePrefix+"file-1", `{"id":"file-1","object":"file","filename":"a.go","path":"a.go","owner":"key-a","content":"package a"}`, 0)
+
+	if err := MigrateFileIndex(); err != nil {
+		t.Fatalf("MigrateFileIndex: %v", err)
+	}
+	if err := MigrateFileIndex(); err != nil {
+		t.Fatalf("重复迁移失败: %v", err)
+	}
+
+	if data, _ := config.RedisGet(filePrefix + "file-1"); strings.Contains(data, "content") {
+		t.Errorf("迁移后的元数据仍包含内容: %s", data)
+	}
+	if content, _ := config.RedisGet(fileContentPrefix + "file-1"); content != "package a" {
+		t.Errorf("迁移后的文件内容 = %q", content)
+	}
+	if members, _ := config.RedisSMembers(fileOwnerPrefix + "key-a"); strings.Join(members, ",") != "file-1" {
+		t.Errorf("迁移后的文件索引 = %v", members)
+	}
+}
@@ -3,16 +3,14 @@ package api
 import (
 	"augment2api/config"
 	"augment2api/pkg/logger"
-	"bufio"
-	"bytes"
+	"augment2api/pkg/tokenizer"
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"math/rand"
 	"net/http"
-	"net/url"
 	"strings"
 	"sync"
 	"time"
@@ -29,6 +27,18 @@ type OpenAIRequest struct {
 	Stream      bool          `json:"stream,omitempty"`
 	Temperature float64       `json:"temperature,omitempty"`
 	MaxTokens   int           `json:"max_tokens,omitempty"`
+	Tools       []OpenAITool  `json:"tools,omitempty"`
+	ToolChoice  interface{}   `json:"tool_choice,omitempty"`
+
+	StreamOptions  *StreamOptions  `json:"stream_options,omitempty"`
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+	ConversationID string          `json:"conversation_id,omitempty"` // 服务端对话ID，携带时messages只需包含新消息
+	FileIDs        []string        `json:"file_ids,omitempty"`        // 作为上下文的上传文件ID
+	Workspace      string          `json:"workspace,omitempty"`       // 使用该工作区中的所有上传文件作为上下文
+
+	IncludeReasoning bool `json:"include_reasoning,omitempty"` // 以reasoning_content返回思考节点
+	IncludeNodes     bool `json:"include_nodes,omitempty"`     // 以augment_nodes返回其他响应节点
+	AutoContinue     bool `json:"auto_continue,omitempty"`     // 回复被截断时自动续写并拼接到同一个响应中
 }
 
 // OpenAIResponse OpenAI兼容的响应结构
@@ -48,6 +58,7 @@ type OpenAIStreamResponse struct {
 	Created int64          `json:"created"`
 	Model   string         `json:"model"`
 	Choices []StreamChoice `json:"choices"`
+	Usage   *Usage         `json:"usage,omitempty"` // 仅在include_usage的最后一个块中返回
 }
 
 type StreamChoice struct {
@@ -63,8 +74,14 @@ type Choice struct {
 }
 
 type ChatMessage struct {
-	Role    string      `json:"role"`
-	Content interface{} `json:"content"`
+	Role       string      `json:"role"`
+	Content    interface{} `json:"content"`
+	Name       string      `json:"name,omitempty"`
+	ToolCalls  []ToolCall  `json:"tool_calls,omitempty"`
+	ToolCallID string      `json:"tool_call_id,omitempty"`
+
+	ReasoningContent string          `json:"reasoning_content,omitempty"` // 模型的思考内容，请求include_reasoning时返回
+	AugmentNodes     []NodeExtension `json:"augment_nodes,omitempty"`     // 其他响应节点，请求include_nodes时返回
 }
 
 // GetContent 添加一个辅助方法来获取消息内容
@@ -105,23 +122,43 @@ type ToolDefinition struct {
 
 // Node 节点结构
 type Node struct {
-	ID          int         `json:"id"`
-	Type        int         `json:"type"`
-	Content     string      `json:"content"`
-	ToolUse     ToolUse     `json:"tool_use"`
-	AgentMemory AgentMemory `json:"agent_memory"`
+	ID             int             `json:"id"`
+	Type           int             `json:"type"`
+	Content        string          `json:"content"`
+	ToolUse        ToolUse         `json:"tool_use"`
+	AgentMemory    AgentMemory     `json:"agent_memory"`
+	TextNode       *TextNode       `json:"text_node,omitempty"`
+	ToolResultNode *ToolResultNode `json:"tool_result_node,omitempty"`
+	ImageNode      *ImageNode      `json:"image_node,omitempty"`
+	Thinking       *ThinkingNode   `json:"thinking,omitempty"`
+	TokenUsage     *TokenUsageNode `json:"token_usage,omitempty"`
 }
 
+// ToolUse 工具调用节点（tool_use、tool_use_start）的内容
 type ToolUse struct {
 	ToolUseID string `json:"tool_use_id"`
 	ToolName  string `json:"tool_name"`
 	InputJSON string `json:"input_json"`
+	IsPartial bool   `json:"is_partial,omitempty"` // tool_use_start节点中参数尚未完整
 }
 
+// AgentMemory 记忆节点（agent_memory）的内容
 type AgentMemory struct {
 	Content string `json:"content"`
 }
 
+// TextNode 请求中的文本节点
+type TextNode struct {
+	Content string `json:"content"`
+}
+
+// ToolResultNode 请求中的工具执行结果节点
+type ToolResultNode struct {
+	ToolUseID string `json:"tool_use_id"`
+	Content   string `json:"content"`
+	IsError   bool   `json:"is_error"`
+}
+
 // AugmentRequest Augment API请求结构
 type AugmentRequest struct {
 	ChatHistory    []AugmentChatHistory `json:"chat_history"`
@@ -145,6 +182,9 @@ type AugmentRequest struct {
 	} `json:"feature_detection_flags"`
 	ToolDefinitions []ToolDefinition `json:"tool_definitions"`
 	Nodes           []Node           `json:"nodes"`
+
+	// 回退到CHAT模式时使用的用户指南，由提示词模板渲染，不发送给Augment
+	fallbackGuideLines string
 }
 
 type AugmentChatHistory struct {
@@ -157,8 +197,10 @@ type AugmentChatHistory struct {
 
 // AugmentResponse Augment API响应结构
 type AugmentResponse struct {
-	Text string `json:"text"`
-	Done bool   `json:"done"`
+	Text       string      `json:"text"`
+	Done       bool        `json:"done"`
+	Nodes      []Node      `json:"nodes,omitempty"`
+	StopReason interface{} `json:"stop_reason,omitempty"` // 停止原因，上游可能返回字符串或数字
 }
 
 // CodeResponse 用于解析从授权服务返回的代码
@@ -259,37 +301,16 @@ func generatePath() string {
 	return fmt.Sprintf("%s/%s%s", dir, filename, ext)
 }
 
-// convertToAugmentRequest 将OpenAI请求转换为Augment请求
-func convertToAugmentRequest(req OpenAIRequest) AugmentRequest {
-	// 确定模式和其他参数基于模型名称
-	mode := "CHAT" // 默认使用CHAT模式
-	userGuideLines := "must answer in Chinese."
-	includeToolDefinitions := false
-	includeDefaultPrompt := false
-
-	// 将模型名称转换为小写，然后检查后缀
-	modelLower := strings.ToLower(req.Model)
-
-	// 检查模型名称后缀 (不区分大小写)
-	if strings.HasSuffix(modelLower, "-chat") {
-		// 保持使用CHAT模式的默认设置
-		mode = "CHAT"
-	} else if strings.HasSuffix(modelLower, "-agent") {
-		// 使用AGENT模式
-		mode = "AGENT"
-		userGuideLines = "Answer in Chinese, do not use any tools, and for questions involving internet searches, please answer based on your existing knowledge."
-		includeToolDefinitions = true
-		includeDefaultPrompt = true
-	}
-
-	augmentReq := AugmentRequest{
-		Path:           "",                  // 这个是关联的项目文件路径，暂时传空，不影响对话
-		Mode:           mode,                // 根据模型名称决定模式
-		Prefix:         defaultPrefix,       // 固定前缀，影响模型回复风格
-		Suffix:         " ",                 // 固定后缀，暂时传空，不影响对话
-		Lang:           detectLanguage(req), // 简单检测当前对话语言类型，不传好像回答有问题
-		Message:        "",                  // 当前对话消息
-		UserGuideLines: userGuideLines,      // 根据模型类型设置指南
+// newAugmentRequest 创建一个使用默认前后缀、空历史和空blobs的Augment请求
+func newAugmentRequest(mode, lang, userGuideLines string) AugmentRequest {
+	return AugmentRequest{
+		Path:           "",             // 这个是关联的项目文件路径，暂时传空，不影响对话
+		Mode:           mode,           // 根据模型名称决定模式
+		Prefix:         defaultPrefix,  // 固定前缀，影响模型回复风格
+		Suffix:         " ",            // 固定后缀，暂时传空，不影响对话
+		Lang:           lang,           // 简单检测当前对话语言类型，不传好像回答有问题
+		Message:        "",             // 当前对话消息
+		UserGuideLines: userGuideLines, // 根据模型类型设置指南
 		// 初始化为空列表
 		ChatHistory: make([]AugmentChatHistory, 0),
 		Blobs: struct {
@@ -311,57 +332,129 @@ func convertToAugmentRequest(req OpenAIRequest) AugmentRequest {
 		ToolDefinitions: []ToolDefinition{}, // 初始化为空
 		Nodes:           make([]Node, 0),
 	}
+}
+
+// convertToAugmentRequest 将OpenAI请求转换为Augment请求
+// 用户指南、前缀和提示词由API Key或模型对应的提示词模板渲染
+// 消息内容无法转换（如不支持的内容类型、无效图片）时返回错误，客户端断开时停止下载图片
+func convertToAugmentRequest(c *gin.Context, req OpenAIRequest, apiKey config.APIKey) (AugmentRequest, error) {
+	ctx := c.Request.Context()
+
+	// 根据模型注册表确定模式和工具
+	model, err := requestModel(c, req.Model)
+	if err != nil {
+		return AugmentRequest{}, err
+	}
+	tmpl := selectPromptTemplate(apiKey, model)
+	mode := model.Mode
+	includeToolDefinitions := model.IncludeTools
+
+	// 模型未单独配置指南和提示词时，使用模板中对应模式的内容
+	userGuideLines := model.UserGuidelines
+	if userGuideLines == "" {
+		userGuideLines = tmpl.ChatGuidelines
+		if mode == "AGENT" {
+			userGuideLines = tmpl.AgentGuidelines
+		}
+	}
+	modelPrompt := model.DefaultPrompt
+	if modelPrompt == "" && mode == "AGENT" {
+		modelPrompt = tmpl.DefaultPrompt
+	}
+
+	// 按角色整理对话，system消息合并到用户指南中
+	conv := normalizeConversation(req.Messages)
+
+	// 客户端自带工具时使用AGENT模式，并以客户端工具替换内置工具定义
+	clientTools := convertOpenAITools(req.Tools, req.ToolChoice)
+	if len(clientTools) > 0 {
+		mode = "AGENT"
+		userGuideLines = tmpl.ToolGuidelines
+		includeToolDefinitions = false
+		modelPrompt = ""
+	}
+
+	vars := newPromptVars(req.Model, apiKey, mode)
+	augmentReq := newAugmentRequest(mode, detectLanguage(conv.Current.lastRequestContent()), renderPrompt(userGuideLines, vars))
+	augmentReq.Prefix = renderPrompt(tmpl.Prefix, vars)
+	modelPrompt = renderPrompt(modelPrompt, vars)
+
+	// 回退到CHAT模式时按CHAT模式渲染
+	vars.Mode = "CHAT"
+	augmentReq.fallbackGuideLines = renderPrompt(tmpl.FallbackGuidelines, vars)
 
 	// 根据模型类型决定是否包含工具定义
 	if includeToolDefinitions {
 		augmentReq.ToolDefinitions = getFullToolDefinitions()
 	}
+	if len(clientTools) > 0 {
+		augmentReq.ToolDefinitions = clientTools
+	}
 
-	// 处理消息历史
-	if len(req.Messages) > 1 { // 有历史消息
-		// 每次处理一对消息（用户问题和助手回答）
-		for i := 0; i < len(req.Messages)-1; i += 2 {
-			if i+1 < len(req.Messages) {
-				userMsg := req.Messages[i]
-				assistantMsg := req.Messages[i+1]
-
-				chatHistory := AugmentChatHistory{
-					RequestMessage: userMsg.GetContent(),
-					ResponseText:   assistantMsg.GetContent(),
-					RequestID:      generateRequestID(), // 生成唯一的请求ID
-					RequestNodes:   make([]Node, 0),
-					ResponseNodes: []Node{
-						{
-							ID:      0,
-							Type:    0,
-							Content: assistantMsg.GetContent(),
-							ToolUse: ToolUse{
-								ToolUseID: "",
-								ToolName:  "",
-								InputJSON: "",
-							},
-							AgentMemory: AgentMemory{
-								Content: "",
-							},
-						},
-					},
-				}
-				augmentReq.ChatHistory = append(augmentReq.ChatHistory, chatHistory)
-			}
-		}
+	if conv.System != "" {
+		augmentReq.UserGuideLines = conv.System + "\n" + augmentReq.UserGuideLines
 	}
 
-	// 设置当前消息
-	if len(req.Messages) > 0 {
-		lastMsg := req.Messages[len(req.Messages)-1]
-		if includeDefaultPrompt {
-			augmentReq.Message = defaultPrompt + "\n" + lastMsg.GetContent()
-		} else {
-			augmentReq.Message = lastMsg.GetContent()
+	// 处理消息历史，每轮包含用户请求和助手回答
+	for _, turn := range conv.History {
+		chatHistory, err := newChatHistory(ctx, turn)
+		if err != nil {
+			return AugmentRequest{}, err
 		}
+		augmentReq.ChatHistory = append(augmentReq.ChatHistory, chatHistory)
 	}
 
-	return augmentReq
+	// 设置当前消息，工具结果和图片作为当前请求的节点发送
+	nodes, err := conv.Current.requestNodes(ctx)
+	if err != nil {
+		return AugmentRequest{}, err
+	}
+	augmentReq.Nodes = nodes
+	augmentReq.Message = conv.Current.requestText()
+	if modelPrompt != "" && augmentReq.Message != "" {
+		augmentReq.Message = modelPrompt + "\n" + augmentReq.Message
+	}
+
+	// AGENT模式发送API Key保存的记忆
+	injectAgentMemories(&augmentReq, apiKey)
+
+	return augmentReq, nil
+}
+
+// newChatHistory 将一轮问答转换为Augment的历史记录
+func newChatHistory(ctx context.Context, turn conversationTurn) (AugmentChatHistory, error) {
+	requestNodes, err := turn.requestNodes(ctx)
+	if err != nil {
+		return AugmentChatHistory{}, err
+	}
+
+	responseText := turn.replyText()
+	chatHistory := AugmentChatHistory{
+		RequestMessage: turn.requestText(),
+		ResponseText:   responseText,
+		RequestID:      generateRequestID(), // 生成唯一的请求ID
+		RequestNodes:   requestNodes,
+		ResponseNodes: []Node{
+			{
+				ID:      0,
+				Type:    responseNodeTypeRawResponse,
+				Content: responseText,
+				ToolUse: ToolUse{
+					ToolUseID: "",
+					ToolName:  "",
+					InputJSON: "",
+				},
+				AgentMemory: AgentMemory{
+					Content: "",
+				},
+			},
+		},
+	}
+
+	// 助手的工具调用作为响应节点
+	chatHistory.ResponseNodes = append(chatHistory.ResponseNodes, toolUseNodes(turn.replyToolCalls(), 1)...)
+
+	return chatHistory, nil
 }
 
 // generateRequestID 生成唯一的请求ID
@@ -371,12 +464,11 @@ func generateRequestID() string {
 }
 
 // detectLanguage 检测编程语言
-func detectLanguage(req OpenAIRequest) string {
-	if len(req.Messages) == 0 {
+func detectLanguage(content string) string {
+	if content == "" {
 		return ""
 	}
 
-	content := req.Messages[len(req.Messages)-1].GetContent()
 	// 简单判断一下当前对话语言类型
 	if strings.Contains(strings.ToLower(content), "html") {
 		return "HTML"
@@ -528,25 +620,30 @@ func CallbackHandler(c *gin.Context, getAccessTokenFunc func(string, string, str
 	})
 }
 
-// ModelsHandler 处理模型请求
+// ModelsHandler 处理模型请求，返回注册表中所有启用的模型及其别名
 func ModelsHandler(c *gin.Context) {
-	// 这里直接返回写死的模型
+	models, err := config.GetAllModelConfigs()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取模型列表失败"})
+		return
+	}
+
 	response := ModelsResponse{
 		Object: "list",
-		Data: []ModelObject{
-			{
-				ID:      "claude-3.7-agent",
-				Object:  "model",
-				Created: 1708387200,
-				OwnedBy: "anthropic",
-			},
-			{
-				ID:      "augment-chat",
+		Data:   []ModelObject{},
+	}
+	for _, model := range models {
+		if !model.Enabled {
+			continue
+		}
+		for _, id := range append([]string{model.ID}, model.Aliases...) {
+			response.Data = append(response.Data, ModelObject{
+				ID:      id,
 				Object:  "model",
-				Created: 1708387200,
-				OwnedBy: "augment",
-			},
-		},
+				Created: int(model.Created),
+				OwnedBy: model.OwnedBy,
+			})
+		}
 	}
 
 	c.JSON(http.StatusOK, response)
@@ -563,21 +660,66 @@ func ChatCompletionsHandler(c *gin.Context) {
 		return
 	}
 
+	if _, err := requestModel(c, req.Model); err != nil {
+		writeOpenAIError(c, http.StatusNotFound, err.Error(), "invalid_request_error", "model", "model_not_found")
+		cleanupRequestStatus(c)
+		return
+	}
+
+	formatSpec, err := parseResponseFormat(req.ResponseFormat)
+	if err != nil {
+		writeOpenAIError(c, http.StatusBadRequest, err.Error(), "invalid_request_error", "response_format", "")
+		cleanupRequestStatus(c)
+		return
+	}
+
+	// 携带conversation_id时在服务端保存的历史后追加本次消息
+	conv, ok := applyConversation(c, &req)
+	if !ok {
+		writeConversationNotFound(c)
+		cleanupRequestStatus(c)
+		return
+	}
+
 	// 转换为Augment请求格式
-	augmentReq := convertToAugmentRequest(req)
+	augmentReq, err := requestAugmentRequest(c, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		cleanupRequestStatus(c)
+		return
+	}
+	if conv != nil {
+		augmentReq.Blobs.CheckpointID = conv.CheckpointID
+	}
+	if !attachFiles(c, req, &augmentReq) {
+		cleanupRequestStatus(c)
+		return
+	}
+	trimContext(c, req.Model, &augmentReq)
+
+	// 结构化输出需要校验完整回复
+	if formatSpec != nil {
+		handleStructuredRequest(c, req, augmentReq, formatSpec)
+		return
+	}
+
+	// 回复被截断时自动续写，结构化输出已有自己的重试逻辑
+	c.Set("auto_continue", req.AutoContinue)
 
 	// 处理流式请求
 	if req.Stream {
-		handleStreamRequest(c, augmentReq, req.Model)
+		includeUsage := req.StreamOptions != nil && req.StreamOptions.IncludeUsage
+		handleStreamRequest(c, augmentReq, req.Model, includeUsage, newNodeCollector(req))
 		return
 	}
 
 	// 处理非流式请求
-	handleNonStreamRequest(c, augmentReq, req.Model)
+	handleNonStreamRequest(c, augmentReq, req.Model, newNodeCollector(req))
 }
 
 // 异步处理token使用计数
-func asyncIncrementTokenUsage(token string, model string) {
+func asyncIncrementTokenUsage(c *gin.Context, token string, model string) {
+	modelConfig, _ := requestModel(c, model)
 	go func() {
 		defer func() {
 			if r := recover(); r != nil {
@@ -590,12 +732,12 @@ func asyncIncrementTokenUsage(token string, model string) {
 		}()
 
 		// 增加token使用计数
-		incrementTokenUsage(token, model)
+		incrementTokenUsage(token, modelConfig.Mode)
 	}()
 }
 
 // 处理流式请求
-func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string) {
+func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string, includeUsage bool, nodes *nodeCollector) {
 	defer func() {
 		if r := recover(); r != nil {
 			logger.Log.WithFields(logrus.Fields{
@@ -608,70 +750,19 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 		cleanupRequestStatus(c)
 	}()
 
-	// 从上下文中获取token和tenant_url
-	tokenInterface, exists := c.Get("token")
-	tenantURLInterface, exists2 := c.Get("tenant_url")
-
-	var token, tenant string
-
-	if exists && exists2 {
-		token, _ = tokenInterface.(string)
-		tenant, _ = tenantURLInterface.(string)
-	}
-
-	// 如果上下文中没有，则使用GetAuthInfo获取
-	if token == "" || tenant == "" {
-		token, tenant = GetAuthInfo()
-	}
-
-	if token == "" || tenant == "" {
+	// 从上下文中获取token和tenant_url，命中响应缓存时不使用token
+	cacheHit := ResponseCacheHit(c)
+	token, tenant := getRequestToken(c)
+	if !cacheHit && (token == "" || tenant == "") {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "无可用Token,请先在管理页面获取"})
 		return
 	}
 
 	// 异步处理token使用计数
-	asyncIncrementTokenUsage(token, model)
-
-	// 准备请求数据
-	jsonData, err := json.Marshal(augmentReq)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "序列化请求失败"})
-		return
+	if !cacheHit {
+		asyncIncrementTokenUsage(c, token, model)
 	}
 
-	// 提取主机部分
-	parsedURL, err := url.Parse(tenant)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "解析租户URL失败"})
-		return
-	}
-	hostName := parsedURL.Host
-
-	// 创建请求
-	requestURL := tenant + "chat-stream"
-	req, err := http.NewRequest("POST", requestURL, bytes.NewReader(jsonData))
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建请求失败"})
-		return
-	}
-
-	// 设置请求头
-	req.Header.Set("Host", hostName)
-	req.Header.Set("Content-Length", fmt.Sprintf("%d", len(jsonData)))
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("User-Agent", "augment.intellij/0.184.0 (Mac OS X; aarch64; 15.2) WebStorm/2024.3.5")
-	req.Header.Set("x-api-version", "2")
-
-	// 生成请求ID和会话ID
-	requestID := uuid.New().String()
-	sessionID := uuid.New().String()
-	req.Header.Set("x-request-id", requestID)
-	req.Header.Set("x-request-session-id", sessionID)
-
-	// 使用createHTTPClient创建客户端
-	client := createHTTPClient()
-
 	// 设置刷新器以确保数据立即发送
 	flusher, ok := c.Writer.(http.Flusher)
 	if !ok {
@@ -679,203 +770,36 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 		return
 	}
 
-	// 第一次尝试使用原始模式请求
-	resp, err := client.Do(req)
-	if err != nil {
-		logger.Log.WithFields(logrus.Fields{
-			"error": err.Error(),
-			"mode":  augmentReq.Mode,
-		}).Error("请求失败")
-
-		// 切换到CHAT模式
-		augmentReq.Mode = "CHAT"
-		augmentReq.UserGuideLines = "使用中文回答"
-		augmentReq.ToolDefinitions = []ToolDefinition{}
-
-		// 重新准备请求数据
-		jsonData, err = json.Marshal(augmentReq)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "序列化请求失败"})
-			return
-		}
-
-		// 创建新的请求
-		req, err = http.NewRequest("POST", requestURL, bytes.NewReader(jsonData))
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "创建请求失败"})
-			return
-		}
-
-		// 设置相同的请求头
-		req.Header.Set("Host", hostName)
-		req.Header.Set("Content-Length", fmt.Sprintf("%d", len(jsonData)))
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", "Bearer "+token)
-		req.Header.Set("User-Agent", "augment.intellij/0.184.0 (Mac OS X; aarch64; 15.2) WebStorm/2024.3.5")
-		req.Header.Set("x-api-version", "2")
-		req.Header.Set("x-request-id", requestID)
-		req.Header.Set("x-request-session-id", sessionID)
-
-		// 重新发送请求
-		resp, err = client.Do(req)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "请求失败: " + err.Error()})
-			return
-		}
-	}
-	defer resp.Body.Close()
-
-	// 检查响应状态码
-	if resp.StatusCode != http.StatusOK {
-		body, err := io.ReadAll(resp.Body)
-		errMsg := "Augment response error"
-		if err == nil {
-			bodyStr := string(body)
-			// 检查是否是HTML错误页面（Hugging Face的500错误页面）
-			if strings.Contains(bodyStr, "<html>") || strings.Contains(bodyStr, "<!DOCTYPE") {
-				errMsg = "Service temporarily unavailable (500 Internal Server Error)"
-				logger.Log.WithFields(logrus.Fields{
-					"status_code": resp.StatusCode,
-					"response_preview": bodyStr[:min(200, len(bodyStr))],
-				}).Error("收到HTML错误页面，可能是Hugging Face平台问题")
-			} else {
-				errMsg = errMsg + ": " + bodyStr
-			}
-		}
-		c.JSON(resp.StatusCode, gin.H{"error": errMsg})
-		return
-	}
-
-	// 异步记录会话事件
-	asyncRecordSessionEvent(token, tenant, requestID, sessionID)
-
-	// 读取并转发响应
-	reader := bufio.NewReader(resp.Body)
 	responseID := fmt.Sprintf("chatcmpl-%d", time.Now().Unix())
 
 	var fullText string
-	var hasError bool
-
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			logger.Log.WithFields(logrus.Fields{
-				"error": err.Error(),
-				"mode":  augmentReq.Mode,
-			}).Error("读取响应失败")
-
-			// 切换到CHAT模式
-			if augmentReq.Mode != "CHAT" {
-				logger.Log.WithFields(logrus.Fields{
-					"error": err.Error(),
-					"mode":  augmentReq.Mode,
-				}).Info("切换到CHAT模式")
-
-				augmentReq.Mode = "CHAT"
-				augmentReq.UserGuideLines = "使用中文回答"
-				augmentReq.ToolDefinitions = []ToolDefinition{}
-
-				// 重新准备请求数据
-				jsonData, err = json.Marshal(augmentReq)
-				if err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "序列化请求失败"})
-					return
-				}
-
-				// 创建新的请求
-				req, err = http.NewRequest("POST", requestURL, bytes.NewReader(jsonData))
-				if err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "创建请求失败"})
-					return
-				}
-
-				// 设置相同的请求头
-				req.Header.Set("Host", hostName)
-				req.Header.Set("Content-Length", fmt.Sprintf("%d", len(jsonData)))
-				req.Header.Set("Content-Type", "application/json")
-				req.Header.Set("Authorization", "Bearer "+token)
-				req.Header.Set("User-Agent", "augment.intellij/0.184.0 (Mac OS X; aarch64; 15.2) WebStorm/2024.3.5")
-				req.Header.Set("x-api-version", "2")
-				req.Header.Set("x-request-id", requestID)
-				req.Header.Set("x-request-session-id", sessionID)
-
-				// 重新发送请求
-				resp, err = client.Do(req)
-				if err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "请求失败: " + err.Error()})
-					return
-				}
-				defer resp.Body.Close()
-
-				// 检查响应状态码
-				if resp.StatusCode != http.StatusOK {
-					body, err := io.ReadAll(resp.Body)
-					errMsg := "Augment response error"
-					if err == nil {
-						bodyStr := string(body)
-						// 检查是否是HTML错误页面（Hugging Face的500错误页面）
-						if strings.Contains(bodyStr, "<html>") || strings.Contains(bodyStr, "<!DOCTYPE") {
-							errMsg = "Service temporarily unavailable (500 Internal Server Error)"
-							logger.Log.WithFields(logrus.Fields{
-								"status_code": resp.StatusCode,
-								"response_preview": bodyStr[:min(200, len(bodyStr))],
-							}).Error("收到HTML错误页面，可能是Hugging Face平台问题")
-						} else {
-							errMsg = errMsg + ": " + bodyStr
-						}
-					}
-					c.JSON(resp.StatusCode, gin.H{"error": errMsg})
-					return
-				}
-
-				// 重新设置reader
-				reader = bufio.NewReader(resp.Body)
-				continue
-			}
-			break
-		}
+	started := false
+	toolCalls := newToolCallCollector()
+	setStreamKeepalive(c, func() { writeSSEPing(c, flusher) })
 
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-
-		var augmentResp AugmentResponse
-		if err := json.Unmarshal([]byte(line), &augmentResp); err != nil {
-			log.Printf("解析响应失败: %v", err)
-			continue
+	// 流结束后按最终输出记录用量
+	defer func() {
+		if fullText != "" || len(toolCalls.calls) > 0 {
+			asyncRecordTokenCounts(c, token, chatUsage(augmentReq, fullText))
 		}
+	}()
 
-		// 检查响应内容是否包含错误信息
-		if strings.Contains(augmentResp.Text, errBlocked) {
-			hasError = true
-
-			// 获取token的个性化请求间隔作为冷却时间
-			requestInterval := getTokenRequestInterval(token)
-			cooldownDuration := time.Duration(requestInterval) * time.Second
-
-			// 将当前token加入冷却队列，使用个性化冷却时间
-			logger.Log.WithFields(logrus.Fields{
-				"token": token,
-				"mode":  augmentReq.Mode,
-				"cooldown_seconds": requestInterval,
-			}).Info("检测到block信息，将token加入冷却队列")
-
-			err := SetTokenCoolStatus(token, cooldownDuration)
-			if err != nil {
-				logger.Log.WithFields(logrus.Fields{
-					"token": token,
-					"error": err.Error(),
-				}).Error("将token加入冷却队列失败")
-			}
-
-			break
+	token, upstreamErr := forwardWithContinuation(c, model, augmentReq, func(augmentResp AugmentResponse) bool {
+		if !started {
+			started = true
+			setSSEHeaders(c)
 		}
 
 		fullText += augmentResp.Text
+		newToolCalls := toolCalls.collect(augmentResp.Nodes)
+		reasoning, newNodes := nodes.collect(augmentResp.Nodes)
+
+		delta := streamDelta(augmentResp.Text, newToolCalls)
+		delta.ReasoningContent = reasoning
+		delta.AugmentNodes = newNodes
+		if augmentResp.Text == "" && reasoning != "" {
+			delta.Content = nil
+		}
 
 		// 创建OpenAI兼容的流式响应
 		streamResp := OpenAIStreamResponse{
@@ -885,11 +809,8 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 			Model:   model,
 			Choices: []StreamChoice{
 				{
-					Index: 0,
-					Delta: ChatMessage{
-						Role:    "assistant",
-						Content: augmentResp.Text,
-					},
+					Index:        0,
+					Delta:        delta,
 					FinishReason: nil,
 				},
 			},
@@ -897,7 +818,7 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 
 		// 如果是最后一条消息，设置完成原因
 		if augmentResp.Done {
-			finishReason := "stop"
+			finishReason := chatFinishReason(toolCalls, augmentResp.StopReason)
 			streamResp.Choices[0].FinishReason = &finishReason
 		}
 
@@ -905,182 +826,60 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 		jsonResp, err := json.Marshal(streamResp)
 		if err != nil {
 			log.Printf("序列化响应失败: %v", err)
-			continue
+			return true
 		}
 
 		fmt.Fprintf(c.Writer, "data: %s\n\n", jsonResp)
 		flusher.Flush()
 
-		// 如果完成，发送最后的[DONE]标记
+		// 如果完成，发送用量和最后的[DONE]标记
 		if augmentResp.Done {
-			fmt.Fprintf(c.Writer, "data: [DONE]\n\n")
-			flusher.Flush()
-			break
-		}
-	}
-
-	// 如果检测到错误信息，尝试切换到CHAT模式重新请求
-	if hasError && augmentReq.Mode != "CHAT" {
-		logger.Log.WithFields(logrus.Fields{
-			"mode": augmentReq.Mode,
-		}).Info("检测到block信息，尝试切换到 CHAT 模式回复！")
-
-		// 切换到CHAT模式
-		augmentReq.Mode = "CHAT"
-		augmentReq.UserGuideLines = "使用中文回答"
-		augmentReq.ToolDefinitions = []ToolDefinition{}
-
-		// 重新准备请求数据
-		jsonData, err = json.Marshal(augmentReq)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "序列化请求失败"})
-			return
-		}
-
-		// 创建新的请求
-		req, err = http.NewRequest("POST", requestURL, bytes.NewReader(jsonData))
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "创建请求失败"})
-			return
-		}
-
-		// 设置相同的请求头
-		req.Header.Set("Host", hostName)
-		req.Header.Set("Content-Length", fmt.Sprintf("%d", len(jsonData)))
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", "Bearer "+token)
-		req.Header.Set("User-Agent", "augment.intellij/0.184.0 (Mac OS X; aarch64; 15.2) WebStorm/2024.3.5")
-		req.Header.Set("x-api-version", "2")
-		req.Header.Set("x-request-id", requestID)
-		req.Header.Set("x-request-session-id", sessionID)
-
-		// 重新发送请求
-		resp, err = client.Do(req)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "请求失败: " + err.Error()})
-			return
-		}
-		defer resp.Body.Close()
-
-		// 检查响应状态码
-		if resp.StatusCode != http.StatusOK {
-			body, err := io.ReadAll(resp.Body)
-			errMsg := "Augment response error"
-			if err == nil {
-				bodyStr := string(body)
-				// 检查是否是HTML错误页面（Hugging Face的500错误页面）
-				if strings.Contains(bodyStr, "<html>") || strings.Contains(bodyStr, "<!DOCTYPE") {
-					errMsg = "Service temporarily unavailable (500 Internal Server Error)"
-					logger.Log.WithFields(logrus.Fields{
-						"status_code": resp.StatusCode,
-						"response_preview": bodyStr[:min(200, len(bodyStr))],
-					}).Error("收到HTML错误页面，可能是Hugging Face平台问题")
-				} else {
-					errMsg = errMsg + ": " + bodyStr
-				}
+			var usage *Usage
+			if includeUsage {
+				u := chatUsage(augmentReq, fullText)
+				usage = &u
 			}
-			c.JSON(resp.StatusCode, gin.H{"error": errMsg})
-			return
+			writeStreamDone(c, flusher, responseID, model, usage)
 		}
+		return true
+	})
 
-		// 异步记录会话事件
-		asyncRecordSessionEvent(token, tenant, requestID, sessionID)
-
-		// 读取并转发响应
-		reader = bufio.NewReader(resp.Body)
-		responseID = fmt.Sprintf("chatcmpl-%d", time.Now().Unix())
-
-		fullText = ""
-		for {
-			line, err := reader.ReadString('\n')
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				log.Printf("读取响应失败: %v", err)
-				break
-			}
-
-			line = strings.TrimSpace(line)
-			if line == "" {
-				continue
-			}
-
-			var augmentResp AugmentResponse
-			if err := json.Unmarshal([]byte(line), &augmentResp); err != nil {
-				log.Printf("解析响应失败: %v", err)
-				continue
-			}
-
-			fullText += augmentResp.Text
-
-			// 创建OpenAI兼容的流式响应
-			streamResp := OpenAIStreamResponse{
-				ID:      responseID,
-				Object:  "chat.completion.chunk",
-				Created: time.Now().Unix(),
-				Model:   model,
-				Choices: []StreamChoice{
-					{
-						Index: 0,
-						Delta: ChatMessage{
-							Role:    "assistant",
-							Content: augmentResp.Text,
-						},
-						FinishReason: nil,
-					},
-				},
-			}
-
-			// 如果是最后一条消息，设置完成原因
-			if augmentResp.Done {
-				finishReason := "stop"
-				streamResp.Choices[0].FinishReason = &finishReason
-			}
-
-			// 序列化并发送响应
-			jsonResp, err := json.Marshal(streamResp)
-			if err != nil {
-				log.Printf("序列化响应失败: %v", err)
-				continue
-			}
-
-			fmt.Fprintf(c.Writer, "data: %s\n\n", jsonResp)
-			flusher.Flush()
-
-			// 如果完成，发送最后的[DONE]标记
-			if augmentResp.Done {
-				fmt.Fprintf(c.Writer, "data: [DONE]\n\n")
-				flusher.Flush()
-				break
-			}
-		}
+	if upstreamErr == nil {
+		saveConversationReply(c, ChatMessage{Role: "assistant", Content: fullText, ToolCalls: toolCalls.messageToolCalls()})
+		return
+	}
+	if upstreamErr.Kind == upstreamCancelled {
+		handleClientCancel(c, token)
+		return
+	}
+	// 已开始输出时以错误块结束，不发送finish_reason和[DONE]，客户端据此判断回复不完整
+	writeStreamError(c, upstreamErr.StatusCode, upstreamErr.Message)
+	flusher.Flush()
+	if started {
+		logger.Log.WithFields(logrus.Fields{
+			"error": upstreamErr.Message,
+			"model": model,
+		}).Error("流式响应中断")
 	}
 }
 
-// estimateTokenCount 粗略估计文本中的token数量
-// 这是一个简单的估算方法，实际token数量取决于具体的分词算法
+// estimateTokenCount 使用系统配置的分词器计算文本中的token数量，默认使用内嵌的BPE词表
 func estimateTokenCount(text string) int {
-	// 英文单词和标点符号大约是1个token
-	// 中文字符大约是1.5个token（每个字符约为0.75个token）
-	// 按空格分割英文单词
-	words := strings.Fields(text)
-	wordCount := len(words)
-
-	// 计算中文字符数量
-	chineseCount := 0
-	for _, r := range text {
-		if r >= 0x4E00 && r <= 0x9FFF {
-			chineseCount++
-		}
-	}
+	return tokenizer.Get(config.AppConfig.Tokenizer).Count(text)
+}
 
-	// 粗略估计：英文单词按1个token计算，中文字符按0.75个token计算
-	return wordCount + int(float64(chineseCount)*0.75)
+// estimatePromptTokens 估算Augment请求（当前消息和历史记录）的token数量
+func estimatePromptTokens(augmentReq AugmentRequest) int {
+	promptTokens := estimateTokenCount(augmentReq.Message)
+	for _, history := range augmentReq.ChatHistory {
+		promptTokens += estimateTokenCount(history.RequestMessage)
+		promptTokens += estimateTokenCount(history.ResponseText)
+	}
+	return promptTokens
 }
 
 // 处理非流式请求
-func handleNonStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string) {
+func handleNonStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string, nodes *nodeCollector) {
 	defer func() {
 		if r := recover(); r != nil {
 			logger.Log.WithFields(logrus.Fields{
@@ -1092,162 +891,50 @@ func handleNonStreamRequest(c *gin.Context, augmentReq AugmentRequest, model str
 		cleanupRequestStatus(c) // 确保在函数返回时同步清理请求状态
 	}()
 
-	// 从上下文中获取token和tenant_url
-	tokenInterface, exists := c.Get("token")
-	tenantURLInterface, exists2 := c.Get("tenant_url")
-
-	var token, tenant string
-
-	if exists && exists2 {
-		token, _ = tokenInterface.(string)
-		tenant, _ = tenantURLInterface.(string)
-	}
-
-	// 如果上下文中没有，则使用GetAuthInfo获取
-	if token == "" || tenant == "" {
-		token, tenant = GetAuthInfo()
-	}
-
-	if token == "" || tenant == "" {
+	// 从上下文中获取token和tenant_url，命中响应缓存时不使用token
+	cacheHit := ResponseCacheHit(c)
+	token, tenant := getRequestToken(c)
+	if !cacheHit && (token == "" || tenant == "") {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "无可用Token,请先在管理页面获取"})
 		return
 	}
 
 	// 异步处理token使用计数
-	asyncIncrementTokenUsage(token, model)
-
-	// 准备请求数据
-	jsonData, err := json.Marshal(augmentReq)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "序列化请求失败"})
-		return
-	}
-
-	// 提取主机部分
-	parsedURL, err := url.Parse(tenant)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "解析租户URL失败"})
-		return
+	if !cacheHit {
+		asyncIncrementTokenUsage(c, token, model)
 	}
-	hostName := parsedURL.Host
-
-	// 创建请求
-	requestURL := tenant + "chat-stream"
-	req, err := http.NewRequest("POST", requestURL, bytes.NewReader(jsonData))
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建请求失败"})
-		return
-	}
-
-	// 设置请求头
-	req.Header.Set("Host", hostName)
-	req.Header.Set("Content-Length", fmt.Sprintf("%d", len(jsonData)))
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("User-Agent", "augment.intellij/0.184.0 (Mac OS X; aarch64; 15.2) WebStorm/2024.3.5")
-	req.Header.Set("x-api-version", "2")
-
-	// 生成请求ID和会话ID
-	requestID := uuid.New().String()
-	sessionID := uuid.New().String()
-	req.Header.Set("x-request-id", requestID)
-	req.Header.Set("x-request-session-id", sessionID)
-
-	client := createHTTPClient()
-	resp, err := client.Do(req)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "请求失败: " + err.Error()})
-		return
-	}
-	defer resp.Body.Close()
-
-	// 检查响应状态码
-	if resp.StatusCode != http.StatusOK {
-		body, err := io.ReadAll(resp.Body)
-		errMsg := "Augment response error"
-		if err == nil {
-			bodyStr := string(body)
-			// 检查是否是HTML错误页面（Hugging Face的500错误页面）
-			if strings.Contains(bodyStr, "<html>") || strings.Contains(bodyStr, "<!DOCTYPE") {
-				errMsg = "Service temporarily unavailable (500 Internal Server Error)"
-				logger.Log.WithFields(logrus.Fields{
-					"status_code": resp.StatusCode,
-					"response_preview": bodyStr[:min(200, len(bodyStr))],
-				}).Error("收到HTML错误页面，可能是Hugging Face平台问题")
-			} else {
-				errMsg = errMsg + ": " + bodyStr
-			}
-		}
-		c.JSON(resp.StatusCode, gin.H{"error": errMsg})
-		return
-	}
-
-	// 异步记录会话事件
-	asyncRecordSessionEvent(token, tenant, requestID, sessionID)
 
 	// 读取完整响应
-	reader := bufio.NewReader(resp.Body)
 	var fullText string
+	var stopReason interface{}
+	toolCalls := newToolCallCollector()
 
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "读取响应失败: " + err.Error()})
-			return
-		}
-
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-
-		var augmentResp AugmentResponse
-		if err := json.Unmarshal([]byte(line), &augmentResp); err != nil {
-			continue
-		}
-
+	token, upstreamErr := forwardWithContinuation(c, model, augmentReq, func(augmentResp AugmentResponse) bool {
 		fullText += augmentResp.Text
-
-		// 检查响应内容是否包含错误信息
-		if strings.Contains(augmentResp.Text, errBlocked) {
-			// 获取token的个性化请求间隔作为冷却时间
-			requestInterval := getTokenRequestInterval(token)
-			cooldownDuration := time.Duration(requestInterval) * time.Second
-
-			// 将当前token加入冷却队列，使用个性化冷却时间
-			logger.Log.WithFields(logrus.Fields{
-				"token": token,
-				"mode":  augmentReq.Mode,
-				"cooldown_seconds": requestInterval,
-			}).Info("检测到block信息，将token加入冷却队列")
-
-			err := SetTokenCoolStatus(token, cooldownDuration)
-			if err != nil {
-				logger.Log.WithFields(logrus.Fields{
-					"token": token,
-					"error": err.Error(),
-				}).Error("将token加入冷却队列失败")
-			}
-		}
-
-		if augmentResp.Done {
-			break
+		if augmentResp.StopReason != nil {
+			stopReason = augmentResp.StopReason
 		}
+		toolCalls.collect(augmentResp.Nodes)
+		nodes.collect(augmentResp.Nodes)
+		return true
+	})
+	if upstreamErr != nil && upstreamErr.Kind == upstreamCancelled {
+		handleClientCancel(c, token)
+		return
+	}
+	if upstreamErr != nil {
+		c.JSON(upstreamErr.StatusCode, gin.H{"error": upstreamErr.Message})
+		return
 	}
 
+	saveConversationReply(c, ChatMessage{Role: "assistant", Content: fullText, ToolCalls: toolCalls.messageToolCalls()})
+
 	// 创建OpenAI兼容的响应
-	finishReason := "stop"
+	finishReason := chatFinishReason(toolCalls, stopReason)
 
-	// 估算token数量
-	promptTokens := estimateTokenCount(augmentReq.Message)
-	for _, history := range augmentReq.ChatHistory {
-		promptTokens += estimateTokenCount(history.RequestMessage)
-		promptTokens += estimateTokenCount(history.ResponseText)
-	}
-	completionTokens := estimateTokenCount(fullText)
+	// 估算token数量并记录用量
+	usage := chatUsage(augmentReq, fullText)
+	asyncRecordTokenCounts(c, token, usage)
 
 	openAIResp := OpenAIResponse{
 		ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
@@ -1258,17 +945,17 @@ func handleNonStreamRequest(c *gin.Context, augmentReq AugmentRequest, model str
 			{
 				Index: 0,
 				Message: ChatMessage{
-					Role:    "assistant",
-					Content: fullText,
+					Role:      "assistant",
+					Content:   fullText,
+					ToolCalls: toolCalls.messageToolCalls(),
+
+					ReasoningContent: nodes.reasoningText.String(),
+					AugmentNodes:     nodes.nodes,
 				},
 				FinishReason: &finishReason,
 			},
 		},
-		Usage: Usage{
-			PromptTokens:     promptTokens,
-			CompletionTokens: completionTokens,
-			TotalTokens:      promptTokens + completionTokens,
-		},
+		Usage: usage,
 	}
 
 	c.JSON(http.StatusOK, openAIResp)
@@ -1305,176 +992,96 @@ func cleanupRequestStatus(c *gin.Context) {
 		return
 	}
 
-	// 更新请求状态为已完成
-	err := SetTokenRequestStatus(token, TokenRequestStatus{
-		InProgress:    false,
-		LastRequestAt: time.Now(),
-	})
-
-	// 无论更新状态是否成功，都要释放锁
-	defer lock.Unlock()
+	// 客户端断开或切换token时会提前清理，清除锁引用避免重复释放
+	c.Set("token_lock", nil)
 
-	if err != nil {
+	// 更新请求状态为已完成，无论更新状态是否成功，都要释放锁
+	if err := ReleaseTokenLease(token, lock); err != nil {
 		logger.Log.WithFields(logrus.Fields{
 			"error": err.Error(),
 		}).Error("清理请求状态失败")
-		return
 	}
 }
 
-// 创建 HTTP 客户端，如果配置了代理则使用
-func createHTTPClient() *http.Client {
-	// 创建自定义Transport，强制使用HTTP/1.1
-	transport := &http.Transport{
-		ForceAttemptHTTP2:     false, // 禁用HTTP/2
-		MaxIdleConns:          100,
-		MaxIdleConnsPerHost:   10,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		DisableKeepAlives:     false,
-		DisableCompression:    false,
+// getRequestToken 从上下文中获取本次请求使用的token和tenant_url，没有则使用GetAuthInfo获取
+func getRequestToken(c *gin.Context) (string, string) {
+	var token, tenant string
+	if tokenInterface, exists := c.Get("token"); exists {
+		token, _ = tokenInterface.(string)
 	}
-
-	// 检查是否配置了代理
-	if config.AppConfig.ProxyURL != "" {
-		proxyURL, err := url.Parse(config.AppConfig.ProxyURL)
-		if err == nil {
-			transport.Proxy = http.ProxyURL(proxyURL)
-			log.Printf("使用代理: %s", config.AppConfig.ProxyURL)
-		} else {
-			log.Printf("代理URL格式错误: %v", err)
-		}
+	if tenantURLInterface, exists := c.Get("tenant_url"); exists {
+		tenant, _ = tenantURLInterface.(string)
 	}
 
-	client := &http.Client{
-		Transport: transport,
-		Timeout:   60 * time.Second, // 设置总超时时间
+	if token == "" || tenant == "" {
+		token, tenant = GetAuthInfo()
 	}
-
-	return client
+	return token, tenant
 }
 
-// 异步记录用户会话事件
-func asyncRecordSessionEvent(token, tenantURL, requestID, sessionID string) {
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				logger.Log.WithFields(logrus.Fields{
-					"error":      r,
-					"token":      token,
-					"tenant_url": tenantURL,
-				}).Error("记录会话事件时发生panic")
-			}
-		}()
+// coolDownToken 检测到block信息后，以token的个性化请求间隔作为冷却时间将其加入冷却队列
+func coolDownToken(token, mode string) {
+	requestInterval := getTokenRequestInterval(token)
+	cooldownDuration := time.Duration(requestInterval) * time.Second
 
-		// 提取主机部分
-		parsedURL, err := url.Parse(tenantURL)
-		if err != nil {
-			logger.Log.WithFields(logrus.Fields{
-				"error":      err.Error(),
-				"tenant_url": tenantURL,
-			}).Error("解析租户URL失败")
-			return
-		}
-		hostName := parsedURL.Host
-
-		// 构建事件数据
-		currentTime := time.Now()
-		eventData := map[string]interface{}{
-			"events": []map[string]interface{}{
-				{
-					"event_name":      "used-chat",
-					"event_time_sec":  currentTime.Unix(),
-					"event_time_nsec": currentTime.UnixNano() % 1000000000,
-				},
-			},
-		}
-
-		// 序列化请求数据
-		jsonData, err := json.Marshal(eventData)
-		if err != nil {
-			logger.Log.WithFields(logrus.Fields{
-				"error": err.Error(),
-			}).Error("序列化事件数据失败")
-			return
-		}
-
-		// 构建请求URL
-		requestURL := tenantURL + "record-onboarding-session-event"
+	logger.Log.WithFields(logrus.Fields{
+		"token":            token,
+		"mode":             mode,
+		"cooldown_seconds": requestInterval,
+	}).Info("检测到block信息，将token加入冷却队列")
 
-		// 创建请求
-		req, err := http.NewRequest("POST", requestURL, bytes.NewReader(jsonData))
-		if err != nil {
-			logger.Log.WithFields(logrus.Fields{
-				"error": err.Error(),
-			}).Error("创建记录事件请求失败")
-			return
-		}
+	err := SetTokenCoolStatus(token, cooldownDuration)
+	if err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"token": token,
+			"error": err.Error(),
+		}).Error("将token加入冷却队列失败")
+	}
+}
 
-		// 设置请求头
-		req.Header.Set("Host", hostName)
-		req.Header.Set("Content-Length", fmt.Sprintf("%d", len(jsonData)))
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", "Bearer "+token)
-		req.Header.Set("User-Agent", "augment.intellij/0.184.0 (Mac OS X; aarch64; 15.2) WebStorm/2024.3.5")
-		req.Header.Set("x-api-version", "2")
-		req.Header.Set("x-request-id", requestID)
-		req.Header.Set("x-request-session-id", sessionID)
-		req.Header.Set("Accept-Charset", "UTF-8")
-
-		// 发送请求
-		client := createHTTPClient()
-		resp, err := client.Do(req)
-		if err != nil {
-			logger.Log.WithFields(logrus.Fields{
-				"error": err.Error(),
-			}).Error("发送记录事件请求失败")
-			return
-		}
-		defer resp.Body.Close()
+// fallbackToChatMode 切换到CHAT模式，使用模板中的回退指南并去掉工具定义后重新请求
+func fallbackToChatMode(augmentReq *AugmentRequest) {
+	augmentReq.Mode = "CHAT"
+	augmentReq.UserGuideLines = augmentReq.fallbackGuideLines
+	if augmentReq.UserGuideLines == "" {
+		augmentReq.UserGuideLines = builtinPromptTemplate().FallbackGuidelines
+	}
+	augmentReq.ToolDefinitions = []ToolDefinition{}
+}
 
-		// 记录响应状态
-		logger.Log.WithFields(logrus.Fields{
-			"status_code": resp.StatusCode,
-			"tenant_url":  tenantURL,
-		}).Info("记录会话事件完成")
-	}()
+// 创建访问target（租户或CF Worker地址）的HTTP客户端，复用当前代理配置下该路线的共享连接池
+func createHTTPClient(target string) *http.Client {
+	// 不设置总超时时间，避免长时间生成的回复被中途截断；
+	// 连接阶段由连接超时限制，等待首个响应和响应间隔由AugmentClient按配置检测
+	return &http.Client{
+		Transport: upstreamTransport(target),
+	}
 }
 
 // 在处理聊天请求时增加token使用计数
-func incrementTokenUsage(token string, model string) {
-	// 先将模型名称转换为小写
-	modelLower := strings.ToLower(model)
-
-	// 根据模型类型确定计数键 (不区分大小写)
-	var countKey string
-	if strings.HasSuffix(modelLower, "-chat") {
-		countKey = "token_usage_chat:" + token
-	} else if strings.HasSuffix(modelLower, "-agent") {
+func incrementTokenUsage(token string, mode string) {
+	// 根据模型注册表中的模式确定计数键
+	countKey := "token_usage_chat:" + token
+	if mode == "AGENT" {
 		countKey = "token_usage_agent:" + token
-	} else {
-		countKey = "token_usage:" + token // 默认键
-		// 非特定结尾的模型，增加chat计数
-		err := config.RedisIncr("token_usage_chat:" + token)
-		if err != nil {
-			logger.Log.Error("增加token chat使用计数失败: %v", err)
-		}
 	}
 
 	// 使用Redis的INCR命令增加计数
 	err := config.RedisIncr(countKey)
 	if err != nil {
-		logger.Log.Error("增加token使用计数失败: %v", err)
+		logger.Log.WithFields(logrus.Fields{
+			"token": token,
+			"error": err.Error(),
+		}).Error("增加token使用计数失败")
 	}
 
 	// 同时增加总使用计数
-	totalCountKey := "token_usage:" + token
-	if countKey != totalCountKey { // 避免重复计数
-		err = config.RedisIncr(totalCountKey)
-		if err != nil {
-			logger.Log.Error("增加token总使用计数失败: %v", err)
-		}
+	err = config.RedisIncr("token_usage:" + token)
+	if err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"token": token,
+			"error": err.Error(),
+		}).Error("增加token总使用计数失败")
 	}
 }
 
@@ -0,0 +1,212 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// 请求节点类型：图片
+	requestNodeTypeImage = 2
+
+	// 单张图片允许的最大字节数
+	maxImageBytes = 5 << 20
+
+	// 下载单张图片的总超时时间
+	imageDownloadTimeout = 30 * time.Second
+)
+
+// 图片格式，与Augment chat-stream接口的图片格式枚举对应
+const (
+	imageFormatPNG  = 1
+	imageFormatJPEG = 2
+	imageFormatGIF  = 3
+	imageFormatWEBP = 4
+)
+
+// ImageNode 请求中的图片节点
+type ImageNode struct {
+	ImageData string `json:"image_data"` // base64编码的图片数据
+	Format    int    `json:"format"`
+}
+
+// imageHTTPClient 下载图片使用的客户端，图片地址由客户端提供，不经过上游代理，
+// 且只允许连接公网地址，避免通过图片地址访问服务所在的内网
+var imageHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: rejectInternalAddress,
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// rejectInternalAddress 在建立连接前检查实际连接的IP，域名解析到内网地址（包括重定向后的地址）时拒绝连接
+func rejectInternalAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("无效的地址: %s", address)
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() {
+		return fmt.Errorf("不允许访问内网地址: %s", ip)
+	}
+	return nil
+}
+
+// invalidContentError 客户端传入的消息内容无法转换，应返回400
+type invalidContentError struct {
+	message string
+}
+
+func (e *invalidContentError) Error() string {
+	return e.message
+}
+
+func newInvalidContentError(format string, args ...interface{}) error {
+	return &invalidContentError{message: fmt.Sprintf(format, args...)}
+}
+
+// messageImageNodes 校验消息中的内容块，将image_url内容块转换为图片请求节点
+// 不支持的内容块类型返回invalidContentError，而不是静默丢弃
+func messageImageNodes(ctx context.Context, msg ChatMessage, startID int) ([]Node, error) {
+	parts, ok := msg.Content.([]interface{})
+	if !ok {
+		return nil, nil
+	}
+
+	var nodes []Node
+	for _, item := range parts {
+		part, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, newInvalidContentError("无效的消息内容块")
+		}
+
+		partType, _ := part["type"].(string)
+		switch partType {
+		case "text", "input_text":
+			continue
+		case "image_url":
+			imageURL := ""
+			switch v := part["image_url"].(type) {
+			case string:
+				imageURL = v
+			case map[string]interface{}:
+				imageURL, _ = v["url"].(string)
+			}
+			if imageURL == "" {
+				return nil, newInvalidContentError("image_url内容块缺少url")
+			}
+
+			node, err := imageNode(ctx, imageURL, startID+len(nodes))
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, node)
+		default:
+			return nil, newInvalidContentError("不支持的内容类型: %s", partType)
+		}
+	}
+
+	return nodes, nil
+}
+
+// imageNode 读取图片并构造图片请求节点
+func imageNode(ctx context.Context, imageURL string, id int) (Node, error) {
+	data, err := loadImage(ctx, imageURL)
+	if err != nil {
+		return Node{}, err
+	}
+	if len(data) > maxImageBytes {
+		return Node{}, newInvalidContentError("图片大小超过限制: %d字节，最大%d字节", len(data), maxImageBytes)
+	}
+
+	format, err := detectImageFormat(data)
+	if err != nil {
+		return Node{}, err
+	}
+
+	return Node{
+		ID:   id,
+		Type: requestNodeTypeImage,
+		ImageNode: &ImageNode{
+			ImageData: base64.StdEncoding.EncodeToString(data),
+			Format:    format,
+		},
+	}, nil
+}
+
+// loadImage 解析data URL或下载http(s)图片，客户端断开时停止下载
+func loadImage(ctx context.Context, imageURL string) ([]byte, error) {
+	if strings.HasPrefix(imageURL, "data:") {
+		header, payload, found := strings.Cut(imageURL, ",")
+		if !found || !strings.HasSuffix(header, ";base64") {
+			return nil, newInvalidContentError("仅支持base64编码的data URL图片")
+		}
+		if base64.StdEncoding.DecodedLen(len(payload)) > maxImageBytes+3 {
+			return nil, newInvalidContentError("图片大小超过限制，最大%d字节", maxImageBytes)
+		}
+		data, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			return nil, newInvalidContentError("图片base64解码失败: %v", err)
+		}
+		return data, nil
+	}
+
+	if !strings.HasPrefix(imageURL, "http://") && !strings.HasPrefix(imageURL, "https://") {
+		return nil, newInvalidContentError("不支持的图片地址: 仅支持data URL和http(s)地址")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, imageDownloadTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", imageURL, nil)
+	if err != nil {
+		return nil, newInvalidContentError("不支持的图片地址: %v", err)
+	}
+	resp, err := imageHTTPClient.Do(req)
+	if err != nil {
+		return nil, newInvalidContentError("下载图片失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newInvalidContentError("下载图片失败，状态码: %d", resp.StatusCode)
+	}
+
+	// 多读一个字节用于判断是否超出大小限制
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImageBytes+1))
+	if err != nil {
+		return nil, newInvalidContentError("读取图片失败: %v", err)
+	}
+	return data, nil
+}
+
+// detectImageFormat 根据文件内容判断图片格式
+func detectImageFormat(data []byte) (int, error) {
+	switch http.DetectContentType(data) {
+	case "image/png":
+		return imageFormatPNG, nil
+	case "image/jpeg":
+		return imageFormatJPEG, nil
+	case "image/gif":
+		return imageFormatGIF, nil
+	case "image/webp":
+		return imageFormatWEBP, nil
+	default:
+		return 0, newInvalidContentError("不支持的图片格式，仅支持PNG、JPEG、GIF和WEBP")
+	}
+}
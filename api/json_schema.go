@@ -0,0 +1,349 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// schemaValidator 按JSON Schema的常用子集校验json.Unmarshal解码后的数据
+// 支持type、enum、const、properties、required、additionalProperties、items、
+// 长度和数值范围、pattern、allOf/anyOf/oneOf以及指向本文档的$ref
+type schemaValidator struct {
+	root  map[string]interface{}
+	depth int
+}
+
+// 校验时schema的最大嵌套层数，防止未经checkSchemaRefs检查的循环$ref导致无限递归
+const maxSchemaDepth = 256
+
+// validateJSONSchema 校验数据是否符合schema，返回第一个不符合的位置和原因
+func validateJSONSchema(value interface{}, schema map[string]interface{}) error {
+	v := &schemaValidator{root: schema}
+	return v.validate(value, schema, "$")
+}
+
+func (v *schemaValidator) validate(value interface{}, schema map[string]interface{}, path string) error {
+	v.depth++
+	defer func() { v.depth-- }()
+	if v.depth > maxSchemaDepth {
+		return fmt.Errorf("%s: schema nesting exceeds %d levels", path, maxSchemaDepth)
+	}
+
+	if ref, ok := schema["$ref"].(string); ok {
+		resolved, err := v.resolveRef(ref)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if err := v.validate(value, resolved, path); err != nil {
+			return err
+		}
+	}
+
+	if err := v.validateCombinators(value, schema, path); err != nil {
+		return err
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		matched := false
+		for _, candidate := range enum {
+			if reflect.DeepEqual(value, candidate) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: value must be one of %s", path, compactJSON(enum))
+		}
+	}
+	if constant, ok := schema["const"]; ok && !reflect.DeepEqual(value, constant) {
+		return fmt.Errorf("%s: value must be %s", path, compactJSON(constant))
+	}
+
+	if types := schemaTypes(schema["type"]); len(types) > 0 {
+		actual := jsonType(value)
+		matched := false
+		for _, t := range types {
+			if t == actual || (t == "number" && actual == "integer") {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(types, " or "), actual)
+		}
+	}
+
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		return v.validateObject(typed, schema, path)
+	case []interface{}:
+		return v.validateArray(typed, schema, path)
+	case string:
+		return validateString(typed, schema, path)
+	case float64:
+		return validateNumber(typed, schema, path)
+	}
+	return nil
+}
+
+// validateCombinators 校验allOf、anyOf和oneOf
+func (v *schemaValidator) validateCombinators(value interface{}, schema map[string]interface{}, path string) error {
+	if allOf, ok := schema["allOf"].([]interface{}); ok {
+		for _, item := range allOf {
+			if sub, ok := item.(map[string]interface{}); ok {
+				if err := v.validate(value, sub, path); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, keyword := range []string{"anyOf", "oneOf"} {
+		options, ok := schema[keyword].([]interface{})
+		if !ok {
+			continue
+		}
+		matches := 0
+		var firstErr error
+		for _, item := range options {
+			sub, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if err := v.validate(value, sub, path); err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			matches++
+		}
+		if matches == 0 {
+			return fmt.Errorf("%s: value does not match any %s option (%v)", path, keyword, firstErr)
+		}
+		if keyword == "oneOf" && matches > 1 {
+			return fmt.Errorf("%s: value matches more than one oneOf option", path)
+		}
+	}
+	return nil
+}
+
+func (v *schemaValidator) validateObject(object map[string]interface{}, schema map[string]interface{}, path string) error {
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, item := range required {
+			name, _ := item.(string)
+			if _, exists := object[name]; name != "" && !exists {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]interface{})
+	for name, value := range object {
+		childPath := path + "." + name
+		if sub, ok := properties[name].(map[string]interface{}); ok {
+			if err := v.validate(value, sub, childPath); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				return fmt.Errorf("%s: additional property %q is not allowed", path, name)
+			}
+		case map[string]interface{}:
+			if err := v.validate(value, additional, childPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (v *schemaValidator) validateArray(array []interface{}, schema map[string]interface{}, path string) error {
+	if min, ok := schemaNumber(schema["minItems"]); ok && float64(len(array)) < min {
+		return fmt.Errorf("%s: expected at least %v items, got %d", path, min, len(array))
+	}
+	if max, ok := schemaNumber(schema["maxItems"]); ok && float64(len(array)) > max {
+		return fmt.Errorf("%s: expected at most %v items, got %d", path, max, len(array))
+	}
+
+	if items, ok := schema["items"].(map[string]interface{}); ok {
+		for i, item := range array {
+			if err := v.validate(item, items, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateString(s string, schema map[string]interface{}, path string) error {
+	length := float64(utf8.RuneCountInString(s))
+	if min, ok := schemaNumber(schema["minLength"]); ok && length < min {
+		return fmt.Errorf("%s: string shorter than %v characters", path, min)
+	}
+	if max, ok := schemaNumber(schema["maxLength"]); ok && length > max {
+		return fmt.Errorf("%s: string longer than %v characters", path, max)
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		// Go正则不支持的写法（如反向引用）跳过校验
+		if re, err := regexp.Compile(pattern); err == nil && !re.MatchString(s) {
+			return fmt.Errorf("%s: string does not match pattern %q", path, pattern)
+		}
+	}
+	return nil
+}
+
+func validateNumber(n float64, schema map[string]interface{}, path string) error {
+	if min, ok := schemaNumber(schema["minimum"]); ok && n < min {
+		return fmt.Errorf("%s: must be >= %v", path, min)
+	}
+	if max, ok := schemaNumber(schema["maximum"]); ok && n > max {
+		return fmt.Errorf("%s: must be <= %v", path, max)
+	}
+	if min, ok := schemaNumber(schema["exclusiveMinimum"]); ok && n <= min {
+		return fmt.Errorf("%s: must be > %v", path, min)
+	}
+	if max, ok := schemaNumber(schema["exclusiveMaximum"]); ok && n >= max {
+		return fmt.Errorf("%s: must be < %v", path, max)
+	}
+	return nil
+}
+
+// resolveRef 解析指向本文档的$ref，如#/$defs/item或#/definitions/item
+func (v *schemaValidator) resolveRef(ref string) (map[string]interface{}, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("unsupported $ref %q", ref)
+	}
+
+	var current interface{} = v.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#"), "/") {
+		if part == "" {
+			continue
+		}
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+		current = object[part]
+	}
+
+	resolved, ok := current.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unresolvable $ref %q", ref)
+	}
+	return resolved, nil
+}
+
+// checkSchemaRefs 检查schema中所有$ref都能解析，且不存在不经过properties或items就回到自身的循环引用，
+// 如{"$ref":"#"}或两个定义互相$ref。经过properties或items的递归引用（如树形结构）是允许的
+func checkSchemaRefs(schema map[string]interface{}) error {
+	v := &schemaValidator{root: schema}
+	return v.checkRefs(schema, map[string]bool{}, map[string]bool{})
+}
+
+// checkRefs 遍历schema，active为校验同一个值时已经经过的$ref，checked为已经检查过的$ref
+func (v *schemaValidator) checkRefs(schema map[string]interface{}, active, checked map[string]bool) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		if active[ref] {
+			return fmt.Errorf("cyclic $ref %q", ref)
+		}
+		if !checked[ref] {
+			checked[ref] = true
+			resolved, err := v.resolveRef(ref)
+			if err != nil {
+				return err
+			}
+			active[ref] = true
+			err = v.checkRefs(resolved, active, checked)
+			delete(active, ref)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// allOf/anyOf/oneOf校验的仍是同一个值
+	for _, keyword := range []string{"allOf", "anyOf", "oneOf"} {
+		options, _ := schema[keyword].([]interface{})
+		for _, item := range options {
+			if sub, ok := item.(map[string]interface{}); ok {
+				if err := v.checkRefs(sub, active, checked); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// properties、additionalProperties和items校验的是子节点，重新开始记录
+	var children []map[string]interface{}
+	properties, _ := schema["properties"].(map[string]interface{})
+	for _, item := range properties {
+		if sub, ok := item.(map[string]interface{}); ok {
+			children = append(children, sub)
+		}
+	}
+	for _, keyword := range []string{"additionalProperties", "items"} {
+		if sub, ok := schema[keyword].(map[string]interface{}); ok {
+			children = append(children, sub)
+		}
+	}
+	for _, sub := range children {
+		if err := v.checkRefs(sub, map[string]bool{}, checked); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaTypes 获取schema中的type，支持字符串和字符串数组
+func schemaTypes(value interface{}) []string {
+	switch t := value.(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		types := make([]string, 0, len(t))
+		for _, item := range t {
+			if s, ok := item.(string); ok {
+				types = append(types, s)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+// jsonType 返回解码后数据对应的JSON类型，整数返回integer
+func jsonType(value interface{}) string {
+	switch t := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if t == math.Trunc(t) && !math.IsInf(t, 0) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+func schemaNumber(value interface{}) (float64, bool) {
+	n, ok := value.(float64)
+	return n, ok
+}
@@ -0,0 +1,368 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Agent记忆键前缀，每个下游API Key一个哈希表（agent_memories:key:<API Key>），字段为记忆ID，值为Memory的JSON
+// 未使用API Key鉴权的请求共用defaultMemoryScope，API Key带有apiKeyMemoryScope前缀，两者不会冲突
+const (
+	agentMemoriesPrefix = "agent_memories:"
+	defaultMemoryScope  = "default"
+	apiKeyMemoryScope   = "key:"
+	// 记忆键迁移完成标记，旧版的记忆键为agent_memories:<API Key>
+	memoryScopeMigratedKey = "agent_memories_migrated"
+	// 记忆内容索引前缀，与记忆哈希表一一对应，字段为内容的SHA-256，值为记忆ID，用于并发添加时去重
+	agentMemoryIndexPrefix = "agent_memory_index:"
+
+	// Augment返回的记忆工具名称
+	rememberToolName = "remember"
+)
+
+// 记忆来源
+const (
+	memorySourceManual   = "manual"   // 通过接口添加
+	memorySourceTool     = "tool"     // 模型调用remember工具
+	memorySourceResponse = "response" // 响应中的AgentMemory节点
+)
+
+// Memory 保存的Agent记忆，AGENT模式请求时作为AgentMemories发送
+type Memory struct {
+	ID        string `json:"id"`
+	Content   string `json:"content"`
+	Source    string `json:"source"`
+	CreatedAt int64  `json:"created_at"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+// MemoryRequest 创建/更新记忆的请求结构
+type MemoryRequest struct {
+	Content string `json:"content" binding:"required"`
+}
+
+// memoryScope 返回API Key对应的记忆哈希表键
+func memoryScope(apiKey config.APIKey) string {
+	if apiKey.Key == "" {
+		return agentMemoriesPrefix + defaultMemoryScope
+	}
+	return agentMemoriesPrefix + apiKeyMemoryScope + apiKey.Key
+}
+
+// MigrateMemoryScopes 将旧版agent_memories:<API Key>的记忆及其内容索引迁移到新的键，只执行一次
+// 旧版中名为default的API Key与未鉴权请求共用记忆，无法区分，保留在未鉴权请求的记忆中
+func MigrateMemoryScopes() error {
+	if migrated, err := config.RedisExists(memoryScopeMigratedKey); err != nil || migrated {
+		return err
+	}
+
+	apiKeys, err := config.GetAllAPIKeys()
+	if err != nil {
+		return fmt.Errorf("获取API Key失败: %v", err)
+	}
+	for _, apiKey := range apiKeys {
+		if apiKey.Key == defaultMemoryScope {
+			continue
+		}
+		scope := memoryScope(apiKey)
+		for oldKey, newKey := range map[string]string{
+			agentMemoriesPrefix + apiKey.Key:    scope,
+			agentMemoryIndexPrefix + apiKey.Key: memoryIndexKey(scope),
+		} {
+			exists, err := config.RedisExists(oldKey)
+			if err != nil {
+				return fmt.Errorf("检查记忆键失败: %v", err)
+			}
+			if !exists {
+				continue
+			}
+			if err := config.RedisRename(oldKey, newKey); err != nil {
+				return fmt.Errorf("迁移记忆键失败: %v", err)
+			}
+		}
+	}
+	return config.RedisSet(memoryScopeMigratedKey, "1", 0) // 永不过期
+}
+
+// getMemories 获取记忆列表，按创建时间排序
+func getMemories(scope string) ([]Memory, error) {
+	values, err := config.RedisHGetAll(scope)
+	if err != nil {
+		return nil, err
+	}
+
+	memories := make([]Memory, 0, len(values))
+	for _, value := range values {
+		var memory Memory
+		if err := json.Unmarshal([]byte(value), &memory); err != nil {
+			continue
+		}
+		memories = append(memories, memory)
+	}
+
+	sort.Slice(memories, func(i, j int) bool {
+		return memories[i].CreatedAt < memories[j].CreatedAt
+	})
+	return memories, nil
+}
+
+// memoryIndexKey 返回记忆哈希表对应的内容索引键
+func memoryIndexKey(scope string) string {
+	return agentMemoryIndexPrefix + strings.TrimPrefix(scope, agentMemoriesPrefix)
+}
+
+// memoryContentHash 计算记忆内容的索引字段
+func memoryContentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// getMemory 根据ID获取记忆
+func getMemory(scope, id string) (Memory, error) {
+	data, err := config.RedisHGet(scope, id)
+	if err != nil {
+		return Memory{}, err
+	}
+	var memory Memory
+	err = json.Unmarshal([]byte(data), &memory)
+	return memory, err
+}
+
+// removeMemoryIndex 移除仍指向该记忆的内容索引
+func removeMemoryIndex(scope string, memory Memory) {
+	hash := memoryContentHash(memory.Content)
+	if id, err := config.RedisHGet(memoryIndexKey(scope), hash); err == nil && id == memory.ID {
+		config.RedisHDel(memoryIndexKey(scope), hash)
+	}
+}
+
+func saveMemory(scope string, memory Memory) error {
+	data, err := json.Marshal(memory)
+	if err != nil {
+		return err
+	}
+	return config.RedisHSet(scope, memory.ID, string(data))
+}
+
+// addMemory 添加一条记忆，已存在相同内容时返回已有的记忆
+// 先保存记忆再用HSETNX占用内容索引，并发添加相同内容时只有一条保留，其余删除后返回保留的记忆
+func addMemory(scope, content, source string) (Memory, error) {
+	content = strings.TrimSpace(content)
+	now := time.Now().Unix()
+	memory := Memory{
+		ID:        "mem_" + strings.ReplaceAll(uuid.New().String(), "-", ""),
+		Content:   content,
+		Source:    source,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := saveMemory(scope, memory); err != nil {
+		return Memory{}, err
+	}
+
+	indexKey := memoryIndexKey(scope)
+	hash := memoryContentHash(content)
+	added, err := config.RedisHSetNX(indexKey, hash, memory.ID)
+	if err != nil || added {
+		return memory, err
+	}
+
+	existingID, err := config.RedisHGet(indexKey, hash)
+	if err == nil && existingID != memory.ID {
+		if existing, err := getMemory(scope, existingID); err == nil {
+			config.RedisHDel(scope, memory.ID)
+			return existing, nil
+		}
+	}
+	// 索引指向的记忆已被删除，由本条记忆接替
+	return memory, config.RedisHSet(indexKey, hash, memory.ID)
+}
+
+// formatAgentMemories 将记忆列表转换为AgentMemories字段的内容，每行一条
+func formatAgentMemories(memories []Memory) string {
+	lines := make([]string, 0, len(memories))
+	for _, memory := range memories {
+		lines = append(lines, "- "+memory.Content)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// injectAgentMemories AGENT模式请求时将API Key保存的记忆写入AgentMemories
+func injectAgentMemories(augmentReq *AugmentRequest, apiKey config.APIKey) {
+	if augmentReq.Mode != "AGENT" {
+		return
+	}
+	memories, err := getMemories(memoryScope(apiKey))
+	if err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("读取Agent记忆失败")
+		return
+	}
+	augmentReq.AgentMemories = formatAgentMemories(memories)
+}
+
+// responseMemories 提取响应节点中的记忆：remember工具调用的memory参数和AgentMemory节点的内容
+func responseMemories(nodes []Node) map[string]string {
+	memories := make(map[string]string)
+	for _, node := range nodes {
+		if content := strings.TrimSpace(node.AgentMemory.Content); content != "" {
+			memories[content] = memorySourceResponse
+		}
+		if node.Type != responseNodeTypeToolUse || node.ToolUse.ToolName != rememberToolName {
+			continue
+		}
+		var input struct {
+			Memory string `json:"memory"`
+		}
+		if err := json.Unmarshal([]byte(node.ToolUse.InputJSON), &input); err != nil {
+			continue
+		}
+		if content := strings.TrimSpace(input.Memory); content != "" {
+			memories[content] = memorySourceTool
+		}
+	}
+	return memories
+}
+
+// memoryCollector 收集一次请求的响应中出现的记忆，同一内容只保存一次
+type memoryCollector struct {
+	scope string
+	seen  map[string]bool
+}
+
+func newMemoryCollector(c *gin.Context) *memoryCollector {
+	return &memoryCollector{scope: memoryScope(requestAPIKey(c)), seen: make(map[string]bool)}
+}
+
+// collect 异步保存响应节点中新出现的记忆
+func (mc *memoryCollector) collect(nodes []Node) {
+	for content, source := range responseMemories(nodes) {
+		if mc.seen[content] {
+			continue
+		}
+		mc.seen[content] = true
+
+		go func(content, source string) {
+			memory, err := addMemory(mc.scope, content, source)
+			if err != nil {
+				logger.Log.WithFields(logrus.Fields{
+					"error": err.Error(),
+				}).Error("保存Agent记忆失败")
+				return
+			}
+			logger.Log.WithFields(logrus.Fields{
+				"memory_id": memory.ID,
+				"source":    source,
+			}).Info("已保存响应中的Agent记忆")
+		}(content, source)
+	}
+}
+
+// ListMemoriesHandler 获取当前API Key的所有记忆
+func ListMemoriesHandler(c *gin.Context) {
+	memories, err := getMemories(memoryScope(requestAPIKey(c)))
+	if err != nil {
+		writeOpenAIError(c, http.StatusInternalServerError, "获取记忆失败: "+err.Error(), "api_error", "", "")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"data":   memories,
+	})
+}
+
+// CreateMemoryHandler 为当前API Key添加记忆
+func CreateMemoryHandler(c *gin.Context) {
+	var req MemoryRequest
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Content) == "" {
+		writeOpenAIError(c, http.StatusBadRequest, "记忆内容不能为空", "invalid_request_error", "content", "")
+		return
+	}
+
+	memory, err := addMemory(memoryScope(requestAPIKey(c)), req.Content, memorySourceManual)
+	if err != nil {
+		writeOpenAIError(c, http.StatusInternalServerError, "保存记忆失败: "+err.Error(), "api_error", "", "")
+		return
+	}
+	c.JSON(http.StatusOK, memory)
+}
+
+// UpdateMemoryHandler 修改记忆内容
+func UpdateMemoryHandler(c *gin.Context) {
+	var req MemoryRequest
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Content) == "" {
+		writeOpenAIError(c, http.StatusBadRequest, "记忆内容不能为空", "invalid_request_error", "content", "")
+		return
+	}
+
+	scope := memoryScope(requestAPIKey(c))
+	memory, err := getMemory(scope, c.Param("id"))
+	if err == redis.Nil {
+		writeOpenAIError(c, http.StatusNotFound, "记忆不存在", "invalid_request_error", "id", "memory_not_found")
+		return
+	}
+	if err != nil {
+		writeOpenAIError(c, http.StatusInternalServerError, "读取记忆失败: "+err.Error(), "api_error", "", "")
+		return
+	}
+
+	content := strings.TrimSpace(req.Content)
+	if content != memory.Content {
+		// 新内容已被其他记忆使用时拒绝修改，保持同一内容只有一条记忆
+		added, err := config.RedisHSetNX(memoryIndexKey(scope), memoryContentHash(content), memory.ID)
+		if err != nil {
+			writeOpenAIError(c, http.StatusInternalServerError, "保存记忆失败: "+err.Error(), "api_error", "", "")
+			return
+		}
+		if !added {
+			writeOpenAIError(c, http.StatusConflict, "已存在相同内容的记忆", "invalid_request_error", "content", "memory_exists")
+			return
+		}
+		removeMemoryIndex(scope, memory)
+	}
+
+	memory.Content = content
+	memory.UpdatedAt = time.Now().Unix()
+	if err := saveMemory(scope, memory); err != nil {
+		writeOpenAIError(c, http.StatusInternalServerError, "保存记忆失败: "+err.Error(), "api_error", "", "")
+		return
+	}
+	c.JSON(http.StatusOK, memory)
+}
+
+// DeleteMemoryHandler 删除记忆
+func DeleteMemoryHandler(c *gin.Context) {
+	scope := memoryScope(requestAPIKey(c))
+	id := c.Param("id")
+	memory, err := getMemory(scope, id)
+	if err != nil {
+		writeOpenAIError(c, http.StatusNotFound, "记忆不存在", "invalid_request_error", "id", "memory_not_found")
+		return
+	}
+
+	removeMemoryIndex(scope, memory)
+
+	if err := config.RedisHDel(scope, id); err != nil {
+		writeOpenAIError(c, http.StatusInternalServerError, "删除记忆失败: "+err.Error(), "api_error", "", "")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":      id,
+		"object":  "memory.deleted",
+		"deleted": true,
+	})
+}
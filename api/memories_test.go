@@ -0,0 +1,75 @@
+package api
+
+import (
+	"augment2api/config"
+	"testing"
+)
+
+func TestMemoryScope(t *testing.T) {
+	tests := []struct {
+		apiKey string
+		scope  string
+	}{
+		{apiKey: "", scope: "agent_memories:default"},
+		{apiKey: "default", scope: "agent_memories:key:default"},
+		{apiKey: "sk-a", scope: "agent_memories:key:sk-a"},
+	}
+	for _, tt := range tests {
+		scope := memoryScope(config.APIKey{Key: tt.apiKey})
+		if scope != tt.scope {
+			t.Errorf("memoryScope(%q) = %q, want %q", tt.apiKey, scope, tt.scope)
+		}
+		if index := memoryIndexKey(scope); index != agentMemoryIndexPrefix+scope[len(agentMemoriesPrefix):] {
+			t.Errorf("memoryIndexKey(%q) = %q", scope, index)
+		}
+	}
+}
+
+func TestMigrateMemoryScopes(t *testing.T) {
+	newFakeRedis(t)
+	for _, key := range []string{"sk-a", "default"} {
+		if err := config.SetAPIKey(config.APIKey{Key: key, Name: key, Enabled: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 旧版的记忆键：API Key直接拼接在前缀后，名为default的API Key与未鉴权请求共用记忆
+	if _, err := addMemory(agentMemoriesPrefix+"sk-a", "prefers Go", memorySourceManual); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := addMemory(agentMemoriesPrefix+defaultMemoryScope, "shared", memorySourceManual); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MigrateMemoryScopes(); err != nil {
+		t.Fatalf("MigrateMemoryScopes: %v", err)
+	}
+
+	scope := memoryScope(config.APIKey{Key: "sk-a"})
+	memories, _ := getMemories(scope)
+	if len(memories) != 1 || memories[0].Content != "prefers Go" {
+		t.Errorf("迁移后的记忆 = %+v", memories)
+	}
+	if id, err := config.RedisHGet(memoryIndexKey(scope), memoryContentHash("prefers Go")); err != nil || id != memories[0].ID {
+		t.Errorf("迁移后的内容索引 = %q, %v", id, err)
+	}
+	if exists, _ := config.RedisExists(agentMemoriesPrefix + "sk-a"); exists {
+		t.Error("旧记忆键未删除")
+	}
+	if memories, _ := getMemories(memoryScope(config.APIKey{})); len(memories) != 1 {
+		t.Errorf("未鉴权请求的记忆 = %+v", memories)
+	}
+	if memories, _ := getMemories(memoryScope(config.APIKey{Key: "default"})); len(memories) != 0 {
+		t.Errorf("名为default的API Key不应继承共用的记忆: %+v", memories)
+	}
+
+	// 迁移只执行一次，之后的键不再改名
+	if _, err := addMemory(agentMemoriesPrefix+"sk-a", "later", memorySourceManual); err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateMemoryScopes(); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := config.RedisExists(agentMemoriesPrefix + "sk-a"); !exists {
+		t.Error("迁移重复执行")
+	}
+}
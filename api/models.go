@@ -0,0 +1,268 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// ModelConfigRequest 创建/更新模型配置的请求结构
+type ModelConfigRequest struct {
+	ID             string   `json:"id"`
+	Aliases        []string `json:"aliases"`
+	Mode           string   `json:"mode"`
+	UserGuidelines string   `json:"user_guidelines"`
+	DefaultPrompt  string   `json:"default_prompt"`
+	PromptTemplate string   `json:"prompt_template"`
+	IncludeTools   bool     `json:"include_tools"`
+	CacheTTL       int      `json:"cache_ttl"`
+	ContextBudget  int      `json:"context_budget"`
+	OwnedBy        string   `json:"owned_by"`
+	Enabled        *bool    `json:"enabled"`
+}
+
+// 注册表为空时写入的默认模型，与原先写死的模型列表一致
+var defaultModelOwners = map[string]string{
+	"claude-3.7-agent": "anthropic",
+	"augment-chat":     "augment",
+}
+
+// suffixModelConfig 按模型名称后缀推断配置，用于注册表为空时写入默认模型
+// 以-agent结尾使用AGENT模式并下发内置工具，其余使用CHAT模式，指南和提示词取自提示词模板
+func suffixModelConfig(name string) config.ModelConfig {
+	model := config.ModelConfig{
+		ID:      name,
+		Mode:    "CHAT",
+		OwnedBy: "augment",
+		Enabled: true,
+		Created: 1708387200,
+	}
+
+	if strings.HasSuffix(strings.ToLower(name), "-agent") {
+		model.Mode = "AGENT"
+		model.IncludeTools = true
+	}
+
+	return model
+}
+
+// resolvedModel 当前请求已解析的模型
+type resolvedModel struct {
+	name  string
+	model config.ModelConfig
+	err   error
+}
+
+// requestModel 解析当前请求使用的模型，结果保存在gin上下文中，同一请求内只查询一次注册表
+func requestModel(c *gin.Context, name string) (config.ModelConfig, error) {
+	if value, exists := c.Get("model_config"); exists {
+		if resolved, ok := value.(resolvedModel); ok && resolved.name == name {
+			return resolved.model, resolved.err
+		}
+	}
+	model, err := resolveModel(name)
+	c.Set("model_config", resolvedModel{name: name, model: model, err: err})
+	return model, err
+}
+
+// resolveModel 根据请求中的模型名称查找模型配置，未登记或已禁用的模型返回错误
+func resolveModel(name string) (config.ModelConfig, error) {
+	model, found := config.FindModelConfig(name)
+	if !found {
+		return model, fmt.Errorf("模型 %s 不存在", name)
+	}
+	if !model.Enabled {
+		return model, fmt.Errorf("模型 %s 已禁用", name)
+	}
+	return model, nil
+}
+
+// InitModelRegistry 注册表为空时写入默认模型，否则重建模型名称索引
+func InitModelRegistry() error {
+	models, err := config.GetAllModelConfigs()
+	if err != nil {
+		return err
+	}
+	if len(models) > 0 {
+		return config.RebuildModelNameIndex(models)
+	}
+
+	for id, owner := range defaultModelOwners {
+		model := suffixModelConfig(id)
+		model.OwnedBy = owner
+		if err := config.SetModelConfig(model); err != nil {
+			return err
+		}
+		logger.Log.WithFields(logrus.Fields{
+			"model": id,
+		}).Info("初始化默认模型")
+	}
+
+	return nil
+}
+
+// GetModelConfigs 获取所有模型配置
+func GetModelConfigs(c *gin.Context) {
+	models, err := config.GetAllModelConfigs()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取模型配置失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"models": models,
+		"total":  len(models),
+	})
+}
+
+// SaveModelConfig 创建或更新模型配置
+// POST创建模型，模型已存在时返回409；PUT按路径参数中的ID创建或更新模型
+func SaveModelConfig(c *gin.Context) {
+	var req ModelConfigRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "请求数据格式错误: " + err.Error(),
+		})
+		return
+	}
+
+	creating := c.Param("id") == ""
+	if !creating {
+		req.ID = c.Param("id")
+	}
+	req.ID = strings.TrimSpace(req.ID)
+	if req.ID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "模型ID不能为空",
+		})
+		return
+	}
+
+	req.Mode = strings.ToUpper(req.Mode)
+	if req.Mode == "" {
+		req.Mode = "CHAT"
+	}
+	if req.Mode != "CHAT" && req.Mode != "AGENT" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "模式只能为CHAT或AGENT",
+		})
+		return
+	}
+
+	// 别名不能与其他模型的ID或别名冲突
+	models, err := config.GetAllModelConfigs()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取模型配置失败: " + err.Error(),
+		})
+		return
+	}
+	for _, other := range models {
+		if other.ID == req.ID {
+			continue
+		}
+		for _, name := range append([]string{req.ID}, req.Aliases...) {
+			if other.Matches(name) {
+				c.JSON(http.StatusConflict, gin.H{
+					"status": "error",
+					"error":  fmt.Sprintf("名称 %s 已被模型 %s 使用", name, other.ID),
+				})
+				return
+			}
+		}
+	}
+
+	model, err := config.GetModelConfig(req.ID)
+	if err == nil && creating {
+		c.JSON(http.StatusConflict, gin.H{
+			"status": "error",
+			"error":  fmt.Sprintf("模型 %s 已存在，请使用PUT /api/models/%s更新", req.ID, req.ID),
+		})
+		return
+	}
+	if err != nil {
+		// 新建模型
+		model = config.ModelConfig{
+			ID:      req.ID,
+			Enabled: true,
+			Created: time.Now().Unix(),
+		}
+	}
+
+	model.Aliases = req.Aliases
+	model.Mode = req.Mode
+	model.UserGuidelines = req.UserGuidelines
+	model.DefaultPrompt = req.DefaultPrompt
+	model.PromptTemplate = req.PromptTemplate
+	model.IncludeTools = req.IncludeTools
+	model.CacheTTL = req.CacheTTL
+	model.ContextBudget = req.ContextBudget
+	model.OwnedBy = req.OwnedBy
+	if model.OwnedBy == "" {
+		model.OwnedBy = "augment"
+	}
+	if req.Enabled != nil {
+		model.Enabled = *req.Enabled
+	}
+
+	if err := config.SetModelConfig(model); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "保存模型配置失败: " + err.Error(),
+		})
+		return
+	}
+
+	logger.Log.WithFields(logrus.Fields{
+		"model":   model.ID,
+		"mode":    model.Mode,
+		"enabled": model.Enabled,
+	}).Info("保存模型配置成功")
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"model":  model,
+	})
+}
+
+// DeleteModelConfig 删除模型配置
+func DeleteModelConfig(c *gin.Context) {
+	id := c.Param("id")
+	if _, err := config.GetModelConfig(id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  "模型不存在",
+		})
+		return
+	}
+
+	if err := config.DeleteModelConfig(id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "删除模型配置失败: " + err.Error(),
+		})
+		return
+	}
+
+	logger.Log.WithFields(logrus.Fields{
+		"model": id,
+	}).Info("删除模型配置成功")
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
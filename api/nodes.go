@@ -0,0 +1,122 @@
+package api
+
+import "strings"
+
+// 响应节点类型
+const (
+	responseNodeTypeRawResponse         = 0
+	responseNodeTypeSuggestedQuestions  = 1
+	responseNodeTypeMainTextFinished    = 2
+	responseNodeTypeWorkspaceFileChunks = 3
+	responseNodeTypeRelevantSources     = 4
+	responseNodeTypeToolUse             = 5
+	responseNodeTypeAgentMemory         = 6
+	responseNodeTypeToolUseStart        = 7
+	responseNodeTypeThinking            = 8
+	responseNodeTypeBillingMetadata     = 9
+	responseNodeTypeTokenUsage          = 10
+)
+
+// responseNodeTypeNames 扩展字段中使用的节点类型名称
+var responseNodeTypeNames = map[int]string{
+	responseNodeTypeRawResponse:         "raw_response",
+	responseNodeTypeSuggestedQuestions:  "suggested_questions",
+	responseNodeTypeMainTextFinished:    "main_text_finished",
+	responseNodeTypeWorkspaceFileChunks: "workspace_file_chunks",
+	responseNodeTypeRelevantSources:     "relevant_sources",
+	responseNodeTypeToolUse:             "tool_use",
+	responseNodeTypeAgentMemory:         "agent_memory",
+	responseNodeTypeToolUseStart:        "tool_use_start",
+	responseNodeTypeThinking:            "thinking",
+	responseNodeTypeBillingMetadata:     "billing_metadata",
+	responseNodeTypeTokenUsage:          "token_usage",
+}
+
+// TokenUsageNode 响应中的token用量节点
+type TokenUsageNode struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens,omitempty"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens,omitempty"`
+}
+
+// ThinkingNode 响应中的思考节点
+type ThinkingNode struct {
+	Summary string `json:"summary"`
+	Content string `json:"content,omitempty"`
+}
+
+// text 返回思考内容，没有完整内容时使用摘要
+func (t *ThinkingNode) text() string {
+	if t.Content != "" {
+		return t.Content
+	}
+	return t.Summary
+}
+
+// NodeExtension 以augment_nodes扩展字段返回给客户端的响应节点
+type NodeExtension struct {
+	ID          int             `json:"id"`
+	Type        string          `json:"type"`
+	Content     string          `json:"content,omitempty"`
+	ToolUse     *ToolUse        `json:"tool_use,omitempty"`
+	AgentMemory *AgentMemory    `json:"agent_memory,omitempty"`
+	Thinking    *ThinkingNode   `json:"thinking,omitempty"`
+	TokenUsage  *TokenUsageNode `json:"token_usage,omitempty"`
+}
+
+func newNodeExtension(node Node) NodeExtension {
+	ext := NodeExtension{
+		ID:         node.ID,
+		Type:       responseNodeTypeNames[node.Type],
+		Content:    node.Content,
+		Thinking:   node.Thinking,
+		TokenUsage: node.TokenUsage,
+	}
+	if ext.Type == "" {
+		ext.Type = "unknown"
+	}
+	if node.ToolUse.ToolName != "" {
+		toolUse := node.ToolUse
+		ext.ToolUse = &toolUse
+	}
+	if node.AgentMemory.Content != "" {
+		memory := node.AgentMemory
+		ext.AgentMemory = &memory
+	}
+	return ext
+}
+
+// nodeCollector 按请求的选项提取响应节点中的思考内容和扩展节点，未开启的选项不提取
+type nodeCollector struct {
+	reasoning  bool
+	extensions bool
+
+	reasoningText strings.Builder
+	nodes         []NodeExtension
+}
+
+func newNodeCollector(req OpenAIRequest) *nodeCollector {
+	return &nodeCollector{reasoning: req.IncludeReasoning, extensions: req.IncludeNodes}
+}
+
+// collect 返回本次节点中的思考内容和扩展节点
+// 文本和工具调用已转换为content和tool_calls，不作为扩展节点返回；开启include_reasoning时思考节点也不再重复返回
+func (nc *nodeCollector) collect(nodes []Node) (string, []NodeExtension) {
+	var reasoning strings.Builder
+	var added []NodeExtension
+	for _, node := range nodes {
+		if node.Type == responseNodeTypeThinking && node.Thinking != nil && nc.reasoning {
+			reasoning.WriteString(node.Thinking.text())
+			continue
+		}
+		if !nc.extensions || node.Type == responseNodeTypeRawResponse || node.Type == responseNodeTypeToolUse {
+			continue
+		}
+		added = append(added, newNodeExtension(node))
+	}
+
+	nc.reasoningText.WriteString(reasoning.String())
+	nc.nodes = append(nc.nodes, added...)
+	return reasoning.String(), added
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+// nodeTranscript 带节点的chat-stream输出：思考、文本、工具调用开始与完成、记忆、正文结束和token用量
+const nodeTranscript = `
+{"text":"","done":false,"nodes":[{"id":0,"type":8,"content":"","thinking":{"summary":"The user wants the weather, call get_weather."}}]}
+{"text":"Let me check.","done":false,"nodes":[{"id":1,"type":0,"content":"Let me check."}]}
+{"text":"","done":false,"nodes":[{"id":2,"type":7,"content":"","tool_use":{"tool_use_id":"toolu_01","tool_name":"get_weather","input_json":"","is_partial":true}}]}
+{"text":"","done":false,"nodes":[{"id":3,"type":5,"content":"","tool_use":{"tool_use_id":"toolu_01","tool_name":"get_weather","input_json":"{\"city\":\"Paris\"}"}}]}
+{"text":"","done":false,"nodes":[{"id":4,"type":6,"content":"","agent_memory":{"content":"The user lives in Paris"}}]}
+{"text":"","done":true,"nodes":[{"id":5,"type":2,"content":"Let me check."},{"id":6,"type":10,"content":"","token_usage":{"input_tokens":1200,"output_tokens":45,"cache_read_input_tokens":1024}}]}`
+
+// transcriptNodes 按顺序返回录制响应中的所有节点
+func transcriptNodes(t *testing.T) []Node {
+	t.Helper()
+	var nodes []Node
+	for _, resp := range decodeTranscript(t, nodeTranscript) {
+		nodes = append(nodes, resp.Nodes...)
+	}
+	return nodes
+}
+
+func TestDecodeResponseNodes(t *testing.T) {
+	nodes := transcriptNodes(t)
+	if len(nodes) != 7 {
+		t.Fatalf("len(nodes) = %d, want 7", len(nodes))
+	}
+
+	tests := []struct {
+		name  string
+		node  Node
+		check func(Node) bool
+	}{
+		{name: "thinking", node: nodes[0], check: func(n Node) bool {
+			return n.Type == responseNodeTypeThinking && n.Thinking != nil &&
+				n.Thinking.text() == "The user wants the weather, call get_weather."
+		}},
+		{name: "raw_response", node: nodes[1], check: func(n Node) bool {
+			return n.Type == responseNodeTypeRawResponse && n.Content == "Let me check."
+		}},
+		{name: "tool_use_start", node: nodes[2], check: func(n Node) bool {
+			return n.Type == responseNodeTypeToolUseStart && n.ToolUse.IsPartial && n.ToolUse.ToolName == "get_weather"
+		}},
+		{name: "tool_use", node: nodes[3], check: func(n Node) bool {
+			return n.Type == responseNodeTypeToolUse && !n.ToolUse.IsPartial &&
+				n.ToolUse == ToolUse{ToolUseID: "toolu_01", ToolName: "get_weather", InputJSON: `{"city":"Paris"}`}
+		}},
+		{name: "agent_memory", node: nodes[4], check: func(n Node) bool {
+			return n.Type == responseNodeTypeAgentMemory && n.AgentMemory.Content == "The user lives in Paris"
+		}},
+		{name: "main_text_finished", node: nodes[5], check: func(n Node) bool {
+			return n.Type == responseNodeTypeMainTextFinished && n.Content == "Let me check."
+		}},
+		{name: "token_usage", node: nodes[6], check: func(n Node) bool {
+			return n.Type == responseNodeTypeTokenUsage && n.TokenUsage != nil &&
+				*n.TokenUsage == TokenUsageNode{InputTokens: 1200, OutputTokens: 45, CacheReadInputTokens: 1024}
+		}},
+	}
+	for _, tt := range tests {
+		if !tt.check(tt.node) {
+			t.Errorf("%s: 解析结果不正确: %+v", tt.name, tt.node)
+		}
+	}
+}
+
+func TestNodeCollector(t *testing.T) {
+	tests := []struct {
+		name      string
+		req       OpenAIRequest
+		reasoning string
+		types     []string
+	}{
+		{
+			name: "disabled",
+		},
+		{
+			name:      "include_reasoning",
+			req:       OpenAIRequest{IncludeReasoning: true},
+			reasoning: "The user wants the weather, call get_weather.",
+		},
+		{
+			name:  "include_nodes",
+			req:   OpenAIRequest{IncludeNodes: true},
+			types: []string{"thinking", "tool_use_start", "agent_memory", "main_text_finished", "token_usage"},
+		},
+		{
+			name:      "both",
+			req:       OpenAIRequest{IncludeReasoning: true, IncludeNodes: true},
+			reasoning: "The user wants the weather, call get_weather.",
+			types:     []string{"tool_use_start", "agent_memory", "main_text_finished", "token_usage"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := newNodeCollector(tt.req)
+			for _, resp := range decodeTranscript(t, nodeTranscript) {
+				collector.collect(resp.Nodes)
+			}
+
+			if reasoning := collector.reasoningText.String(); reasoning != tt.reasoning {
+				t.Errorf("reasoning = %q, want %q", reasoning, tt.reasoning)
+			}
+			var types []string
+			for _, ext := range collector.nodes {
+				types = append(types, ext.Type)
+			}
+			if !reflect.DeepEqual(types, tt.types) {
+				t.Errorf("extension types = %v, want %v", types, tt.types)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// token请求结果统计键前缀，哈希字段为结果名称，值为次数
+	tokenOutcomesPrefix = "token_outcomes:"
+
+	// 请求结果
+	OutcomeSuccess   = "success"   // 上游正常完成
+	OutcomeBlocked   = "blocked"   // 上游返回block信息
+	OutcomeError     = "error"     // 上游请求或读取失败
+	OutcomeCancelled = "cancelled" // 客户端在响应完成前断开连接
+
+	// statusClientClosedRequest 客户端主动关闭请求（沿用nginx的499状态码）
+	statusClientClosedRequest = 499
+)
+
+// RecordRequestOutcome 异步累加token的请求结果计数
+func RecordRequestOutcome(token, outcome string) {
+	if token == "" {
+		return
+	}
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				logger.Log.WithFields(logrus.Fields{
+					"error": r,
+					"token": token,
+				}).Error("记录请求结果时发生panic")
+			}
+		}()
+
+		if err := config.RedisHIncrBy(tokenOutcomesPrefix+token, outcome, 1); err != nil {
+			logger.Log.WithFields(logrus.Fields{
+				"token":   token,
+				"outcome": outcome,
+				"error":   err.Error(),
+			}).Error("记录请求结果失败")
+		}
+	}()
+}
+
+// getTokenOutcomes 读取token累计的请求结果计数
+func getTokenOutcomes(token string) map[string]int {
+	outcomes := make(map[string]int)
+	values, err := config.RedisHGetAll(tokenOutcomesPrefix + token)
+	if err != nil {
+		return outcomes
+	}
+	for outcome, value := range values {
+		if n, err := strconv.Atoi(value); err == nil {
+			outcomes[outcome] = n
+		}
+	}
+	return outcomes
+}
+
+// clientGone 判断客户端是否已断开连接
+func clientGone(c *gin.Context) bool {
+	return c.Request.Context().Err() != nil
+}
+
+// handleClientCancel 客户端断开连接后立即释放token并记录cancelled结果
+func handleClientCancel(c *gin.Context, token string) {
+	logger.Log.WithFields(logrus.Fields{
+		"token": token,
+		"path":  c.Request.URL.Path,
+	}).Info("客户端已断开连接，终止上游请求")
+
+	cleanupRequestStatus(c)
+	RecordRequestOutcome(token, OutcomeCancelled)
+	c.Abort()
+}
@@ -0,0 +1,276 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"bytes"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// promptVars 提示词模板中可用的变量
+type promptVars struct {
+	Date    string
+	Time    string
+	Model   string
+	KeyName string
+	Mode    string
+}
+
+// PromptPreviewRequest 预览提示词模板渲染结果的请求结构
+type PromptPreviewRequest struct {
+	OpenAIRequest
+	APIKey         string `json:"api_key"`         // 按该API Key的配置选择模板
+	PromptTemplate string `json:"prompt_template"` // 指定模板，优先于API Key和模型的配置
+}
+
+// builtinPromptTemplate 内置默认模板，Redis中没有default模板时使用
+func builtinPromptTemplate() config.PromptTemplate {
+	return config.PromptTemplate{
+		Name:               config.DefaultPromptTemplateName,
+		Description:        "默认提示词模板",
+		Prefix:             defaultPrefix,
+		ChatGuidelines:     "Answer in the same language as the user's message.",
+		AgentGuidelines:    "Answer in the same language as the user's message, do not use any tools, and for questions involving internet searches, please answer based on your existing knowledge.",
+		ToolGuidelines:     "Answer in the same language as the user's message.",
+		FallbackGuidelines: "Answer in the same language as the user's message.",
+		DefaultPrompt:      defaultPrompt,
+	}
+}
+
+// InitPromptTemplates 默认模板不存在时写入内置默认模板
+func InitPromptTemplates() error {
+	if _, err := config.GetPromptTemplate(config.DefaultPromptTemplateName); err == nil {
+		return nil
+	}
+
+	logger.Log.Info("初始化默认提示词模板")
+	return config.SetPromptTemplate(builtinPromptTemplate())
+}
+
+// newPromptVars 构造模板变量
+func newPromptVars(model string, apiKey config.APIKey, mode string) promptVars {
+	now := time.Now()
+	return promptVars{
+		Date:    now.Format("2006-01-02"),
+		Time:    now.Format("15:04:05"),
+		Model:   model,
+		KeyName: apiKey.Name,
+		Mode:    mode,
+	}
+}
+
+// selectPromptTemplate 按API Key、模型、默认模板的顺序选择提示词模板
+func selectPromptTemplate(apiKey config.APIKey, model config.ModelConfig) config.PromptTemplate {
+	for _, name := range []string{apiKey.PromptTemplate, model.PromptTemplate, config.DefaultPromptTemplateName} {
+		if name == "" {
+			continue
+		}
+		tmpl, err := config.GetPromptTemplate(name)
+		if err == nil {
+			return tmpl
+		}
+		logger.Log.WithFields(logrus.Fields{
+			"template": name,
+			"error":    err.Error(),
+		}).Warn("提示词模板不存在，尝试下一个模板")
+	}
+	return builtinPromptTemplate()
+}
+
+// renderPromptText 渲染模板文本
+func renderPromptText(text string, vars promptVars) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+
+	tmpl, err := template.New("prompt").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, vars); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// renderPrompt 渲染模板文本，渲染失败时记录日志并使用原文
+func renderPrompt(text string, vars promptVars) string {
+	rendered, err := renderPromptText(text, vars)
+	if err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("渲染提示词模板失败，使用原始文本")
+		return text
+	}
+	return rendered
+}
+
+// validatePromptTemplate 使用示例变量渲染模板的所有字段，检查模板语法
+func validatePromptTemplate(tmpl config.PromptTemplate) error {
+	vars := newPromptVars("example-model", config.APIKey{Name: "example"}, "CHAT")
+	fields := []string{
+		tmpl.Prefix,
+		tmpl.ChatGuidelines,
+		tmpl.AgentGuidelines,
+		tmpl.ToolGuidelines,
+		tmpl.FallbackGuidelines,
+		tmpl.DefaultPrompt,
+	}
+	for _, field := range fields {
+		if _, err := renderPromptText(field, vars); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetPromptTemplates 获取所有提示词模板
+func GetPromptTemplates(c *gin.Context) {
+	templates, err := config.GetAllPromptTemplates()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取提示词模板失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":    "success",
+		"templates": templates,
+		"total":     len(templates),
+	})
+}
+
+// SavePromptTemplate 创建或更新提示词模板
+func SavePromptTemplate(c *gin.Context) {
+	var tmpl config.PromptTemplate
+	if err := c.ShouldBindJSON(&tmpl); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "请求数据格式错误: " + err.Error(),
+		})
+		return
+	}
+
+	tmpl.Name = strings.TrimSpace(c.Param("name"))
+	if tmpl.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "模板名称不能为空",
+		})
+		return
+	}
+
+	if err := validatePromptTemplate(tmpl); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "模板语法错误: " + err.Error(),
+		})
+		return
+	}
+
+	if err := config.SetPromptTemplate(tmpl); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "保存提示词模板失败: " + err.Error(),
+		})
+		return
+	}
+
+	logger.Log.WithFields(logrus.Fields{
+		"template": tmpl.Name,
+	}).Info("保存提示词模板成功")
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "success",
+		"template": tmpl,
+	})
+}
+
+// DeletePromptTemplate 删除提示词模板，默认模板不能删除
+func DeletePromptTemplate(c *gin.Context) {
+	name := c.Param("name")
+	if name == config.DefaultPromptTemplateName {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "不能删除默认提示词模板",
+		})
+		return
+	}
+
+	if _, err := config.GetPromptTemplate(name); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  "模板不存在",
+		})
+		return
+	}
+
+	if err := config.DeletePromptTemplate(name); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "删除提示词模板失败: " + err.Error(),
+		})
+		return
+	}
+
+	logger.Log.WithFields(logrus.Fields{
+		"template": name,
+	}).Info("删除提示词模板成功")
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
+
+// PreviewPromptTemplate 预览聊天请求转换后发送给Augment的请求内容
+func PreviewPromptTemplate(c *gin.Context) {
+	var req PromptPreviewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "请求数据格式错误: " + err.Error(),
+		})
+		return
+	}
+
+	apiKey := config.APIKey{Name: "preview"}
+	if req.APIKey != "" {
+		var err error
+		apiKey, err = config.GetAPIKey(req.APIKey)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status": "error",
+				"error":  "API Key不存在",
+			})
+			return
+		}
+	}
+	if req.PromptTemplate != "" {
+		apiKey.PromptTemplate = req.PromptTemplate
+	}
+
+	augmentReq, err := convertToAugmentRequest(c, req.OpenAIRequest, apiKey)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":              "success",
+		"request":             augmentReq,
+		"fallback_guidelines": augmentReq.fallbackGuideLines,
+	})
+}
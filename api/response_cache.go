@@ -0,0 +1,195 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// 响应缓存键前缀，值为cachedResponse的JSON
+const responseCachePrefix = "response_cache:"
+
+// cachedResponse 缓存的上游响应序列，命中时按原顺序重放，由处理函数转换为流式或非流式格式
+type cachedResponse struct {
+	Model     string            `json:"model"`
+	Responses []AugmentResponse `json:"responses"`
+	CreatedAt int64             `json:"created_at"`
+}
+
+// ResponseCacheMiddleware 在分配token前查询响应缓存
+// 命中时请求不再占用token池中的token，未命中时记录缓存键，由forwardWithFailover在上游正常完成后写入
+func ResponseCacheMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !config.AppConfig.ResponseCacheEnabled || !strings.HasSuffix(c.Request.URL.Path, "/chat/completions") {
+			c.Next()
+			return
+		}
+
+		cacheControl := strings.ToLower(c.GetHeader("Cache-Control"))
+		if strings.Contains(cacheControl, "no-cache") || strings.Contains(cacheControl, "no-store") {
+			c.Header("X-Cache", "BYPASS")
+			c.Next()
+			return
+		}
+
+		// 读取请求体后重新放回，供处理函数解析
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "读取请求数据失败"})
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		// 无法解析或不适合缓存的请求（需要校验输出或自动续写、依赖服务端对话历史或上传的文件）交给处理函数按原流程处理
+		var req OpenAIRequest
+		if err := json.Unmarshal(body, &req); err != nil || req.ResponseFormat != nil || req.ConversationID != "" ||
+			len(req.FileIDs) > 0 || req.Workspace != "" || req.AutoContinue {
+			c.Next()
+			return
+		}
+		apiKey := requestAPIKey(c)
+		ttl := responseCacheTTL(c, apiKey, req.Model)
+		if ttl <= 0 {
+			c.Next()
+			return
+		}
+		augmentReq, err := convertToAugmentRequest(c, req, apiKey)
+		// 转换结果交给处理函数复用，避免重复下载图片
+		c.Set("augment_request", convertedRequest{augmentReq: augmentReq, err: err})
+		if err != nil {
+			c.Next()
+			return
+		}
+
+		key := responseCacheKey(apiKey.Key, augmentReq)
+		if cached, ok := loadResponseCache(key); ok {
+			logger.Log.WithFields(logrus.Fields{
+				"model": req.Model,
+				"key":   key,
+			}).Info("命中响应缓存")
+			c.Set("response_cache", cached)
+			c.Header("X-Cache", "HIT")
+			c.Next()
+			return
+		}
+
+		c.Set("response_cache_key", key)
+		c.Set("response_cache_ttl", ttl)
+		c.Header("X-Cache", "MISS")
+		c.Next()
+	}
+}
+
+// convertedRequest 响应缓存中间件转换请求的结果
+type convertedRequest struct {
+	augmentReq AugmentRequest
+	err        error
+}
+
+// requestAugmentRequest 获取响应缓存中间件已转换的请求，中间件未转换时重新转换
+func requestAugmentRequest(c *gin.Context, req OpenAIRequest) (AugmentRequest, error) {
+	if value, exists := c.Get("augment_request"); exists {
+		if converted, ok := value.(convertedRequest); ok {
+			return converted.augmentReq, converted.err
+		}
+	}
+	return convertToAugmentRequest(c, req, requestAPIKey(c))
+}
+
+// ResponseCacheHit 判断当前请求是否命中响应缓存
+func ResponseCacheHit(c *gin.Context) bool {
+	_, exists := c.Get("response_cache")
+	return exists
+}
+
+// responseCacheTTL 按API Key、模型、全局配置的顺序确定缓存有效期，不大于0时不缓存
+func responseCacheTTL(c *gin.Context, apiKey config.APIKey, model string) time.Duration {
+	if apiKey.CacheTTL != 0 {
+		return time.Duration(apiKey.CacheTTL) * time.Second
+	}
+	if modelConfig, err := requestModel(c, model); err == nil && modelConfig.CacheTTL != 0 {
+		return time.Duration(modelConfig.CacheTTL) * time.Second
+	}
+	return config.AppConfig.ResponseCacheTTL
+}
+
+// responseCacheKey 计算API Key和规范化后的Augment请求的哈希，忽略每次请求都会重新生成的ID
+// 不同API Key的缓存互相隔离，一个Key的回复不会返回给另一个Key
+func responseCacheKey(apiKey string, augmentReq AugmentRequest) string {
+	normalized := augmentReq
+	normalized.Blobs.CheckpointID = ""
+	normalized.ChatHistory = make([]AugmentChatHistory, len(augmentReq.ChatHistory))
+	for i, history := range augmentReq.ChatHistory {
+		history.RequestID = ""
+		normalized.ChatHistory[i] = history
+	}
+
+	data, _ := json.Marshal(normalized)
+	hash := sha256.New()
+	hash.Write([]byte(apiKey))
+	hash.Write([]byte{0})
+	hash.Write(data)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func loadResponseCache(key string) (*cachedResponse, bool) {
+	data, err := config.RedisGet(responseCachePrefix + key)
+	if err != nil {
+		return nil, false
+	}
+	var cached cachedResponse
+	if err := json.Unmarshal([]byte(data), &cached); err != nil || len(cached.Responses) == 0 {
+		return nil, false
+	}
+	return &cached, true
+}
+
+// cachedResponses 获取命中缓存时需要重放的上游响应
+func cachedResponses(c *gin.Context) ([]AugmentResponse, bool) {
+	value, exists := c.Get("response_cache")
+	if !exists {
+		return nil, false
+	}
+	cached, ok := value.(*cachedResponse)
+	if !ok {
+		return nil, false
+	}
+	return cached.Responses, true
+}
+
+// storeResponseCache 上游正常完成后异步写入缓存，请求未启用缓存时不做任何处理
+func storeResponseCache(c *gin.Context, model string, responses []AugmentResponse) {
+	key := c.GetString("response_cache_key")
+	ttl := c.GetDuration("response_cache_ttl")
+	if key == "" || ttl <= 0 || len(responses) == 0 {
+		return
+	}
+
+	go func() {
+		data, err := json.Marshal(cachedResponse{
+			Model:     model,
+			Responses: responses,
+			CreatedAt: time.Now().Unix(),
+		})
+		if err != nil {
+			return
+		}
+		if err := config.RedisSet(responseCachePrefix+key, string(data), ttl); err != nil {
+			logger.Log.WithFields(logrus.Fields{
+				"key":   key,
+				"error": err.Error(),
+			}).Error("写入响应缓存失败")
+		}
+	}()
+}
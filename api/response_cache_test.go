@@ -0,0 +1,115 @@
+package api
+
+import (
+	"augment2api/config"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// waitForCacheEntries 等待异步写入的响应缓存条目数量达到count
+func waitForCacheEntries(t *testing.T, count int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if keys, _ := config.RedisKeys(responseCachePrefix + "*"); len(keys) >= count {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("响应缓存条目未达到%d条", count)
+}
+
+func TestResponseCacheMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	fake := newFakeRedis(t)
+	previous := config.AppConfig
+	config.AppConfig.ResponseCacheEnabled = true
+	config.AppConfig.ResponseCacheTTL = time.Minute
+	t.Cleanup(func() { config.AppConfig = previous })
+	if err := config.SetModelConfig(suffixModelConfig("augment-chat")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 处理函数命中缓存时重放缓存的回复，未命中时模拟上游回复并写入缓存
+	upstreamCalls := 0
+	router := gin.New()
+	router.POST("/v1/chat/completions", func(c *gin.Context) {
+		c.Set("api_key", config.APIKey{Key: c.GetHeader("Authorization")})
+	}, ResponseCacheMiddleware(), func(c *gin.Context) {
+		if responses, ok := cachedResponses(c); ok {
+			c.String(http.StatusOK, responses[0].Text)
+			return
+		}
+		upstreamCalls++
+		text := fmt.Sprintf("reply %d", upstreamCalls)
+		storeResponseCache(c, "augment-chat", []AugmentResponse{{Text: text, Done: true}})
+		c.String(http.StatusOK, text)
+	})
+
+	steps := []struct {
+		name    string
+		apiKey  string
+		message string
+		advance time.Duration
+		cache   string
+		body    string
+	}{
+		{name: "first request misses", apiKey: "key-a", message: "hi", cache: "MISS", body: "reply 1"},
+		{name: "same request hits", apiKey: "key-a", message: "hi", cache: "HIT", body: "reply 1"},
+		{name: "other API key misses", apiKey: "key-b", message: "hi", cache: "MISS", body: "reply 2"},
+		{name: "other API key hits its own entry", apiKey: "key-b", message: "hi", cache: "HIT", body: "reply 2"},
+		{name: "other message misses", apiKey: "key-a", message: "hello", cache: "MISS", body: "reply 3"},
+		{name: "expired entry misses", apiKey: "key-a", message: "hi", advance: time.Minute, cache: "MISS", body: "reply 4"},
+	}
+
+	entries := 0
+	for _, step := range steps {
+		if step.advance > 0 {
+			// 之前的条目都已过期
+			fake.advance(step.advance)
+			entries = 0
+		}
+
+		body := fmt.Sprintf(`{"model":"augment-chat","messages":[{"role":"user","content":%q}]}`, step.message)
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+		req.Header.Set("Authorization", step.apiKey)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if cache := w.Header().Get("X-Cache"); cache != step.cache {
+			t.Errorf("%s: X-Cache = %q, want %q", step.name, cache, step.cache)
+		}
+		if w.Body.String() != step.body {
+			t.Errorf("%s: body = %q, want %q", step.name, w.Body.String(), step.body)
+		}
+		if step.cache == "MISS" {
+			entries++
+			waitForCacheEntries(t, entries)
+		}
+	}
+}
+
+func TestResponseCacheKey(t *testing.T) {
+	augmentReq := newAugmentRequest("CHAT", "", "")
+	augmentReq.Message = "hi"
+	augmentReq.ChatHistory = []AugmentChatHistory{{RequestMessage: "a", ResponseText: "b", RequestID: "req-1"}}
+
+	// 每次请求重新生成的ID不影响缓存键
+	regenerated := augmentReq
+	regenerated.ChatHistory = []AugmentChatHistory{{RequestMessage: "a", ResponseText: "b", RequestID: "req-2"}}
+	if responseCacheKey("key-a", augmentReq) != responseCacheKey("key-a", regenerated) {
+		t.Error("请求ID不同时缓存键不同")
+	}
+	if responseCacheKey("key-a", augmentReq) == responseCacheKey("key-b", augmentReq) {
+		t.Error("不同API Key的缓存键相同")
+	}
+	if responseCacheKey("", augmentReq) == responseCacheKey("key-a", augmentReq) {
+		t.Error("未使用API Key的请求与API Key请求的缓存键相同")
+	}
+}
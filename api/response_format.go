@@ -0,0 +1,322 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// ResponseFormat OpenAI兼容的response_format参数
+type ResponseFormat struct {
+	Type       string            `json:"type"` // text、json_object 或 json_schema
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+// JSONSchemaFormat json_schema类型的schema定义
+type JSONSchemaFormat struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+const (
+	// 要求只输出JSON对象的指令
+	jsonObjectInstruction = "Respond with a single valid JSON object only. Do not wrap it in markdown code fences and do not add any text before or after it."
+	// 要求输出符合schema的JSON的指令，参数依次为schema名称和schema内容
+	jsonSchemaInstruction = "Respond with a single JSON value that conforms to the JSON schema named %q below. Do not wrap it in markdown code fences and do not add any text before or after it.\nSchema:\n%s"
+	// 校验失败后重新请求的指令，参数为校验错误
+	jsonRetryInstruction = "Your previous reply was rejected because it is not valid: %s\nReply again with only the corrected JSON, without markdown code fences or any other text."
+)
+
+// responseFormatSpec 解析后的结构化输出要求
+type responseFormatSpec struct {
+	name   string
+	schema map[string]interface{} // 为nil时只要求JSON对象
+	raw    string
+}
+
+// parseResponseFormat 解析并检查response_format，text或未设置时返回nil
+func parseResponseFormat(format *ResponseFormat) (*responseFormatSpec, error) {
+	if format == nil || format.Type == "" || format.Type == "text" {
+		return nil, nil
+	}
+
+	switch format.Type {
+	case "json_object":
+		return &responseFormatSpec{}, nil
+	case "json_schema":
+		if format.JSONSchema == nil || len(format.JSONSchema.Schema) == 0 {
+			return nil, fmt.Errorf("response_format.json_schema.schema不能为空")
+		}
+		var schema map[string]interface{}
+		if err := json.Unmarshal(format.JSONSchema.Schema, &schema); err != nil {
+			return nil, fmt.Errorf("response_format.json_schema.schema不是有效的JSON对象: %v", err)
+		}
+		if err := checkSchemaRefs(schema); err != nil {
+			return nil, fmt.Errorf("response_format.json_schema.schema无效: %v", err)
+		}
+		return &responseFormatSpec{
+			name:   format.JSONSchema.Name,
+			schema: schema,
+			raw:    compactJSON(schema),
+		}, nil
+	default:
+		return nil, fmt.Errorf("不支持的response_format类型: %s", format.Type)
+	}
+}
+
+// instruction 追加到用户消息后的格式要求
+func (s *responseFormatSpec) instruction() string {
+	if s.schema == nil {
+		return jsonObjectInstruction
+	}
+	return fmt.Sprintf(jsonSchemaInstruction, s.name, s.raw)
+}
+
+// validate 从模型输出中取出JSON并校验，返回去掉代码块后的JSON文本
+func (s *responseFormatSpec) validate(text string) (string, error) {
+	content := stripCodeFence(strings.TrimSpace(text))
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(content), &value); err != nil {
+		return "", fmt.Errorf("the reply is not valid JSON (%v)", err)
+	}
+
+	if s.schema == nil {
+		if _, ok := value.(map[string]interface{}); !ok {
+			return "", fmt.Errorf("the reply must be a JSON object, got %s", jsonType(value))
+		}
+		return content, nil
+	}
+
+	if err := validateJSONSchema(value, s.schema); err != nil {
+		return "", err
+	}
+	return content, nil
+}
+
+// stripCodeFence 去掉包裹整个回复的markdown代码块
+func stripCodeFence(text string) string {
+	if !strings.HasPrefix(text, "```") || !strings.HasSuffix(text, "```") || len(text) < 6 {
+		return text
+	}
+	body := strings.TrimSuffix(text[3:], "```")
+	// 去掉代码块语言标记，如```json
+	if newline := strings.IndexByte(body, '\n'); newline >= 0 {
+		body = body[newline+1:]
+	}
+	return strings.TrimSpace(body)
+}
+
+// compactJSON 将数据序列化为紧凑的JSON文本
+func compactJSON(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(data)
+}
+
+// responseFormatRetries 校验失败后重新请求的最大次数
+func responseFormatRetries() int {
+	if config.AppConfig.ResponseFormatRetries < 0 {
+		return 0
+	}
+	return config.AppConfig.ResponseFormatRetries
+}
+
+// writeOpenAIError 返回OpenAI格式的错误
+func writeOpenAIError(c *gin.Context, status int, message, errType, param, code string) {
+	errBody := gin.H{
+		"message": message,
+		"type":    errType,
+		"param":   nil,
+		"code":    nil,
+	}
+	if param != "" {
+		errBody["param"] = param
+	}
+	if code != "" {
+		errBody["code"] = code
+	}
+	// 流式响应已发送过心跳时只能以SSE事件返回
+	if c.Writer.Written() {
+		writeSSEData(c, gin.H{"error": errBody})
+		return
+	}
+	c.JSON(status, gin.H{"error": errBody})
+}
+
+// retryStructuredRequest 将上一次的回复加入历史，并要求模型按校验错误修正输出
+func retryStructuredRequest(augmentReq AugmentRequest, reply string, validationErr error) AugmentRequest {
+	retryReq := augmentReq
+	retryReq.ChatHistory = append(append([]AugmentChatHistory{}, augmentReq.ChatHistory...), AugmentChatHistory{
+		RequestMessage: augmentReq.Message,
+		ResponseText:   reply,
+		RequestID:      generateRequestID(),
+		RequestNodes:   augmentReq.Nodes,
+		ResponseNodes: []Node{
+			{
+				ID:      0,
+				Type:    responseNodeTypeRawResponse,
+				Content: reply,
+			},
+		},
+	})
+	retryReq.Nodes = make([]Node, 0)
+	retryReq.Message = fmt.Sprintf(jsonRetryInstruction, validationErr)
+	return retryReq
+}
+
+// handleStructuredRequest 处理带response_format的聊天请求
+// 需要完整输出才能校验，因此流式请求也会先收集完整回复，校验通过后再一次性以流式格式返回
+func handleStructuredRequest(c *gin.Context, req OpenAIRequest, augmentReq AugmentRequest, spec *responseFormatSpec) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Log.WithFields(logrus.Fields{
+				"error": r,
+				"model": req.Model,
+			}).Error("处理结构化输出请求时发生panic")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器内部错误"})
+		}
+		// 函数返回时同步清理请求状态
+		cleanupRequestStatus(c)
+	}()
+
+	token, tenant := getRequestToken(c)
+	if token == "" || tenant == "" {
+		writeOpenAIError(c, http.StatusUnauthorized, "无可用Token,请先在管理页面获取", "authentication_error", "", "")
+		return
+	}
+
+	augmentReq.Message = strings.TrimSpace(augmentReq.Message + "\n\n" + spec.instruction())
+
+	// 流式请求在收集和校验完整回复期间发送心跳
+	if req.Stream {
+		if flusher, ok := c.Writer.(http.Flusher); ok {
+			setStreamKeepalive(c, func() { writeSSEPing(c, flusher) })
+		}
+	}
+
+	var usage Usage
+	var lastErr error
+	attemptReq := augmentReq
+	for attempt := 0; attempt <= responseFormatRetries(); attempt++ {
+		// 每次请求都计入token使用次数
+		asyncIncrementTokenUsage(c, token, req.Model)
+
+		var output strings.Builder
+		toolCalls := newToolCallCollector()
+		var upstreamErr *upstreamError
+		token, upstreamErr = forwardWithFailover(c, req.Model, attemptReq, func(augmentResp AugmentResponse) bool {
+			output.WriteString(augmentResp.Text)
+			toolCalls.collect(augmentResp.Nodes)
+			return !augmentResp.Done
+		})
+		if upstreamErr != nil && upstreamErr.Kind == upstreamCancelled {
+			handleClientCancel(c, token)
+			return
+		}
+		if upstreamErr != nil {
+			writeOpenAIError(c, upstreamErr.StatusCode, upstreamErr.Message, "upstream_error", "", "")
+			return
+		}
+
+		reply := output.String()
+		attemptUsage := chatUsage(attemptReq, reply)
+		asyncRecordTokenCounts(c, token, attemptUsage)
+		usage = newUsage(usage.PromptTokens+attemptUsage.PromptTokens, usage.CompletionTokens+attemptUsage.CompletionTokens)
+
+		// 模型调用工具时不校验内容，由客户端执行工具后继续对话
+		if len(toolCalls.calls) > 0 {
+			writeStructuredResponse(c, req, reply, toolCalls, usage)
+			return
+		}
+
+		content, err := spec.validate(reply)
+		if err == nil {
+			writeStructuredResponse(c, req, content, toolCalls, usage)
+			return
+		}
+
+		lastErr = err
+		logger.Log.WithFields(logrus.Fields{
+			"model":   req.Model,
+			"attempt": attempt + 1,
+			"error":   err.Error(),
+		}).Warn("模型输出未通过JSON校验，重新请求")
+		attemptReq = retryStructuredRequest(attemptReq, reply, err)
+	}
+
+	writeOpenAIError(c, http.StatusBadGateway,
+		fmt.Sprintf("模型输出在%d次尝试后仍未通过response_format校验: %v", responseFormatRetries()+1, lastErr),
+		"invalid_response_error", "response_format", "response_format_validation_failed")
+}
+
+// writeStructuredResponse 以流式或非流式格式返回校验后的回复
+func writeStructuredResponse(c *gin.Context, req OpenAIRequest, content string, toolCalls *toolCallCollector, usage Usage) {
+	saveConversationReply(c, ChatMessage{Role: "assistant", Content: content, ToolCalls: toolCalls.messageToolCalls()})
+
+	responseID := fmt.Sprintf("chatcmpl-%d", time.Now().Unix())
+	finishReason := toolCalls.finishReason()
+
+	if !req.Stream {
+		c.JSON(http.StatusOK, OpenAIResponse{
+			ID:      responseID,
+			Object:  "chat.completion",
+			Created: time.Now().Unix(),
+			Model:   req.Model,
+			Choices: []Choice{
+				{
+					Index: 0,
+					Message: ChatMessage{
+						Role:      "assistant",
+						Content:   content,
+						ToolCalls: toolCalls.messageToolCalls(),
+					},
+					FinishReason: &finishReason,
+				},
+			},
+			Usage: usage,
+		})
+		return
+	}
+
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "流式传输不支持"})
+		return
+	}
+	setSSEHeaders(c)
+
+	streamResp := OpenAIStreamResponse{
+		ID:      responseID,
+		Object:  "chat.completion.chunk",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+		Choices: []StreamChoice{
+			{
+				Index:        0,
+				Delta:        streamDelta(content, toolCalls.calls),
+				FinishReason: &finishReason,
+			},
+		},
+	}
+	if jsonResp, err := json.Marshal(streamResp); err == nil {
+		fmt.Fprintf(c.Writer, "data: %s\n\n", jsonResp)
+	}
+
+	var streamUsage *Usage
+	if req.StreamOptions != nil && req.StreamOptions.IncludeUsage {
+		streamUsage = &usage
+	}
+	writeStreamDone(c, flusher, responseID, req.Model, streamUsage)
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"augment2api/config"
+	"context"
+	"math/rand"
+	"time"
+)
+
+// retryableError 判断错误是否可以按重试策略在稍后重试：连接失败、读取失败或配置的状态码
+func retryableError(policy config.RetryPolicy, err *upstreamError) bool {
+	switch err.Kind {
+	case upstreamRequestFailed, upstreamReadFailed:
+		return true
+	case upstreamStatusError:
+		return policy.RetryableStatus(err.StatusCode)
+	}
+	return false
+}
+
+// retryBackoff 第n次重试前的等待时间：基础时间按次数翻倍并受上限限制，取其一半加上随机抖动
+func retryBackoff(policy config.RetryPolicy, retry int) time.Duration {
+	backoff := policy.BackoffBase
+	for i := 1; i < retry && backoff < policy.BackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > policy.BackoffMax {
+		backoff = policy.BackoffMax
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(backoff-half)+1))
+}
+
+// sleepContext 等待指定时间，ctx取消时提前返回false
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
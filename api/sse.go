@@ -0,0 +1,121 @@
+package api
+
+import (
+	"augment2api/config"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setSSEHeaders 设置SSE响应头，需在写入响应体前调用
+func setSSEHeaders(c *gin.Context) {
+	c.Writer.Header().Set("Content-Type", "text/event-stream")
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("Connection", "keep-alive")
+}
+
+// writeSSEPing 发送SSE注释行作为心跳，客户端解析时会忽略该行
+// 首次写入时设置SSE响应头，此后响应状态码固定为200，错误只能以SSE事件返回
+func writeSSEPing(c *gin.Context, flusher http.Flusher) {
+	if !c.Writer.Written() {
+		setSSEHeaders(c)
+	}
+	fmt.Fprint(c.Writer, ": ping\n\n")
+	flusher.Flush()
+}
+
+// writeSSEData 以data事件写入JSON
+func writeSSEData(c *gin.Context, data interface{}) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(c.Writer, "data: %s\n\n", jsonData)
+	c.Writer.Flush()
+}
+
+// writeStreamError 返回流式请求的错误：尚未写入响应时返回JSON错误，
+// 已发送过心跳时以OpenAI流式错误事件返回
+func writeStreamError(c *gin.Context, status int, message string) {
+	if !c.Writer.Written() {
+		c.JSON(status, gin.H{"error": message})
+		return
+	}
+	writeSSEData(c, gin.H{"error": gin.H{"message": message, "type": "upstream_error", "code": status}})
+}
+
+// setStreamKeepalive 为流式请求注册心跳写入函数，等待上游输出期间按stream_heartbeat_seconds调用
+func setStreamKeepalive(c *gin.Context, ping func()) {
+	c.Set("stream_keepalive", ping)
+}
+
+// streamHeartbeat 在请求处理的goroutine中按间隔发送心跳，避免与响应写入并发
+type streamHeartbeat struct {
+	interval time.Duration
+	ticker   *time.Ticker
+	ping     func()
+}
+
+// newStreamHeartbeat 请求未注册心跳或未启用心跳时返回nil，nil值的各方法均可安全调用
+func newStreamHeartbeat(c *gin.Context) *streamHeartbeat {
+	interval := config.AppConfig.StreamHeartbeat
+	value, exists := c.Get("stream_keepalive")
+	if !exists || interval <= 0 {
+		return nil
+	}
+	ping, ok := value.(func())
+	if !ok {
+		return nil
+	}
+	return &streamHeartbeat{interval: interval, ticker: time.NewTicker(interval), ping: ping}
+}
+
+// C 到达心跳时间时可读，未启用心跳时返回nil通道
+func (h *streamHeartbeat) C() <-chan time.Time {
+	if h == nil {
+		return nil
+	}
+	return h.ticker.C
+}
+
+func (h *streamHeartbeat) beat() {
+	if h != nil {
+		h.ping()
+	}
+}
+
+// delay 收到上游输出后重新计时
+func (h *streamHeartbeat) delay() {
+	if h != nil {
+		h.ticker.Reset(h.interval)
+	}
+}
+
+func (h *streamHeartbeat) stop() {
+	if h != nil {
+		h.ticker.Stop()
+	}
+}
+
+// sleep 与sleepContext相同，等待期间继续发送心跳
+func (h *streamHeartbeat) sleep(ctx context.Context, d time.Duration) bool {
+	if h == nil || d <= 0 {
+		return sleepContext(ctx, d)
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case <-h.ticker.C:
+			h.ping()
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
@@ -240,8 +240,10 @@ func getCategoryFromKey(key string) string {
 		return "usage"
 	} else if strings.HasPrefix(key, "token_request_status:") {
 		return "status"
-	} else if strings.HasPrefix(key, "token_usage") {
+	} else if strings.HasPrefix(key, "token_usage") || strings.HasPrefix(key, "token_tokens:") || strings.HasPrefix(key, "api_key_usage:") || strings.HasPrefix(key, "token_outcomes:") || strings.HasPrefix(key, "token_latency:") {
 		return "usage_stats"
+	} else if strings.HasPrefix(key, "response_cache:") {
+		return "cache"
 	}
 	return "other"
 }
@@ -256,6 +258,22 @@ func getKeyDescription(key string) string {
 		"token_usage:":          "Token总使用次数",
 		"token_usage_chat:":     "Token CHAT模式使用次数",
 		"token_usage_agent:":    "Token AGENT模式使用次数",
+		"token_tokens:":         "Token的token用量统计",
+		"token_outcomes:":       "Token请求结果统计",
+		"api_key:":              "下游API Key配置",
+		"api_key_usage:":        "下游API Key的token用量统计",
+		"response_cache:":       "聊天响应缓存",
+		"conversation:":         "服务端对话历史",
+		"token_affinity:":       "对话与token的绑定关系",
+		"agent_memories:":       "下游API Key的Agent记忆",
+		"file:":                 "上传的上下文文件",
+		"file_content:":         "上传的上下文文件内容",
+		"files:":                "下游API Key上传的文件索引",
+		"tenant_blobs:":         "已上传到租户的文件blob",
+		"token_latency:":        "Token上游响应延迟",
+		"token_selection:":      "Token选择策略状态",
+		"token_pool:":           "Token池配置",
+		"token_pool_tokens:":    "Token池中的token",
 	}
 
 	for prefix, desc := range descriptions {
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// 对话与token的绑定关系键前缀，值为token，过期时间为token_affinity_ttl_seconds，每次使用后重新计算
+const tokenAffinityPrefix = "token_affinity:"
+
+// SelectPoolToken 按API Key所属token池的选择策略为请求从池中选择token，未指定池时从全部token中按全局策略选择
+// 启用token亲和时，同一对话优先使用上次分配的token；该token被禁用、在冷却中或超过使用限制时，
+// 重新从token池中选择并更新绑定。token正在被其他请求使用时仍然使用该token，由租约等待其空闲
+func SelectPoolToken(c *gin.Context) (string, string) {
+	if !config.AppConfig.TokenAffinityEnabled {
+		return getAvailableTokenExcluding(nil, requestTokenPool(c))
+	}
+	key := affinityKey(c)
+	if key == "" {
+		return getAvailableTokenExcluding(nil, requestTokenPool(c))
+	}
+	c.Set("token_affinity", key)
+
+	if token, err := config.RedisGet(tokenAffinityPrefix + key); err == nil {
+		tenantURL, inCool, ok := tokenEligibility(token, false)
+		if ok && !inCool {
+			if err := config.RedisExpire(tokenAffinityPrefix+key, config.AppConfig.TokenAffinityTTL); err != nil {
+				logger.Log.WithFields(logrus.Fields{
+					"error": err.Error(),
+				}).Warn("刷新token亲和过期时间失败")
+			}
+			return token, tenantURL
+		}
+		logger.Log.WithFields(logrus.Fields{
+			"token":   token,
+			"cooling": inCool,
+		}).Info("对话绑定的token不可用，重新从token池分配")
+	}
+
+	token, tenantURL := getAvailableTokenExcluding(nil, requestTokenPool(c))
+	if tenantURL != "" {
+		bindTokenAffinity(c, token)
+	}
+	return token, tenantURL
+}
+
+// bindTokenAffinity 将当前请求的对话绑定到token，请求未启用token亲和时不做任何处理
+func bindTokenAffinity(c *gin.Context, token string) {
+	key := c.GetString("token_affinity")
+	if key == "" {
+		return
+	}
+	if err := config.RedisSet(tokenAffinityPrefix+key, token, config.AppConfig.TokenAffinityTTL); err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"token": token,
+			"error": err.Error(),
+		}).Error("保存token亲和失败")
+	}
+}
+
+// affinityKey 计算请求所属对话的键，不同下游API Key的对话互不影响
+// 优先使用X-Conversation-ID请求头或请求体中的conversation_id；否则使用system消息和第一条用户消息（含之前的消息）的哈希，
+// 这部分内容在多轮对话中保持不变。无法确定对话时返回空字符串
+func affinityKey(c *gin.Context) string {
+	scope := requestAPIKey(c).Key
+	if id := strings.TrimSpace(c.GetHeader("X-Conversation-ID")); id != "" {
+		return hashAffinity(scope, "conversation", id)
+	}
+
+	// 读取请求体后重新放回，供处理函数解析
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return ""
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	var payload struct {
+		ConversationID string            `json:"conversation_id"`
+		System         json.RawMessage   `json:"system"` // Anthropic请求的system字段
+		Messages       []json.RawMessage `json:"messages"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return ""
+	}
+	if payload.ConversationID != "" {
+		return hashAffinity(scope, "conversation", payload.ConversationID)
+	}
+
+	parts := []string{string(payload.System)}
+	for _, raw := range payload.Messages {
+		parts = append(parts, string(raw))
+		var msg struct {
+			Role string `json:"role"`
+		}
+		if json.Unmarshal(raw, &msg) == nil && msg.Role == "user" {
+			return hashAffinity(scope, append([]string{"messages"}, parts...)...)
+		}
+	}
+	return ""
+}
+
+func hashAffinity(scope string, parts ...string) string {
+	hash := sha256.New()
+	hash.Write([]byte(scope))
+	for _, part := range parts {
+		hash.Write([]byte{0})
+		hash.Write([]byte(part))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -4,10 +4,10 @@ import (
 	"augment2api/config"
 	"augment2api/pkg/logger"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"math/rand"
 	"net/http"
 	"sort"
 	"strconv"
@@ -38,6 +38,9 @@ type TokenInfo struct {
 	AgentLimit      int       `json:"agent_limit"`        // AGENT模式调用上限
 	DailyLimit      int       `json:"daily_limit"`        // 每日总调用上限
 	DailyUsage      int       `json:"daily_usage"`        // 今日已使用次数
+	Pool            string    `json:"pool"`               // 所属token池，为空表示未分组
+
+	Outcomes map[string]int `json:"outcomes"` // 请求结果统计，如cancelled次数
 }
 
 // TokenItem token项结构
@@ -151,6 +154,7 @@ func GetRedisTokenHandler(c *gin.Context) {
 			agentLimit := getTokenAgentLimit(tokenValue)
 			dailyLimit := getTokenDailyLimit(tokenValue)
 			dailyUsage := getTokenDailyUsage(tokenValue)
+			outcomes := getTokenOutcomes(tokenValue)
 
 			// 构建token信息并发送到channel
 			tokenListChan <- TokenInfo{
@@ -168,6 +172,8 @@ func GetRedisTokenHandler(c *gin.Context) {
 				AgentLimit:      agentLimit,
 				DailyLimit:      dailyLimit,
 				DailyUsage:      dailyUsage,
+				Pool:            fields["pool"],
+				Outcomes:        outcomes,
 			}
 		}(key, token)
 	}
@@ -312,6 +318,11 @@ func DeleteTokenHandler(c *gin.Context) {
 		return
 	}
 
+	// 移出所属的token池
+	if pool, err := config.RedisHGet(tokenKey, "pool"); err == nil && pool != "" {
+		config.RemoveTokenPoolToken(pool, token)
+	}
+
 	// 删除token
 	if err := config.RedisDel(tokenKey); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -355,6 +366,27 @@ func DeleteTokenHandler(c *gin.Context) {
 		config.RedisDel(tokenAgentUsageKey)
 	}
 
+	// 删除token用量统计
+	tokenCountsKey := tokenCountsPrefix + token
+	exists, err = config.RedisExists(tokenCountsKey)
+	if err == nil && exists {
+		config.RedisDel(tokenCountsKey)
+	}
+
+	// 删除请求结果统计
+	tokenOutcomesKey := tokenOutcomesPrefix + token
+	exists, err = config.RedisExists(tokenOutcomesKey)
+	if err == nil && exists {
+		config.RedisDel(tokenOutcomesKey)
+	}
+
+	// 删除上游延迟记录
+	tokenLatencyKey := tokenLatencyPrefix + token
+	exists, err = config.RedisExists(tokenLatencyKey)
+	if err == nil && exists {
+		config.RedisDel(tokenLatencyKey)
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"status": "success",
 	})
@@ -415,6 +447,9 @@ func AddTokenHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, result)
 }
 
+// 检测单个租户地址的超时时间
+const tenantCheckTimeout = 30 * time.Second
+
 // CheckTokenTenantURL 检测token的租户地址
 func CheckTokenTenantURL(token string) (string, error) {
 	// 构建测试消息
@@ -437,11 +472,6 @@ func CheckTokenTenantURL(token string) (string, error) {
 		},
 	}
 
-	jsonData, err := json.Marshal(testMsg)
-	if err != nil {
-		return "", fmt.Errorf("序列化测试消息失败: %v", err)
-	}
-
 	tokenKey := "token:" + token
 
 	currentTenantURL, err := config.RedisHGet(tokenKey, "tenant_url")
@@ -483,28 +513,18 @@ func CheckTokenTenantURL(token string) (string, error) {
 
 	// 测试租户地址
 	for _, tenantURL := range tenantURLsToTest {
-		// 创建请求
-		req, err := http.NewRequest("POST", tenantURL+"chat-stream", bytes.NewReader(jsonData))
-		if err != nil {
-			continue
-		}
-
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", "Bearer "+token)
-		req.Header.Set("User-Agent", "augment.intellij/0.160.0 (Mac OS X; aarch64; 15.2) WebStorm/2024.3.5")
-		req.Header.Set("x-api-version", "2")
-		req.Header.Set("x-request-id", uuid.New().String())
-		req.Header.Set("x-request-session-id", uuid.New().String())
-
-		client := createHTTPClient()
-		resp, err := client.Do(req)
+		client := NewAugmentClient(token, tenantURL)
+		ctx, cancel := context.WithTimeout(context.Background(), tenantCheckTimeout)
+		resp, err := client.post(ctx, "chat-stream", testMsg, uuid.New().String(), uuid.New().String())
 		if err != nil {
+			cancel()
 			fmt.Printf("请求失败: %v\n", err)
 			continue
 		}
 
 		isInvalid := false
 		func() {
+			defer cancel()
 			defer resp.Body.Close()
 
 			// 检查是否返回401状态码（未授权）
@@ -744,117 +764,151 @@ func GetTokenCoolStatus(token string) (TokenCoolStatus, error) {
 	return coolStatus, nil
 }
 
-// GetAvailableToken 获取一个可用的token（未在使用中且冷却时间已过）
+// GetAvailableToken 获取一个可用的token（未在使用中且冷却时间已过），从全部token中按全局配置的选择策略选择
 func GetAvailableToken() (string, string) {
-	// 获取所有token的key
-	keys, err := config.RedisKeys("token:*")
-	if err != nil || len(keys) == 0 {
+	return getAvailableTokenExcluding(nil, config.TokenPool{})
+}
+
+// getAvailableTokenExcluding 按token池的选择策略从池中获取一个可用的token，跳过exclude中的token。
+// pool名称为空时从全部token中按全局配置的策略选择
+func getAvailableTokenExcluding(exclude map[string]bool, pool config.TokenPool) (string, string) {
+	tokens, err := poolTokens(pool.Name)
+	if err != nil || len(tokens) == 0 {
 		return "No token", ""
 	}
+	strategy := selectionStrategy(pool.SelectionStrategy)
 
 	// 筛选可用的token
-	var availableTokens []string
-	var availableTenantURLs []string
-	var cooldownTokens []string
-	var cooldownTenantURLs []string
+	var available []tokenCandidate
+	var cooldown []tokenCandidate
 
-	for _, key := range keys {
-		// 获取token状态
-		status, err := config.RedisHGet(key, "status")
-		if err == nil && status == "disabled" {
-			continue // 跳过被标记为不可用的token
+	for _, token := range tokens {
+		if exclude[token] {
+			continue
 		}
 
-		// 从key中提取token
-		token := key[6:] // 去掉前缀 "token:"
+		tenantURL, inCool, ok := tokenEligibility(token, true)
+		if !ok {
+			continue
+		}
 
-		// 检查token是否启用
-		if !getTokenEnabled(token) {
-			continue // 跳过被禁用的token
+		// 如果token在冷却中，放入冷却队列，否则放入可用队列
+		candidate := tokenCandidate{Token: token, TenantURL: tenantURL}
+		if inCool {
+			cooldown = append(cooldown, candidate)
+		} else {
+			available = append(available, candidate)
 		}
+	}
+
+	// 优先从可用队列中选择token
+	if len(available) > 0 {
+		selected := available[strategy.Select(available)]
+		return selected.Token, selected.TenantURL
+	}
+
+	// 如果没有非冷却token可用，则从冷却队列中选择
+	if len(cooldown) > 0 {
+		selected := cooldown[strategy.Select(cooldown)]
+		return selected.Token, selected.TenantURL
+	}
+
+	// 如果没有任何可用的token
+	return "No available token", ""
+}
 
+// poolTokens 获取token池中的token，名称为空时获取全部token
+func poolTokens(name string) ([]string, error) {
+	if name != "" {
+		return config.GetTokenPoolTokens(name)
+	}
+
+	// 获取所有token的key
+	keys, err := config.RedisKeys("token:*")
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]string, len(keys))
+	for i, key := range keys {
+		tokens[i] = key[6:] // 去掉前缀 "token:"
+	}
+	return tokens, nil
+}
+
+// tokenEligibility 检查token能否分配给请求：未被标记为不可用、已启用、未超过使用限制且有租户地址
+// requireIdle为true时还要求token未在使用中且距上次请求已超过请求间隔。返回租户地址和是否在冷却中
+func tokenEligibility(token string, requireIdle bool) (string, bool, bool) {
+	key := "token:" + token
+
+	// 获取token状态
+	status, err := config.RedisHGet(key, "status")
+	if err == nil && status == "disabled" {
+		return "", false, false // 跳过被标记为不可用的token
+	}
+
+	// 检查token是否启用
+	if !getTokenEnabled(token) {
+		return "", false, false // 跳过被禁用的token
+	}
+
+	if requireIdle {
 		// 获取token的请求状态
 		requestStatus, err := GetTokenRequestStatus(token)
 		if err != nil {
-			continue
+			return "", false, false
 		}
 
 		// 如果token正在使用中，跳过
 		if requestStatus.InProgress {
-			continue
+			return "", false, false
 		}
 
 		// 获取token的独立请求间隔
 		requestInterval := getTokenRequestInterval(token)
 		// 如果距离上次请求时间不足设定的间隔，跳过
 		if time.Since(requestStatus.LastRequestAt) < time.Duration(requestInterval)*time.Second {
-			continue
-		}
-
-		// 检查CHAT模式和AGENT模式的使用次数限制
-		chatUsageCount := getTokenChatUsageCount(token)
-		agentUsageCount := getTokenAgentUsageCount(token)
-
-		// 获取token的独立限制
-		chatLimit := getTokenChatLimit(token)
-		agentLimit := getTokenAgentLimit(token)
-		dailyLimit := getTokenDailyLimit(token)
-		dailyUsage := getTokenDailyUsage(token)
-
-		// 如果CHAT模式已达到限制，跳过
-		if chatUsageCount >= chatLimit {
-			continue
+			return "", false, false
 		}
+	}
 
-		// 如果AGENT模式已达到限制，跳过
-		if agentUsageCount >= agentLimit {
-			continue
-		}
+	// 检查CHAT模式和AGENT模式的使用次数限制
+	chatUsageCount := getTokenChatUsageCount(token)
+	agentUsageCount := getTokenAgentUsageCount(token)
 
-		// 如果每日使用已达到限制，跳过
-		if dailyUsage >= dailyLimit {
-			continue
-		}
+	// 获取token的独立限制
+	chatLimit := getTokenChatLimit(token)
+	agentLimit := getTokenAgentLimit(token)
+	dailyLimit := getTokenDailyLimit(token)
+	dailyUsage := getTokenDailyUsage(token)
 
-		// 获取对应的tenant_url
-		tenantURL, err := config.RedisHGet(key, "tenant_url")
-		if err != nil {
-			continue
-		}
+	// 如果CHAT模式已达到限制，跳过
+	if chatUsageCount >= chatLimit {
+		return "", false, false
+	}
 
-		// 检查token是否在冷却中
-		coolStatus, err := GetTokenCoolStatus(token)
-		if err != nil {
-			continue
-		}
+	// 如果AGENT模式已达到限制，跳过
+	if agentUsageCount >= agentLimit {
+		return "", false, false
+	}
 
-		// 如果token在冷却中，放入冷却队列
-		if coolStatus.InCool {
-			cooldownTokens = append(cooldownTokens, token)
-			cooldownTenantURLs = append(cooldownTenantURLs, tenantURL)
-		} else {
-			// 否则放入可用队列
-			availableTokens = append(availableTokens, token)
-			availableTenantURLs = append(availableTenantURLs, tenantURL)
-		}
+	// 如果每日使用已达到限制，跳过
+	if dailyUsage >= dailyLimit {
+		return "", false, false
 	}
 
-	// 优先从可用队列中选择token
-	if len(availableTokens) > 0 {
-		// 随机选择一个token
-		randomIndex := rand.Intn(len(availableTokens))
-		return availableTokens[randomIndex], availableTenantURLs[randomIndex]
+	// 获取对应的tenant_url
+	tenantURL, err := config.RedisHGet(key, "tenant_url")
+	if err != nil {
+		return "", false, false
 	}
 
-	// 如果没有非冷却token可用，则从冷却队列中选择
-	if len(cooldownTokens) > 0 {
-		// 随机选择一个token
-		randomIndex := rand.Intn(len(cooldownTokens))
-		return cooldownTokens[randomIndex], cooldownTenantURLs[randomIndex]
+	// 检查token是否在冷却中
+	coolStatus, err := GetTokenCoolStatus(token)
+	if err != nil {
+		return "", false, false
 	}
 
-	// 如果没有任何可用的token
-	return "No available token", ""
+	return tenantURL, coolStatus.InCool, true
 }
 
 // getTokenUsageCount 获取token的使用次数
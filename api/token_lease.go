@@ -0,0 +1,69 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// 全局锁映射，用于控制每个 token 的并发请求
+var (
+	tokenLocks      = make(map[string]*sync.Mutex)
+	tokenLocksGuard = sync.Mutex{}
+)
+
+// getTokenLock 获取指定 token 的锁
+func getTokenLock(token string) *sync.Mutex {
+	tokenLocksGuard.Lock()
+	defer tokenLocksGuard.Unlock()
+
+	if lock, exists := tokenLocks[token]; exists {
+		return lock
+	}
+
+	lock := &sync.Mutex{}
+	tokenLocks[token] = lock
+	return lock
+}
+
+// AcquireTokenLease 等待token空闲后加锁，并将其标记为请求中
+func AcquireTokenLease(token string) (*sync.Mutex, error) {
+	lock := getTokenLock(token)
+	lock.Lock()
+
+	if err := markTokenInProgress(token); err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// tryAcquireTokenLease 不等待，token正被其他请求使用时返回false
+func tryAcquireTokenLease(token string) (*sync.Mutex, bool) {
+	lock := getTokenLock(token)
+	if !lock.TryLock() {
+		return nil, false
+	}
+
+	if err := markTokenInProgress(token); err != nil {
+		lock.Unlock()
+		return nil, false
+	}
+	return lock, true
+}
+
+// ReleaseTokenLease 将token标记为请求完成并释放锁，无论状态是否更新成功都会释放锁
+func ReleaseTokenLease(token string, lock *sync.Mutex) error {
+	defer lock.Unlock()
+
+	return SetTokenRequestStatus(token, TokenRequestStatus{
+		InProgress:    false,
+		LastRequestAt: time.Now(),
+	})
+}
+
+func markTokenInProgress(token string) error {
+	return SetTokenRequestStatus(token, TokenRequestStatus{
+		InProgress:    true,
+		LastRequestAt: time.Now(),
+	})
+}
@@ -0,0 +1,289 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// TokenPoolRequest 创建/更新token池的请求结构，更新时未传的字段保持原值
+type TokenPoolRequest struct {
+	Name              string  `json:"name"`               // 创建时必填，更新时使用路径中的名称
+	SelectionStrategy *string `json:"selection_strategy"` // 为空时使用全局配置
+}
+
+// TokenPoolInfo token池配置及其中的token数量
+type TokenPoolInfo struct {
+	config.TokenPool
+	TokenCount int `json:"token_count"`
+}
+
+// GetTokenPools 获取所有token池配置
+func GetTokenPools(c *gin.Context) {
+	pools, err := config.GetAllTokenPools()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取token池失败: " + err.Error(),
+		})
+		return
+	}
+
+	infos := make([]TokenPoolInfo, 0, len(pools))
+	for _, pool := range pools {
+		tokens, _ := config.GetTokenPoolTokens(pool.Name)
+		infos = append(infos, TokenPoolInfo{TokenPool: pool, TokenCount: len(tokens)})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"pools":  infos,
+		"total":  len(infos),
+	})
+}
+
+// CreateTokenPool 创建token池
+func CreateTokenPool(c *gin.Context) {
+	var req TokenPoolRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "请求数据格式错误: " + err.Error(),
+		})
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" || strings.ContainsAny(name, ":*") {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "名称不能为空，且不能包含:或*",
+		})
+		return
+	}
+	if req.SelectionStrategy != nil && !validSelectionStrategy(*req.SelectionStrategy) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "无效的token选择策略: " + *req.SelectionStrategy,
+		})
+		return
+	}
+	if _, err := config.GetTokenPool(name); err == nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"status": "error",
+			"error":  fmt.Sprintf("token池 %s 已存在，请使用PUT /api/token-pools/%s更新", name, name),
+		})
+		return
+	}
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+	pool := config.TokenPool{
+		Name:      name,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if req.SelectionStrategy != nil {
+		pool.SelectionStrategy = *req.SelectionStrategy
+	}
+
+	if err := config.SetTokenPool(pool); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "保存token池失败: " + err.Error(),
+		})
+		return
+	}
+
+	logger.Log.WithFields(logrus.Fields{
+		"pool":     pool.Name,
+		"strategy": pool.SelectionStrategy,
+	}).Info("创建token池成功")
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"pool":   pool,
+	})
+}
+
+// UpdateTokenPool 更新token池的选择策略
+func UpdateTokenPool(c *gin.Context) {
+	pool, err := config.GetTokenPool(c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  "token池不存在",
+		})
+		return
+	}
+
+	var req TokenPoolRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "请求数据格式错误: " + err.Error(),
+		})
+		return
+	}
+	if req.SelectionStrategy != nil {
+		if !validSelectionStrategy(*req.SelectionStrategy) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "error",
+				"error":  "无效的token选择策略: " + *req.SelectionStrategy,
+			})
+			return
+		}
+		pool.SelectionStrategy = *req.SelectionStrategy
+	}
+	pool.UpdatedAt = time.Now().Format("2006-01-02 15:04:05")
+
+	if err := config.SetTokenPool(pool); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "更新token池失败: " + err.Error(),
+		})
+		return
+	}
+
+	logger.Log.WithFields(logrus.Fields{
+		"pool":     pool.Name,
+		"strategy": pool.SelectionStrategy,
+	}).Info("更新token池成功")
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"pool":   pool,
+	})
+}
+
+// DeleteTokenPool 删除token池，池中的token变为未分组。仍有API Key使用该池时拒绝删除
+func DeleteTokenPool(c *gin.Context) {
+	name := c.Param("name")
+	if _, err := config.GetTokenPool(name); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  "token池不存在",
+		})
+		return
+	}
+
+	apiKeys, err := config.GetAllAPIKeys()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取API Key失败: " + err.Error(),
+		})
+		return
+	}
+	for _, apiKey := range apiKeys {
+		if apiKey.Pool == name {
+			c.JSON(http.StatusConflict, gin.H{
+				"status": "error",
+				"error":  fmt.Sprintf("API Key %s 正在使用该token池", apiKey.Name),
+			})
+			return
+		}
+	}
+
+	tokens, err := config.GetTokenPoolTokens(name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取token池成员失败: " + err.Error(),
+		})
+		return
+	}
+	for _, token := range tokens {
+		config.RedisHDel("token:"+token, "pool")
+	}
+
+	if err := config.DeleteTokenPool(name); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "删除token池失败: " + err.Error(),
+		})
+		return
+	}
+
+	logger.Log.WithFields(logrus.Fields{
+		"pool":   name,
+		"tokens": len(tokens),
+	}).Info("删除token池成功")
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
+
+// UpdateTokenPoolAssignment 将token移入指定的token池，pool为空时移出所属的池
+func UpdateTokenPoolAssignment(c *gin.Context) {
+	token := c.Param("token")
+	var req struct {
+		Pool string `json:"pool"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "无效的请求数据",
+		})
+		return
+	}
+
+	tokenKey := "token:" + token
+	exists, err := config.RedisExists(tokenKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "检查token失败: " + err.Error(),
+		})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  "token不存在",
+		})
+		return
+	}
+	if req.Pool != "" {
+		if _, err := config.GetTokenPool(req.Pool); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "error",
+				"error":  "token池不存在: " + req.Pool,
+			})
+			return
+		}
+	}
+
+	// 一个token只属于一个池，先移出原来的池
+	if previous, err := config.RedisHGet(tokenKey, "pool"); err == nil && previous != "" && previous != req.Pool {
+		if err := config.RemoveTokenPoolToken(previous, token); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "error",
+				"error":  "移出原token池失败: " + err.Error(),
+			})
+			return
+		}
+	}
+
+	if req.Pool == "" {
+		err = config.RedisHDel(tokenKey, "pool")
+	} else if err = config.AddTokenPoolToken(req.Pool, token); err == nil {
+		err = config.RedisHSet(tokenKey, "pool", req.Pool)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "更新token池失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
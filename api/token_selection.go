@@ -0,0 +1,288 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"context"
+	"encoding/json"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// 轮询计数器键
+	roundRobinCounterKey = "token_selection:round_robin"
+	// token上游延迟键前缀，哈希表ewma_ms字段为首个响应延迟的指数移动平均值（毫秒）
+	tokenLatencyPrefix = "token_latency:"
+	// 延迟移动平均中新样本的权重
+	latencyEWMAWeight = 0.3
+)
+
+// tokenCandidate 可分配给请求的token
+type tokenCandidate struct {
+	Token     string
+	TenantURL string
+}
+
+// SelectionStrategy 从可用token中选择一个，返回其下标。candidates不为空
+type SelectionStrategy interface {
+	Select(candidates []tokenCandidate) int
+}
+
+// selectionStrategies 可选的token选择策略，token_selection_strategy和token池的selection_strategy使用这些名称
+var selectionStrategies = map[string]SelectionStrategy{
+	"random":           randomStrategy{},
+	"round_robin":      roundRobinStrategy{},
+	"lru":              leastRecentlyUsedStrategy{},
+	"least_used_today": leastUsedTodayStrategy{},
+	"weighted":         weightedQuotaStrategy{},
+	"latency":          latencyStrategy{},
+}
+
+// validSelectionStrategy 判断策略名称是否有效，空字符串表示使用全局配置
+func validSelectionStrategy(name string) bool {
+	if name == "" {
+		return true
+	}
+	_, exists := selectionStrategies[name]
+	return exists
+}
+
+// selectionStrategy 获取指定名称的策略，名称无效时使用全局配置，全局配置也无效时随机选择
+func selectionStrategy(name string) SelectionStrategy {
+	if strategy, exists := selectionStrategies[name]; exists {
+		return strategy
+	}
+	if strategy, exists := selectionStrategies[config.AppConfig.TokenSelectionStrategy]; exists {
+		return strategy
+	}
+	return randomStrategy{}
+}
+
+// requestTokenPool 获取当前请求的API Key所属的token池，未指定池时返回空配置，表示使用全部token和全局策略。
+// 池配置读取失败时仍限制在该池内，使用全局策略
+func requestTokenPool(c *gin.Context) config.TokenPool {
+	name := requestAPIKey(c).Pool
+	if name == "" {
+		return config.TokenPool{}
+	}
+	pool, err := config.GetTokenPool(name)
+	if err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"pool":  name,
+			"error": err.Error(),
+		}).Warn("获取token池配置失败，使用全局选择策略")
+		return config.TokenPool{Name: name}
+	}
+	return pool
+}
+
+// randomStrategy 随机选择
+type randomStrategy struct{}
+
+func (randomStrategy) Select(candidates []tokenCandidate) int {
+	return rand.Intn(len(candidates))
+}
+
+// roundRobinStrategy 按token排序后依次选择，计数器保存在Redis中，多个实例共享
+type roundRobinStrategy struct{}
+
+func (roundRobinStrategy) Select(candidates []tokenCandidate) int {
+	next, err := config.RedisIncrValue(roundRobinCounterKey)
+	if err != nil {
+		return rand.Intn(len(candidates))
+	}
+
+	order := make([]int, len(candidates))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return candidates[order[i]].Token < candidates[order[j]].Token
+	})
+	return order[int(next%int64(len(candidates)))]
+}
+
+// leastRecentlyUsedStrategy 选择最久未发起请求的token
+type leastRecentlyUsedStrategy struct{}
+
+func (leastRecentlyUsedStrategy) Select(candidates []tokenCandidate) int {
+	statuses := batchTokenValues(candidates, readRequestStatus)[0]
+	return minIndex(candidates, func(i int) float64 {
+		var status TokenRequestStatus
+		if err := json.Unmarshal([]byte(statuses[i]), &status); err != nil {
+			return 0
+		}
+		return float64(status.LastRequestAt.UnixNano())
+	})
+}
+
+// leastUsedTodayStrategy 选择今日使用次数最少的token
+type leastUsedTodayStrategy struct{}
+
+func (leastUsedTodayStrategy) Select(candidates []tokenCandidate) int {
+	usages := batchTokenValues(candidates, readDailyUsage)[0]
+	return minIndex(candidates, func(i int) float64 {
+		return float64(parseIntOr(usages[i], 0))
+	})
+}
+
+// weightedQuotaStrategy 按今日剩余调用次数加权随机选择
+type weightedQuotaStrategy struct{}
+
+func (weightedQuotaStrategy) Select(candidates []tokenCandidate) int {
+	values := batchTokenValues(candidates, readDailyLimit, readDailyUsage)
+	weights := make([]int, len(candidates))
+	total := 0
+	for i := range candidates {
+		remaining := parseIntOr(values[0][i], 1000) - parseIntOr(values[1][i], 0) // 未设置每日限制时默认1000次
+		if remaining < 1 {
+			remaining = 1
+		}
+		weights[i] = remaining
+		total += remaining
+	}
+
+	n := rand.Intn(total)
+	for i, weight := range weights {
+		if n < weight {
+			return i
+		}
+		n -= weight
+	}
+	return len(candidates) - 1
+}
+
+// latencyStrategy 选择上游首个响应延迟最低的token，没有延迟记录的token优先选择以获得样本
+type latencyStrategy struct{}
+
+func (latencyStrategy) Select(candidates []tokenCandidate) int {
+	latencies := batchTokenValues(candidates, readLatency)[0]
+	return minIndex(candidates, func(i int) float64 {
+		latency, err := strconv.ParseFloat(latencies[i], 64)
+		if err != nil {
+			return 0
+		}
+		return latency
+	})
+}
+
+// tokenValueReader 向流水线加入读取token某项数据的命令
+type tokenValueReader func(ctx context.Context, pipe redis.Pipeliner, token string) *redis.StringCmd
+
+// readRequestStatus 读取token的请求状态（JSON）
+func readRequestStatus(ctx context.Context, pipe redis.Pipeliner, token string) *redis.StringCmd {
+	return pipe.Get(ctx, "token_status:"+token)
+}
+
+// readDailyUsage 读取token的今日使用次数
+func readDailyUsage(ctx context.Context, pipe redis.Pipeliner, token string) *redis.StringCmd {
+	return pipe.Get(ctx, "token_daily_usage:"+token+":"+time.Now().Format("2006-01-02"))
+}
+
+// readDailyLimit 读取token的每日调用上限
+func readDailyLimit(ctx context.Context, pipe redis.Pipeliner, token string) *redis.StringCmd {
+	return pipe.HGet(ctx, "token:"+token, "daily_limit")
+}
+
+// readLatency 读取token首个响应延迟的移动平均值
+func readLatency(ctx context.Context, pipe redis.Pipeliner, token string) *redis.StringCmd {
+	return pipe.HGet(ctx, tokenLatencyPrefix+token, "ewma_ms")
+}
+
+// batchTokenValues 在一次流水线中为所有候选token执行readers，返回values[reader][candidate]。
+// 不存在或读取失败的值为空字符串，由调用方按默认值处理
+func batchTokenValues(candidates []tokenCandidate, readers ...tokenValueReader) [][]string {
+	cmds := make([][]*redis.StringCmd, len(readers))
+	for r := range readers {
+		cmds[r] = make([]*redis.StringCmd, len(candidates))
+	}
+	err := config.RedisPipelined(func(ctx context.Context, pipe redis.Pipeliner) {
+		for i, candidate := range candidates {
+			for r, read := range readers {
+				cmds[r][i] = read(ctx, pipe, candidate.Token)
+			}
+		}
+	})
+	if err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("批量读取token数据失败")
+	}
+
+	values := make([][]string, len(readers))
+	for r := range readers {
+		values[r] = make([]string, len(candidates))
+		for i, cmd := range cmds[r] {
+			if cmd != nil {
+				values[r][i] = cmd.Val()
+			}
+		}
+	}
+	return values
+}
+
+// parseIntOr 解析整数，为空或无效时返回fallback
+func parseIntOr(value string, fallback int) int {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fallback
+	}
+	return n
+}
+
+// minIndex 返回score最小的候选下标，score相同时随机选择，避免总是选中同一个token
+func minIndex(candidates []tokenCandidate, score func(i int) float64) int {
+	var best []int
+	bestScore := 0.0
+	for i := range candidates {
+		s := score(i)
+		switch {
+		case len(best) == 0 || s < bestScore:
+			best = []int{i}
+			bestScore = s
+		case s == bestScore:
+			best = append(best, i)
+		}
+	}
+	return best[rand.Intn(len(best))]
+}
+
+// getTokenLatency 获取token首个响应延迟的移动平均值（毫秒），没有记录时返回0
+func getTokenLatency(token string) float64 {
+	value, err := config.RedisHGet(tokenLatencyPrefix+token, "ewma_ms")
+	if err != nil {
+		return 0
+	}
+	latency, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0
+	}
+	return latency
+}
+
+// asyncRecordTokenLatency 异步更新token首个响应延迟的移动平均值
+func asyncRecordTokenLatency(token string, latency time.Duration) {
+	if token == "" {
+		return
+	}
+	go func() {
+		sample := float64(latency.Milliseconds())
+		ewma := sample
+		if previous := getTokenLatency(token); previous > 0 {
+			ewma = previous + latencyEWMAWeight*(sample-previous)
+		}
+		if err := config.RedisHSet(tokenLatencyPrefix+token, "ewma_ms", strconv.FormatFloat(ewma, 'f', 1, 64)); err != nil {
+			logger.Log.WithFields(logrus.Fields{
+				"token": token,
+				"error": err.Error(),
+			}).Warn("记录token延迟失败")
+		}
+	}()
+}
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"augment2api/config"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+// pipelineOnlyRedis 选择策略只能通过流水线读取token数据，逐个读取时测试失败
+type pipelineOnlyRedis struct {
+	*fakeRedis
+	t *testing.T
+}
+
+func (r pipelineOnlyRedis) Get(ctx context.Context, key string) *redis.StringCmd {
+	r.t.Errorf("选择策略单独读取了 %s", key)
+	return r.fakeRedis.Get(ctx, key)
+}
+
+func (r pipelineOnlyRedis) HGet(ctx context.Context, key, field string) *redis.StringCmd {
+	r.t.Errorf("选择策略单独读取了 %s %s", key, field)
+	return r.fakeRedis.HGet(ctx, key, field)
+}
+
+// tokenFixture 测试用token的选择依据
+type tokenFixture struct {
+	token       string
+	lastRequest time.Duration // 距上次请求的时间
+	dailyUsage  int
+	dailyLimit  int
+	latency     string
+}
+
+// seedTokens 写入token及其请求状态、今日使用次数、每日限制和延迟记录
+func seedTokens(t *testing.T, fixtures []tokenFixture) []tokenCandidate {
+	t.Helper()
+	today := time.Now().Format("2006-01-02")
+	var candidates []tokenCandidate
+	for _, fixture := range fixtures {
+		config.RedisHSet("token:"+fixture.token, "tenant_url", "https://"+fixture.token+".example.com/")
+		if fixture.dailyLimit > 0 {
+			config.RedisHSet("token:"+fixture.token, "daily_limit", strconv.Itoa(fixture.dailyLimit))
+		}
+		if fixture.dailyUsage > 0 {
+			config.RedisSet("token_daily_usage:"+fixture.token+":"+today, strconv.Itoa(fixture.dailyUsage), 0)
+		}
+		if fixture.lastRequest > 0 {
+			status, _ := json.Marshal(TokenRequestStatus{LastRequestAt: time.Now().Add(-fixture.lastRequest)})
+			config.RedisSet("token_status:"+fixture.token, string(status), 0)
+		}
+		if fixture.latency != "" {
+			config.RedisHSet(tokenLatencyPrefix+fixture.token, "ewma_ms", fixture.latency)
+		}
+		candidates = append(candidates, tokenCandidate{Token: fixture.token})
+	}
+	return candidates
+}
+
+func TestSelectionStrategies(t *testing.T) {
+	fixtures := []tokenFixture{
+		{token: "a", lastRequest: time.Minute, dailyUsage: 5, dailyLimit: 10, latency: "800"},
+		{token: "b", lastRequest: time.Hour, dailyUsage: 9, dailyLimit: 10, latency: "300"},
+		{token: "c", lastRequest: 2 * time.Minute, dailyUsage: 2, dailyLimit: 2, latency: "450"},
+	}
+
+	tests := []struct {
+		strategy string
+		want     string
+	}{
+		{strategy: "lru", want: "b"},
+		{strategy: "least_used_today", want: "c"},
+		{strategy: "latency", want: "b"},
+		{strategy: "weighted", want: "a"}, // 剩余次数a=5，b=1，c=0按1计
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			fake := newFakeRedis(t)
+			candidates := seedTokens(t, fixtures)
+			config.RDB = pipelineOnlyRedis{fakeRedis: fake, t: t}
+
+			counts := map[string]int{}
+			const selections = 200
+			for i := 0; i < selections; i++ {
+				counts[candidates[selectionStrategies[tt.strategy].Select(candidates)].Token]++
+			}
+			if fake.pipelines != selections {
+				t.Errorf("%d次选择执行了%d次流水线, want 每次一次", selections, fake.pipelines)
+			}
+			// weighted为加权随机，只要求剩余次数最多的token被选中最多
+			for token, count := range counts {
+				if token != tt.want && count >= counts[tt.want] {
+					t.Errorf("selected %v, want mostly %s", counts, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSelectionStrategiesWithoutStats(t *testing.T) {
+	newFakeRedis(t)
+	candidates := []tokenCandidate{{Token: "a"}, {Token: "b"}}
+	for name, strategy := range selectionStrategies {
+		if i := strategy.Select(candidates); i < 0 || i >= len(candidates) {
+			t.Errorf("%s selected %d from %d candidates", name, i, len(candidates))
+		}
+	}
+}
+
+func TestGetAvailableTokenFromPool(t *testing.T) {
+	newFakeRedis(t)
+	seedTokens(t, []tokenFixture{
+		{token: "a", lastRequest: time.Hour},
+		{token: "b", lastRequest: time.Minute},
+		{token: "c", lastRequest: 2 * time.Hour},
+	})
+	pool := config.TokenPool{Name: "team", SelectionStrategy: "lru"}
+	config.SetTokenPool(pool)
+	config.AddTokenPoolToken("team", "a")
+	config.AddTokenPoolToken("team", "b")
+
+	tests := []struct {
+		name    string
+		pool    config.TokenPool
+		exclude map[string]bool
+		want    string
+	}{
+		{name: "pool strategy picks within the pool", pool: pool, want: "a"},
+		{name: "excluded tokens are skipped", pool: pool, exclude: map[string]bool{"a": true}, want: "b"},
+		{name: "exhausted pool does not borrow tokens", pool: pool, exclude: map[string]bool{"a": true, "b": true}, want: "No available token"},
+		{name: "empty pool", pool: config.TokenPool{Name: "empty"}, want: "No token"},
+		{name: "no pool uses every token", pool: config.TokenPool{SelectionStrategy: "lru"}, want: "c"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if token, _ := getAvailableTokenExcluding(tt.exclude, tt.pool); token != tt.want {
+				t.Errorf("token = %q, want %q", token, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestTokenPool(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	newFakeRedis(t)
+	config.SetTokenPool(config.TokenPool{Name: "team", SelectionStrategy: "latency"})
+
+	tests := []struct {
+		name   string
+		apiKey *config.APIKey
+		want   config.TokenPool
+	}{
+		{name: "no API key", want: config.TokenPool{}},
+		{name: "API key without pool", apiKey: &config.APIKey{Key: "sk-a"}, want: config.TokenPool{}},
+		{name: "API key with pool", apiKey: &config.APIKey{Key: "sk-b", Pool: "team"}, want: config.TokenPool{Name: "team", SelectionStrategy: "latency"}},
+		{name: "missing pool stays restricted", apiKey: &config.APIKey{Key: "sk-c", Pool: "gone"}, want: config.TokenPool{Name: "gone"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			if tt.apiKey != nil {
+				c.Set("api_key", *tt.apiKey)
+			}
+			if pool := requestTokenPool(c); pool != tt.want {
+				t.Errorf("pool = %+v, want %+v", pool, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package api
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// OpenAITool OpenAI兼容的工具定义
+type OpenAITool struct {
+	Type     string             `json:"type"`
+	Function OpenAIToolFunction `json:"function"`
+}
+
+// OpenAIToolFunction OpenAI工具中的函数定义
+type OpenAIToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// ToolCall OpenAI兼容的工具调用结构
+type ToolCall struct {
+	Index    *int             `json:"index,omitempty"` // 仅流式响应中使用
+	ID       string           `json:"id,omitempty"`
+	Type     string           `json:"type,omitempty"`
+	Function ToolCallFunction `json:"function"`
+}
+
+// ToolCallFunction 工具调用中的函数名和参数
+type ToolCallFunction struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+const (
+	// 请求节点类型
+	requestNodeTypeText       = 0
+	requestNodeTypeToolResult = 1
+
+	// 客户端未提供参数定义时使用的空schema
+	emptyToolSchema = `{"type":"object","properties":{}}`
+)
+
+// convertOpenAITools 将客户端传入的tools转换为Augment的工具定义
+// tool_choice为"none"时不下发任何工具，指定了具体函数时只下发该函数
+func convertOpenAITools(tools []OpenAITool, toolChoice interface{}) []ToolDefinition {
+	if len(tools) == 0 {
+		return nil
+	}
+
+	onlyName := ""
+	switch v := toolChoice.(type) {
+	case string:
+		if v == "none" {
+			return nil
+		}
+	case map[string]interface{}:
+		if function, ok := v["function"].(map[string]interface{}); ok {
+			onlyName, _ = function["name"].(string)
+		}
+	}
+
+	definitions := make([]ToolDefinition, 0, len(tools))
+	for _, tool := range tools {
+		if tool.Type != "" && tool.Type != "function" {
+			continue
+		}
+		if tool.Function.Name == "" {
+			continue
+		}
+		if onlyName != "" && tool.Function.Name != onlyName {
+			continue
+		}
+
+		schema := strings.TrimSpace(string(tool.Function.Parameters))
+		if schema == "" || schema == "null" {
+			schema = emptyToolSchema
+		}
+
+		definitions = append(definitions, ToolDefinition{
+			Name:            tool.Function.Name,
+			Description:     tool.Function.Description,
+			InputSchemaJSON: schema,
+			ToolSafety:      1,
+		})
+	}
+
+	return definitions
+}
+
+// toolUseNodes 将助手消息中的tool_calls转换为Augment的响应节点
+func toolUseNodes(calls []ToolCall, startID int) []Node {
+	nodes := make([]Node, 0, len(calls))
+	for i, call := range calls {
+		nodes = append(nodes, Node{
+			ID:   startID + i,
+			Type: responseNodeTypeToolUse,
+			ToolUse: ToolUse{
+				ToolUseID: call.ID,
+				ToolName:  call.Function.Name,
+				InputJSON: call.Function.Arguments,
+			},
+		})
+	}
+	return nodes
+}
+
+// toolResultNode 将role为tool的消息转换为Augment的工具结果请求节点
+func toolResultNode(msg ChatMessage, id int) Node {
+	return Node{
+		ID:   id,
+		Type: requestNodeTypeToolResult,
+		ToolResultNode: &ToolResultNode{
+			ToolUseID: msg.ToolCallID,
+			Content:   msg.GetContent(),
+		},
+	}
+}
+
+// toolCallCollector 收集Augment响应中的tool_use节点，按出现顺序分配index并去重
+type toolCallCollector struct {
+	seen  map[string]bool
+	calls []ToolCall
+}
+
+func newToolCallCollector() *toolCallCollector {
+	return &toolCallCollector{seen: make(map[string]bool)}
+}
+
+// collect 返回本次节点中新出现的工具调用（带流式index）
+func (tc *toolCallCollector) collect(nodes []Node) []ToolCall {
+	var added []ToolCall
+	for _, node := range nodes {
+		if node.Type != responseNodeTypeToolUse || node.ToolUse.ToolName == "" {
+			continue
+		}
+		if node.ToolUse.ToolUseID != "" && tc.seen[node.ToolUse.ToolUseID] {
+			continue
+		}
+		tc.seen[node.ToolUse.ToolUseID] = true
+
+		index := len(tc.calls)
+		arguments := node.ToolUse.InputJSON
+		if arguments == "" {
+			arguments = "{}"
+		}
+		call := ToolCall{
+			Index: &index,
+			ID:    node.ToolUse.ToolUseID,
+			Type:  "function",
+			Function: ToolCallFunction{
+				Name:      node.ToolUse.ToolName,
+				Arguments: arguments,
+			},
+		}
+		tc.calls = append(tc.calls, call)
+		added = append(added, call)
+	}
+	return added
+}
+
+// messageToolCalls 返回非流式响应使用的工具调用列表（不带index）
+func (tc *toolCallCollector) messageToolCalls() []ToolCall {
+	if len(tc.calls) == 0 {
+		return nil
+	}
+	calls := make([]ToolCall, len(tc.calls))
+	for i, call := range tc.calls {
+		call.Index = nil
+		calls[i] = call
+	}
+	return calls
+}
+
+// finishReason 根据是否产生过工具调用返回完成原因
+func (tc *toolCallCollector) finishReason() string {
+	if len(tc.calls) > 0 {
+		return "tool_calls"
+	}
+	return "stop"
+}
+
+// streamDelta 构造流式响应的delta，有工具调用且无文本时content置空
+func streamDelta(text string, toolCalls []ToolCall) ChatMessage {
+	delta := ChatMessage{
+		Role:    "assistant",
+		Content: text,
+	}
+	if len(toolCalls) > 0 {
+		delta.ToolCalls = toolCalls
+		if text == "" {
+			delta.Content = nil
+		}
+	}
+	return delta
+}
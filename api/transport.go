@@ -0,0 +1,122 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// transportSettings 影响连接建立方式的配置，变化时需要重建Transport
+type transportSettings struct {
+	http2          bool
+	connectTimeout time.Duration
+	headerTimeout  time.Duration
+}
+
+// transportRoute 上游出口路线：出口代理地址（空字符串为直连）和上游主机（租户或CF Worker）
+type transportRoute struct {
+	proxyURL string
+	host     string
+}
+
+// 共享Transport，每条出口路线一个，同一路线的所有请求复用keep-alive连接和TLS会话
+var (
+	transports      = make(map[transportRoute]*sharedTransport)
+	transportsGuard = sync.Mutex{}
+	// 当前上游请求使用的代理地址，proxy_url修改后关闭旧代理的连接
+	upstreamProxyURL string
+)
+
+type sharedTransport struct {
+	settings  transportSettings
+	transport *http.Transport
+}
+
+func currentTransportSettings() transportSettings {
+	return transportSettings{
+		http2:          config.AppConfig.UpstreamHTTP2,
+		connectTimeout: config.AppConfig.UpstreamConnectTimeout,
+		headerTimeout:  config.AppConfig.UpstreamFirstByteTimeout,
+	}
+}
+
+// upstreamHost 获取上游地址的主机部分，无法解析时使用原始地址
+func upstreamHost(target string) string {
+	if parsedURL, err := url.Parse(target); err == nil && parsedURL.Host != "" {
+		return parsedURL.Scheme + "://" + parsedURL.Host
+	}
+	return target
+}
+
+// upstreamTransport 获取当前proxy_url下访问target（租户或CF Worker地址）的共享Transport
+func upstreamTransport(target string) *http.Transport {
+	route := transportRoute{proxyURL: config.AppConfig.ProxyURL, host: upstreamHost(target)}
+	settings := currentTransportSettings()
+
+	transportsGuard.Lock()
+	defer transportsGuard.Unlock()
+
+	if route.proxyURL != upstreamProxyURL {
+		// 旧出口的所有路线不再使用，关闭空闲连接，进行中的请求继续使用旧连接直到完成
+		for oldRoute, old := range transports {
+			if oldRoute.proxyURL == upstreamProxyURL {
+				old.transport.CloseIdleConnections()
+				delete(transports, oldRoute)
+			}
+		}
+		upstreamProxyURL = route.proxyURL
+	}
+
+	if shared, exists := transports[route]; exists {
+		if shared.settings == settings {
+			return shared.transport
+		}
+		// 超时或HTTP/2配置已修改，进行中的请求继续使用旧连接直到完成
+		shared.transport.CloseIdleConnections()
+	}
+
+	transport := newTransport(route.proxyURL, settings)
+	transports[route] = &sharedTransport{settings: settings, transport: transport}
+	return transport
+}
+
+// newTransport 创建连接上游使用的Transport
+// 使用自定义DialContext时只有ForceAttemptHTTP2才会启用HTTP/2，未开启upstream_http2时强制使用HTTP/1.1
+func newTransport(proxyURL string, settings transportSettings) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   settings.connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     settings.http2,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   32,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   settings.connectTimeout,
+		ResponseHeaderTimeout: settings.headerTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if proxyURL != "" {
+		parsedURL, err := url.Parse(proxyURL)
+		if err == nil {
+			transport.Proxy = http.ProxyURL(parsedURL)
+			logger.Log.WithFields(logrus.Fields{
+				"proxy": proxyURL,
+				"http2": settings.http2,
+			}).Info("创建上游连接池，使用代理")
+		} else {
+			logger.Log.WithFields(logrus.Fields{
+				"proxy": proxyURL,
+				"error": err.Error(),
+			}).Error("代理URL格式错误，使用直连")
+		}
+	}
+	return transport
+}
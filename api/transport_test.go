@@ -0,0 +1,95 @@
+package api
+
+import (
+	"augment2api/config"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamTransportRoutes(t *testing.T) {
+	previous := config.AppConfig
+	t.Cleanup(func() { config.AppConfig = previous })
+	config.AppConfig.ProxyURL = ""
+
+	tenant := upstreamTransport("https://d1.api.augmentcode.com/")
+	if upstreamTransport("https://d1.api.augmentcode.com/chat-stream") != tenant {
+		t.Error("同一租户应复用Transport")
+	}
+	worker := upstreamTransport("https://proxy.example.workers.dev")
+	if worker == tenant {
+		t.Error("CF Worker应使用单独的Transport")
+	}
+
+	config.AppConfig.ProxyURL = "http://127.0.0.1:7890"
+	proxied := upstreamTransport("https://d1.api.augmentcode.com/")
+	if proxied == tenant {
+		t.Error("proxy_url修改后应创建新的Transport")
+	}
+	transportsGuard.Lock()
+	for route := range transports {
+		if route.proxyURL == "" {
+			t.Errorf("proxy_url修改后应移除旧出口的路线: %+v", route)
+		}
+	}
+	transportsGuard.Unlock()
+}
+
+// BenchmarkUpstreamTTFB 并发请求下比较共享Transport和每次请求新建Transport的首字节时间（TLS上游）
+func BenchmarkUpstreamTTFB(b *testing.B) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte(`{"text":"hi","done":true}` + "\n"))
+	}))
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	tlsConfig := &tls.Config{RootCAs: roots}
+
+	previous := config.AppConfig
+	defer func() { config.AppConfig = previous }()
+	config.AppConfig.ProxyURL = ""
+	config.AppConfig.UpstreamConnectTimeout = 10 * time.Second
+
+	run := func(b *testing.B, transport func() *http.Transport) {
+		var total atomic.Int64
+		b.SetParallelism(8)
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				client := &http.Client{Transport: transport()}
+				start := time.Now()
+				resp, err := client.Post(server.URL+"/chat-stream", "application/json", nil)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				total.Add(int64(time.Since(start)))
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		})
+		b.ReportMetric(float64(total.Load())/float64(b.N)/float64(time.Millisecond), "ttfb-ms")
+	}
+
+	b.Run("shared", func(b *testing.B) {
+		shared := upstreamTransport(server.URL)
+		shared.TLSClientConfig = tlsConfig
+		run(b, func() *http.Transport { return shared })
+	})
+	b.Run("per-request", func(b *testing.B) {
+		run(b, func() *http.Transport {
+			transport := newTransport("", currentTransportSettings())
+			transport.TLSClientConfig = tlsConfig
+			// 与每次请求新建Transport时一样，连接不会被复用
+			transport.DisableKeepAlives = true
+			return transport
+		})
+	})
+}
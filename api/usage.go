@@ -0,0 +1,164 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// token用量统计键前缀，哈希字段为prompt_tokens、completion_tokens、total_tokens、requests
+	tokenCountsPrefix   = "token_tokens:"
+	apiKeyUsagePrefix   = "api_key_usage:"
+	apiKeyDailyUsageTTL = 90 * 24 * time.Hour
+)
+
+// StreamOptions 流式响应选项
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// newUsage 根据提示和补全的token数量构造用量
+func newUsage(promptTokens, completionTokens int) Usage {
+	return Usage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      promptTokens + completionTokens,
+	}
+}
+
+// chatUsage 估算聊天请求的用量
+func chatUsage(augmentReq AugmentRequest, completion string) Usage {
+	return newUsage(estimatePromptTokens(augmentReq), estimateTokenCount(completion))
+}
+
+// writeStreamDone 结束OpenAI流式响应，客户端设置include_usage时先发送不含choices的用量块
+func writeStreamDone(c *gin.Context, flusher http.Flusher, responseID, model string, usage *Usage) {
+	if usage != nil {
+		usageResp := OpenAIStreamResponse{
+			ID:      responseID,
+			Object:  "chat.completion.chunk",
+			Created: time.Now().Unix(),
+			Model:   model,
+			Choices: []StreamChoice{},
+			Usage:   usage,
+		}
+		if jsonResp, err := json.Marshal(usageResp); err == nil {
+			fmt.Fprintf(c.Writer, "data: %s\n\n", jsonResp)
+		}
+	}
+
+	fmt.Fprintf(c.Writer, "data: [DONE]\n\n")
+	flusher.Flush()
+}
+
+// asyncRecordTokenCounts 异步记录本次请求的token用量到所用token和下游API Key
+func asyncRecordTokenCounts(c *gin.Context, token string, usage Usage) {
+	apiKey := requestAPIKey(c).Key
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				logger.Log.WithFields(logrus.Fields{
+					"error": r,
+					"token": token,
+				}).Error("记录token用量时发生panic")
+			}
+		}()
+
+		// 命中响应缓存的请求没有使用token
+		if token != "" {
+			recordTokenCounts(tokenCountsPrefix+token, usage, 0)
+		}
+		if apiKey != "" {
+			recordTokenCounts(apiKeyUsagePrefix+apiKey, usage, 0)
+			today := time.Now().Format("2006-01-02")
+			recordTokenCounts(apiKeyUsagePrefix+apiKey+":"+today, usage, apiKeyDailyUsageTTL)
+		}
+	}()
+}
+
+// recordTokenCounts 累加用量到指定的哈希键，expiration大于0时设置过期时间
+func recordTokenCounts(key string, usage Usage, expiration time.Duration) {
+	fields := map[string]int{
+		"prompt_tokens":     usage.PromptTokens,
+		"completion_tokens": usage.CompletionTokens,
+		"total_tokens":      usage.TotalTokens,
+		"requests":          1,
+	}
+	for field, value := range fields {
+		if err := config.RedisHIncrBy(key, field, int64(value)); err != nil {
+			logger.Log.WithFields(logrus.Fields{
+				"key":   key,
+				"field": field,
+				"error": err.Error(),
+			}).Error("记录token用量失败")
+			return
+		}
+	}
+
+	if expiration > 0 {
+		if err := config.RedisExpire(key, expiration); err != nil {
+			logger.Log.WithFields(logrus.Fields{
+				"key":   key,
+				"error": err.Error(),
+			}).Error("设置token用量过期时间失败")
+		}
+	}
+}
+
+// getTokenCounts 读取指定键累计的token用量
+func getTokenCounts(key string) map[string]int {
+	counts := map[string]int{
+		"prompt_tokens":     0,
+		"completion_tokens": 0,
+		"total_tokens":      0,
+		"requests":          0,
+	}
+
+	values, err := config.RedisHGetAll(key)
+	if err != nil {
+		return counts
+	}
+	for field, value := range values {
+		if n, err := strconv.Atoi(value); err == nil {
+			counts[field] = n
+		}
+	}
+	return counts
+}
+
+// GetAPIKeyUsage 获取API Key的累计用量和最近几天的每日用量
+func GetAPIKeyUsage(c *gin.Context) {
+	key := c.Param("key")
+	if _, err := config.GetAPIKey(key); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  "API Key不存在",
+		})
+		return
+	}
+
+	days, err := strconv.Atoi(c.DefaultQuery("days", "30"))
+	if err != nil || days <= 0 || days > 90 {
+		days = 30
+	}
+
+	daily := make(map[string]map[string]int, days)
+	for i := 0; i < days; i++ {
+		date := time.Now().AddDate(0, 0, -i).Format("2006-01-02")
+		daily[date] = getTokenCounts(apiKeyUsagePrefix + key + ":" + date)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"total":  getTokenCounts(apiKeyUsagePrefix + key),
+		"daily":  daily,
+	})
+}
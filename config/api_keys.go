@@ -0,0 +1,80 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// APIKey 下游客户端使用的API Key配置
+type APIKey struct {
+	Key            string `json:"key"`
+	Name           string `json:"name"`
+	PromptTemplate string `json:"prompt_template"` // 为空时按模型或默认模板选择
+	CacheTTL       int    `json:"cache_ttl"`       // 响应缓存有效期（秒），0按模型或全局配置，负数不缓存
+	Pool           string `json:"pool"`            // 使用的token池，为空时使用全部token
+	Enabled        bool   `json:"enabled"`
+	CreatedAt      string `json:"created_at"`
+	UpdatedAt      string `json:"updated_at"`
+}
+
+const apiKeyPrefix = "api_key:"
+
+// GetAPIKey 获取API Key配置
+func GetAPIKey(key string) (APIKey, error) {
+	data, err := RedisGet(apiKeyPrefix + key)
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	var apiKey APIKey
+	err = json.Unmarshal([]byte(data), &apiKey)
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	return apiKey, nil
+}
+
+// SetAPIKey 保存API Key配置
+func SetAPIKey(apiKey APIKey) error {
+	if apiKey.Key == "" {
+		return fmt.Errorf("API Key不能为空")
+	}
+
+	data, err := json.Marshal(apiKey)
+	if err != nil {
+		return err
+	}
+
+	return RedisSet(apiKeyPrefix+apiKey.Key, string(data), 0) // 永不过期
+}
+
+// GetAllAPIKeys 获取所有API Key配置，按名称排序
+func GetAllAPIKeys() ([]APIKey, error) {
+	keys, err := RedisKeys(apiKeyPrefix + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	apiKeys := make([]APIKey, 0, len(keys))
+	for _, key := range keys {
+		apiKey, err := GetAPIKey(strings.TrimPrefix(key, apiKeyPrefix))
+		if err != nil {
+			continue
+		}
+		apiKeys = append(apiKeys, apiKey)
+	}
+
+	sort.Slice(apiKeys, func(i, j int) bool {
+		return apiKeys[i].Name < apiKeys[j].Name
+	})
+
+	return apiKeys, nil
+}
+
+// DeleteAPIKey 删除API Key配置
+func DeleteAPIKey(key string) error {
+	return RedisDel(apiKeyPrefix + key)
+}
@@ -17,6 +17,30 @@ type Config struct {
 	AccessPwd       string
 	RoutePrefix     string
 	ProxyURL        string
+	Tokenizer       string
+
+	ResponseFormatRetries int // response_format校验失败后重新请求的次数
+	AutoContinueMax       int // 开启自动续写的请求在回复被截断后最多续写的次数
+	FailoverMaxHops       int // 上游失败时切换到其他token重试的最大次数
+	Retry                 RetryPolicy
+
+	ContextBudget       int    // 发送给上游的上下文token上限，0为不限制，可按模型覆盖
+	ContextTrimStrategy string // 超出上下文上限时的处理方式：drop丢弃最早的对话，summarize用CHAT模式总结
+
+	TokenSelectionStrategy string // 选择token的策略，token池可单独配置
+
+	StreamHeartbeat          time.Duration // 流式响应等待上游输出时发送SSE心跳的间隔，0为不发送
+	UpstreamConnectTimeout   time.Duration // 与上游建立连接（含TLS握手）的超时时间
+	UpstreamFirstByteTimeout time.Duration // 发出请求后等待上游首个响应的超时时间
+	UpstreamIdleTimeout      time.Duration // 上游两次响应之间的最长间隔
+	UpstreamHTTP2            bool          // 连接上游时是否尝试使用HTTP/2
+
+	ResponseCacheEnabled bool          // 是否缓存相同请求的上游响应
+	ResponseCacheTTL     time.Duration // 响应缓存的默认有效期，可按模型或API Key覆盖
+	ConversationTTL      time.Duration // 服务端对话在最后一次更新后的保留时间
+	TokenAffinityEnabled bool          // 是否将同一对话的请求固定到同一个token
+	TokenAffinityTTL     time.Duration // 对话与token的绑定在最后一次使用后的保留时间
+	FileBlobStore        string        // 上传文件的blob存储：augment上传到租户，local不上传（本地测试）
 }
 
 // SystemConfig 系统配置结构
@@ -64,6 +88,7 @@ func LoadConfigFromDatabase() error {
 	}
 
 	// 应用配置到AppConfig
+	AppConfig.Retry = defaultRetryPolicy
 	for _, config := range configs {
 		switch config.Key {
 		case "access_pwd":
@@ -80,6 +105,52 @@ func LoadConfigFromDatabase() error {
 			AppConfig.TenantURL = config.Value
 		case "proxy_url":
 			AppConfig.ProxyURL = config.Value
+		case "tokenizer":
+			AppConfig.Tokenizer = config.Value
+		case "response_format_retries":
+			AppConfig.ResponseFormatRetries = parseIntConfig(config.Key, config.Value, 2)
+		case "auto_continue_max":
+			AppConfig.AutoContinueMax = parseIntConfig(config.Key, config.Value, 3)
+		case "context_budget_tokens":
+			AppConfig.ContextBudget = parseIntConfig(config.Key, config.Value, 0)
+		case "context_trim_strategy":
+			AppConfig.ContextTrimStrategy = config.Value
+		case "failover_max_hops":
+			AppConfig.FailoverMaxHops = parseIntConfig(config.Key, config.Value, 2)
+		case "retry_status_codes":
+			AppConfig.Retry.StatusCodes = parseStatusCodes(config.Value)
+		case "retry_max_attempts":
+			AppConfig.Retry.MaxAttempts = parseIntConfig(config.Key, config.Value, defaultRetryPolicy.MaxAttempts)
+		case "retry_backoff_base_ms":
+			AppConfig.Retry.BackoffBase = time.Duration(parseIntConfig(config.Key, config.Value, 500)) * time.Millisecond
+		case "retry_backoff_max_ms":
+			AppConfig.Retry.BackoffMax = time.Duration(parseIntConfig(config.Key, config.Value, 8000)) * time.Millisecond
+		case "retry_rotate_token":
+			AppConfig.Retry.RotateToken = config.Value == "true"
+		case "stream_heartbeat_seconds":
+			AppConfig.StreamHeartbeat = parseSecondsConfig(config.Key, config.Value, 15)
+		case "upstream_connect_timeout_seconds":
+			AppConfig.UpstreamConnectTimeout = parseSecondsConfig(config.Key, config.Value, 10)
+		case "upstream_first_byte_timeout_seconds":
+			AppConfig.UpstreamFirstByteTimeout = parseSecondsConfig(config.Key, config.Value, 300)
+		case "upstream_idle_timeout_seconds":
+			AppConfig.UpstreamIdleTimeout = parseSecondsConfig(config.Key, config.Value, 120)
+		case "upstream_http2":
+			AppConfig.UpstreamHTTP2 = config.Value == "true"
+		case "response_cache_enabled":
+			AppConfig.ResponseCacheEnabled = config.Value == "true"
+		case "response_cache_ttl_seconds":
+			AppConfig.ResponseCacheTTL = parseSecondsConfig(config.Key, config.Value, 3600)
+		case "conversation_ttl_seconds":
+			AppConfig.ConversationTTL = parseSecondsConfig(config.Key, config.Value, 604800)
+		case "token_affinity_enabled":
+			AppConfig.TokenAffinityEnabled = config.Value == "true"
+		case "token_selection_strategy":
+			AppConfig.TokenSelectionStrategy = config.Value
+		case "token_affinity_ttl_seconds":
+			AppConfig.TokenAffinityTTL = parseSecondsConfig(config.Key, config.Value, 1800)
+		case "file_blob_store":
+			AppConfig.FileBlobStore = config.Value
 		}
 	}
 
@@ -163,6 +234,167 @@ func initializeDefaultConfigs() error {
 			Category:    "network",
 			UpdatedAt:   time.Now(),
 		},
+		{
+			Key:         "tokenizer",
+			Value:       "bpe",
+			Description: "用量统计使用的token估算器（bpe为内嵌词表估算，heuristic为按空格粗略估算），均不等于上游计费的token数",
+			Category:    "api",
+			UpdatedAt:   time.Now(),
+		},
+		{
+			Key:         "response_format_retries",
+			Value:       "2",
+			Description: "结构化输出（response_format）校验失败后重新请求的次数",
+			Category:    "api",
+			UpdatedAt:   time.Now(),
+		},
+		{
+			Key:         "auto_continue_max",
+			Value:       "3",
+			Description: "请求开启auto_continue时，回复被截断（代码块未闭合、缺少done或因长度停止）后自动续写的最大次数",
+			Category:    "api",
+			UpdatedAt:   time.Now(),
+		},
+		{
+			Key:         "context_budget_tokens",
+			Value:       "0",
+			Description: "发送给上游的上下文（用户指南、历史和当前消息）估算token上限，超出时裁剪最早的对话，0为不限制，模型可单独配置",
+			Category:    "api",
+			UpdatedAt:   time.Now(),
+		},
+		{
+			Key:         "context_trim_strategy",
+			Value:       "drop",
+			Description: "超出上下文上限时的处理方式：drop为丢弃最早的对话，summarize为用CHAT模式将其总结为一段摘要（失败时丢弃）",
+			Category:    "api",
+			UpdatedAt:   time.Now(),
+		},
+		{
+			Key:         "failover_max_hops",
+			Value:       "2",
+			Description: "上游返回block或出错且尚未输出内容时，切换到其他token重试的最大次数（0为不切换）",
+			Category:    "api",
+			UpdatedAt:   time.Now(),
+		},
+		{
+			Key:         "retry_status_codes",
+			Value:       "429,500,502,503,504",
+			Description: "上游返回这些状态码时重试（逗号分隔）",
+			Category:    "network",
+			UpdatedAt:   time.Now(),
+		},
+		{
+			Key:         "retry_max_attempts",
+			Value:       "3",
+			Description: "上游请求的最大次数（包括首次请求，1为不重试）",
+			Category:    "network",
+			UpdatedAt:   time.Now(),
+		},
+		{
+			Key:         "retry_backoff_base_ms",
+			Value:       "500",
+			Description: "第一次重试前的等待时间（毫秒），之后每次翻倍并加入随机抖动",
+			Category:    "network",
+			UpdatedAt:   time.Now(),
+		},
+		{
+			Key:         "retry_backoff_max_ms",
+			Value:       "8000",
+			Description: "单次重试等待时间上限（毫秒），上游Retry-After超过该值时不在原token上等待",
+			Category:    "network",
+			UpdatedAt:   time.Now(),
+		},
+		{
+			Key:         "retry_rotate_token",
+			Value:       "true",
+			Description: "重试时是否换用token池中的其他token",
+			Category:    "network",
+			UpdatedAt:   time.Now(),
+		},
+		{
+			Key:         "stream_heartbeat_seconds",
+			Value:       "15",
+			Description: "流式响应等待上游输出时向客户端发送SSE心跳（: ping）的间隔秒数，0为不发送",
+			Category:    "network",
+			UpdatedAt:   time.Now(),
+		},
+		{
+			Key:         "upstream_connect_timeout_seconds",
+			Value:       "10",
+			Description: "与上游建立连接（含TLS握手）的超时秒数",
+			Category:    "network",
+			UpdatedAt:   time.Now(),
+		},
+		{
+			Key:         "upstream_first_byte_timeout_seconds",
+			Value:       "300",
+			Description: "发出请求后等待上游首个响应的超时秒数，AGENT模式可能需要较长时间，0为不限制",
+			Category:    "network",
+			UpdatedAt:   time.Now(),
+		},
+		{
+			Key:         "upstream_idle_timeout_seconds",
+			Value:       "120",
+			Description: "上游两次响应之间的最长间隔秒数，超过后视为上游连接已失效，0为不限制",
+			Category:    "network",
+			UpdatedAt:   time.Now(),
+		},
+		{
+			Key:         "upstream_http2",
+			Value:       "false",
+			Description: "连接上游时是否尝试使用HTTP/2（默认使用HTTP/1.1）",
+			Category:    "network",
+			UpdatedAt:   time.Now(),
+		},
+		{
+			Key:         "response_cache_enabled",
+			Value:       "false",
+			Description: "是否缓存相同聊天请求的响应，命中缓存时不占用token池中的token",
+			Category:    "api",
+			UpdatedAt:   time.Now(),
+		},
+		{
+			Key:         "response_cache_ttl_seconds",
+			Value:       "3600",
+			Description: "响应缓存的默认有效期（秒），模型或API Key单独配置了缓存时间时以其为准",
+			Category:    "api",
+			UpdatedAt:   time.Now(),
+		},
+		{
+			Key:         "conversation_ttl_seconds",
+			Value:       "604800",
+			Description: "服务端对话（/v1/conversations）在最后一次更新后的保留时间（秒），0为永久保留",
+			Category:    "api",
+			UpdatedAt:   time.Now(),
+		},
+		{
+			Key:         "token_selection_strategy",
+			Value:       "random",
+			Description: "从token池选择token的策略：random随机、round_robin轮询、lru最久未使用、least_used_today今日使用最少、weighted按今日剩余次数加权、latency上游延迟最低，token池可单独配置",
+			Category:    "api",
+			UpdatedAt:   time.Now(),
+		},
+		{
+			Key:         "token_affinity_enabled",
+			Value:       "false",
+			Description: "是否将同一对话（X-Conversation-ID请求头、conversation_id或相同的开头消息）的请求固定到同一个token",
+			Category:    "api",
+			UpdatedAt:   time.Now(),
+		},
+		{
+			Key:         "token_affinity_ttl_seconds",
+			Value:       "1800",
+			Description: "对话与token的绑定在最后一次使用后的保留时间（秒）",
+			Category:    "api",
+			UpdatedAt:   time.Now(),
+		},
+		{
+			Key:         "file_blob_store",
+			Value:       "augment",
+			Description: "上传文件（/v1/files）的blob存储：augment为请求时上传到token所属租户，local为不上传，仅用于本地测试",
+			Category:    "api",
+			UpdatedAt:   time.Now(),
+		},
 	}
 
 	for _, config := range defaultConfigs {
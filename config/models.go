@@ -0,0 +1,172 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ModelConfig 模型注册表中的模型配置
+type ModelConfig struct {
+	ID             string    `json:"id"`
+	Aliases        []string  `json:"aliases"`
+	Mode           string    `json:"mode"`            // CHAT 或 AGENT
+	UserGuidelines string    `json:"user_guidelines"` // 为空时使用提示词模板中对应模式的指南
+	DefaultPrompt  string    `json:"default_prompt"`  // 拼接在用户消息前的提示词，为空时使用提示词模板
+	PromptTemplate string    `json:"prompt_template"` // 提示词模板名称，为空时使用默认模板
+	IncludeTools   bool      `json:"include_tools"`   // 是否下发内置工具定义
+	CacheTTL       int       `json:"cache_ttl"`       // 响应缓存有效期（秒），0使用全局配置，负数不缓存
+	ContextBudget  int       `json:"context_budget"`  // 发送给上游的上下文token上限，0使用全局配置，负数不限制
+	OwnedBy        string    `json:"owned_by"`
+	Enabled        bool      `json:"enabled"`
+	Created        int64     `json:"created"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+const (
+	modelConfigPrefix = "model_config:"
+	// 模型名称索引，哈希表字段为小写的模型ID或别名，值为模型ID
+	modelNameIndexKey = "model_names"
+)
+
+// Matches 判断模型名称是否匹配该模型的ID或别名（不区分大小写）
+func (m ModelConfig) Matches(name string) bool {
+	if strings.EqualFold(m.ID, name) {
+		return true
+	}
+	for _, alias := range m.Aliases {
+		if strings.EqualFold(alias, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetModelConfig 根据模型ID获取模型配置
+func GetModelConfig(id string) (ModelConfig, error) {
+	data, err := RedisGet(modelConfigPrefix + id)
+	if err != nil {
+		return ModelConfig{}, err
+	}
+
+	var model ModelConfig
+	err = json.Unmarshal([]byte(data), &model)
+	if err != nil {
+		return ModelConfig{}, err
+	}
+
+	return model, nil
+}
+
+// SetModelConfig 保存模型配置
+func SetModelConfig(model ModelConfig) error {
+	if model.ID == "" {
+		return fmt.Errorf("模型ID不能为空")
+	}
+	model.UpdatedAt = time.Now()
+
+	data, err := json.Marshal(model)
+	if err != nil {
+		return err
+	}
+
+	// 移除旧配置中已删除的别名
+	if previous, err := GetModelConfig(model.ID); err == nil {
+		removeModelNames(previous)
+	}
+	if err := RedisSet(modelConfigPrefix+model.ID, string(data), 0); err != nil { // 永不过期
+		return err
+	}
+	return indexModelNames(model)
+}
+
+// modelNames 模型ID和别名的小写形式，用作名称索引的字段
+func modelNames(model ModelConfig) []string {
+	names := []string{strings.ToLower(model.ID)}
+	for _, alias := range model.Aliases {
+		names = append(names, strings.ToLower(alias))
+	}
+	return names
+}
+
+// indexModelNames 将模型ID和别名写入名称索引
+func indexModelNames(model ModelConfig) error {
+	for _, name := range modelNames(model) {
+		if err := RedisHSet(modelNameIndexKey, name, model.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeModelNames 从名称索引中移除仍指向该模型的名称
+func removeModelNames(model ModelConfig) {
+	for _, name := range modelNames(model) {
+		if id, err := RedisHGet(modelNameIndexKey, name); err == nil && id == model.ID {
+			RedisHDel(modelNameIndexKey, name)
+		}
+	}
+}
+
+// RebuildModelNameIndex 根据已保存的模型配置重建名称索引，用于升级前保存的模型
+func RebuildModelNameIndex(models []ModelConfig) error {
+	if err := RedisDel(modelNameIndexKey); err != nil {
+		return err
+	}
+	for _, model := range models {
+		if err := indexModelNames(model); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetAllModelConfigs 获取所有模型配置，按ID排序
+func GetAllModelConfigs() ([]ModelConfig, error) {
+	keys, err := RedisKeys(modelConfigPrefix + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	models := make([]ModelConfig, 0, len(keys))
+	for _, key := range keys {
+		model, err := GetModelConfig(strings.TrimPrefix(key, modelConfigPrefix))
+		if err != nil {
+			continue
+		}
+		models = append(models, model)
+	}
+
+	sort.Slice(models, func(i, j int) bool {
+		return models[i].ID < models[j].ID
+	})
+
+	return models, nil
+}
+
+// FindModelConfig 根据模型ID或别名查找模型配置，别名通过名称索引查找
+func FindModelConfig(name string) (ModelConfig, bool) {
+	if model, err := GetModelConfig(name); err == nil {
+		return model, true
+	}
+
+	id, err := RedisHGet(modelNameIndexKey, strings.ToLower(name))
+	if err != nil {
+		return ModelConfig{}, false
+	}
+	model, err := GetModelConfig(id)
+	if err != nil || !model.Matches(name) {
+		return ModelConfig{}, false
+	}
+	return model, true
+}
+
+// DeleteModelConfig 删除模型配置
+func DeleteModelConfig(id string) error {
+	if model, err := GetModelConfig(id); err == nil {
+		removeModelNames(model)
+	}
+	return RedisDel(modelConfigPrefix + id)
+}
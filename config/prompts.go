@@ -0,0 +1,87 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PromptTemplate 提示词模板，各字段均为text/template模板
+// 可用变量：{{.Date}} {{.Time}} {{.Model}} {{.KeyName}} {{.Mode}}
+type PromptTemplate struct {
+	Name               string    `json:"name"`
+	Description        string    `json:"description"`
+	Prefix             string    `json:"prefix"`              // 请求上下文前缀，影响模型回复风格
+	ChatGuidelines     string    `json:"chat_guidelines"`     // CHAT模式的用户指南
+	AgentGuidelines    string    `json:"agent_guidelines"`    // AGENT模式的用户指南
+	ToolGuidelines     string    `json:"tool_guidelines"`     // 客户端自带工具时的用户指南
+	FallbackGuidelines string    `json:"fallback_guidelines"` // 回退到CHAT模式重试时的用户指南
+	DefaultPrompt      string    `json:"default_prompt"`      // AGENT模式下拼接在用户消息前的提示词
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
+// DefaultPromptTemplateName 未指定模板时使用的模板名称
+const DefaultPromptTemplateName = "default"
+
+const promptTemplatePrefix = "prompt_template:"
+
+// GetPromptTemplate 根据名称获取提示词模板
+func GetPromptTemplate(name string) (PromptTemplate, error) {
+	data, err := RedisGet(promptTemplatePrefix + name)
+	if err != nil {
+		return PromptTemplate{}, err
+	}
+
+	var template PromptTemplate
+	err = json.Unmarshal([]byte(data), &template)
+	if err != nil {
+		return PromptTemplate{}, err
+	}
+
+	return template, nil
+}
+
+// SetPromptTemplate 保存提示词模板
+func SetPromptTemplate(template PromptTemplate) error {
+	if template.Name == "" {
+		return fmt.Errorf("模板名称不能为空")
+	}
+	template.UpdatedAt = time.Now()
+
+	data, err := json.Marshal(template)
+	if err != nil {
+		return err
+	}
+
+	return RedisSet(promptTemplatePrefix+template.Name, string(data), 0) // 永不过期
+}
+
+// GetAllPromptTemplates 获取所有提示词模板，按名称排序
+func GetAllPromptTemplates() ([]PromptTemplate, error) {
+	keys, err := RedisKeys(promptTemplatePrefix + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	templates := make([]PromptTemplate, 0, len(keys))
+	for _, key := range keys {
+		template, err := GetPromptTemplate(strings.TrimPrefix(key, promptTemplatePrefix))
+		if err != nil {
+			continue
+		}
+		templates = append(templates, template)
+	}
+
+	sort.Slice(templates, func(i, j int) bool {
+		return templates[i].Name < templates[j].Name
+	})
+
+	return templates, nil
+}
+
+// DeletePromptTemplate 删除提示词模板
+func DeletePromptTemplate(name string) error {
+	return RedisDel(promptTemplatePrefix + name)
+}
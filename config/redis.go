@@ -3,6 +3,7 @@ package config
 import (
 	"augment2api/pkg/logger"
 	"context"
+	"fmt"
 	"os"
 	"time"
 
@@ -111,3 +112,112 @@ func RedisHGetAll(key string) (map[string]string, error) {
 	ctx := context.Background()
 	return RDB.HGetAll(ctx, key).Result()
 }
+
+// RedisHIncrBy 增加哈希表字段的计数
+func RedisHIncrBy(key, field string, incr int64) error {
+	ctx := context.Background()
+	return RDB.HIncrBy(ctx, key, field, incr).Err()
+}
+
+// RedisHDel 删除哈希表中的字段
+func RedisHDel(key string, fields ...string) error {
+	ctx := context.Background()
+	return RDB.HDel(ctx, key, fields...).Err()
+}
+
+// RedisIncrValue 增加Redis中的计数器并返回增加后的值
+func RedisIncrValue(key string) (int64, error) {
+	ctx := context.Background()
+	return RDB.Incr(ctx, key).Result()
+}
+
+// RedisSAdd 向集合中添加成员
+func RedisSAdd(key string, members ...string) error {
+	ctx := context.Background()
+	values := make([]interface{}, len(members))
+	for i, member := range members {
+		values[i] = member
+	}
+	return RDB.SAdd(ctx, key, values...).Err()
+}
+
+// RedisSRem 从集合中移除成员
+func RedisSRem(key string, members ...string) error {
+	ctx := context.Background()
+	values := make([]interface{}, len(members))
+	for i, member := range members {
+		values[i] = member
+	}
+	return RDB.SRem(ctx, key, values...).Err()
+}
+
+// RedisRename 重命名键，新键已存在时会被覆盖
+func RedisRename(key, newKey string) error {
+	ctx := context.Background()
+	return RDB.Rename(ctx, key, newKey).Err()
+}
+
+// RedisSMembers 获取集合中的所有成员
+func RedisSMembers(key string) ([]string, error) {
+	ctx := context.Background()
+	return RDB.SMembers(ctx, key).Result()
+}
+
+// redisWatcher 支持WATCH事务的客户端
+type redisWatcher interface {
+	Watch(ctx context.Context, fn func(*redis.Tx) error, keys ...string) error
+}
+
+// 乐观锁冲突时的最大重试次数
+const redisUpdateRetries = 10
+
+// RedisUpdate 使用WATCH/MULTI读取、修改并写回键的值，期间键被其他请求修改时重试，避免并发写入互相覆盖
+// 键不存在时返回redis.Nil，update返回错误时放弃写入
+func RedisUpdate(key string, expiration time.Duration, update func(current string) (string, error)) error {
+	ctx := context.Background()
+	watcher, ok := RDB.(redisWatcher)
+	if !ok {
+		return fmt.Errorf("Redis客户端不支持事务")
+	}
+
+	for i := 0; i < redisUpdateRetries; i++ {
+		err := watcher.Watch(ctx, func(tx *redis.Tx) error {
+			current, err := tx.Get(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+			next, err := update(current)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, next, expiration)
+				return nil
+			})
+			return err
+		}, key)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return redis.TxFailedErr
+}
+
+// RedisHSetNX 哈希表字段不存在时设置字段值，返回是否设置成功
+func RedisHSetNX(key, field, value string) (bool, error) {
+	ctx := context.Background()
+	return RDB.HSetNX(ctx, key, field, value).Result()
+}
+
+// RedisPipelined 在一次往返中执行queue加入的所有命令。键或字段不存在（redis.Nil）不视为错误，调用方通过各命令的结果判断
+func RedisPipelined(queue func(ctx context.Context, pipe redis.Pipeliner)) error {
+	ctx := context.Background()
+	_, err := RDB.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		queue(ctx, pipe)
+		return nil
+	})
+	if err == redis.Nil {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"augment2api/pkg/logger"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryPolicy 上游请求失败后的重试策略
+type RetryPolicy struct {
+	StatusCodes []int         // 需要重试的上游状态码
+	MaxAttempts int           // 包括首次请求在内的最大请求次数
+	BackoffBase time.Duration // 第一次重试前的基础等待时间，之后每次翻倍
+	BackoffMax  time.Duration // 单次等待时间上限
+	RotateToken bool          // 重试时是否换用token池中的其他token
+}
+
+// 重试策略默认值，与initializeDefaultConfigs中的默认配置一致
+var defaultRetryPolicy = RetryPolicy{
+	StatusCodes: []int{429, 500, 502, 503, 504},
+	MaxAttempts: 3,
+	BackoffBase: 500 * time.Millisecond,
+	BackoffMax:  8 * time.Second,
+	RotateToken: true,
+}
+
+// RetryableStatus 判断状态码是否需要重试
+func (p RetryPolicy) RetryableStatus(status int) bool {
+	for _, code := range p.StatusCodes {
+		if code == status {
+			return true
+		}
+	}
+	return false
+}
+
+// parseStatusCodes 解析逗号分隔的状态码列表，忽略无效项
+func parseStatusCodes(value string) []int {
+	codes := []int{}
+	for _, item := range strings.Split(value, ",") {
+		code, err := strconv.Atoi(strings.TrimSpace(item))
+		if err == nil && code >= 100 && code <= 599 {
+			codes = append(codes, code)
+		}
+	}
+	return codes
+}
+
+// parseIntConfig 解析整数配置，无效时记录警告并返回默认值
+func parseIntConfig(key, value string, fallback int) int {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		logger.Log.WithFields(map[string]interface{}{
+			"key":   key,
+			"value": value,
+		}).Warn("配置值不是有效的整数，使用默认值")
+		return fallback
+	}
+	return n
+}
+
+// parseSecondsConfig 解析以秒为单位的时间配置，负数按0处理
+func parseSecondsConfig(key, value string, fallback int) time.Duration {
+	seconds := parseIntConfig(key, value, fallback)
+	if seconds < 0 {
+		seconds = 0
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// TokenPool token池配置，token和下游API Key通过池名称关联到池
+type TokenPool struct {
+	Name              string `json:"name"`
+	SelectionStrategy string `json:"selection_strategy"` // 从池中选择token的策略，为空时使用token_selection_strategy
+	CreatedAt         string `json:"created_at"`
+	UpdatedAt         string `json:"updated_at"`
+}
+
+const (
+	tokenPoolPrefix = "token_pool:"
+	// token池成员集合键前缀，集合成员为属于该池的token
+	tokenPoolTokensPrefix = "token_pool_tokens:"
+)
+
+// GetTokenPool 获取token池配置
+func GetTokenPool(name string) (TokenPool, error) {
+	data, err := RedisGet(tokenPoolPrefix + name)
+	if err != nil {
+		return TokenPool{}, err
+	}
+
+	var pool TokenPool
+	err = json.Unmarshal([]byte(data), &pool)
+	if err != nil {
+		return TokenPool{}, err
+	}
+
+	return pool, nil
+}
+
+// SetTokenPool 保存token池配置
+func SetTokenPool(pool TokenPool) error {
+	if pool.Name == "" {
+		return fmt.Errorf("token池名称不能为空")
+	}
+
+	data, err := json.Marshal(pool)
+	if err != nil {
+		return err
+	}
+
+	return RedisSet(tokenPoolPrefix+pool.Name, string(data), 0) // 永不过期
+}
+
+// GetAllTokenPools 获取所有token池配置，按名称排序
+func GetAllTokenPools() ([]TokenPool, error) {
+	keys, err := RedisKeys(tokenPoolPrefix + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	pools := make([]TokenPool, 0, len(keys))
+	for _, key := range keys {
+		pool, err := GetTokenPool(strings.TrimPrefix(key, tokenPoolPrefix))
+		if err != nil {
+			continue
+		}
+		pools = append(pools, pool)
+	}
+
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].Name < pools[j].Name
+	})
+
+	return pools, nil
+}
+
+// DeleteTokenPool 删除token池配置和成员集合
+func DeleteTokenPool(name string) error {
+	if err := RedisDel(tokenPoolTokensPrefix + name); err != nil {
+		return err
+	}
+	return RedisDel(tokenPoolPrefix + name)
+}
+
+// GetTokenPoolTokens 获取token池中的所有token
+func GetTokenPoolTokens(name string) ([]string, error) {
+	return RedisSMembers(tokenPoolTokensPrefix + name)
+}
+
+// AddTokenPoolToken 将token加入token池
+func AddTokenPoolToken(name, token string) error {
+	return RedisSAdd(tokenPoolTokensPrefix+name, token)
+}
+
+// RemoveTokenPoolToken 将token移出token池
+func RemoveTokenPoolToken(name, token string) error {
+	return RedisSRem(tokenPoolTokensPrefix+name, token)
+}
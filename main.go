@@ -199,6 +199,9 @@ func setupRouter() *gin.Engine {
 	// 更新token限制 - 需要会话验证
 	r.PUT("/api/token/:token/limits", api.AuthTokenMiddleware(), api.UpdateTokenLimits)
 
+	// 更新token所属的token池 - 需要会话验证
+	r.PUT("/api/token/:token/pool", api.AuthTokenMiddleware(), api.UpdateTokenPoolAssignment)
+
 	// 数据库清理 - 需要会话验证
 	r.POST("/api/cleanup", api.AuthTokenMiddleware(), api.CleanupDatabase)
 
@@ -222,6 +225,31 @@ func setupRouter() *gin.Engine {
 	r.DELETE("/api/cf-workers/:id", api.AuthTokenMiddleware(), api.DeleteCFWorker)
 	r.POST("/api/cf-workers/test", api.AuthTokenMiddleware(), api.TestCFWorker)
 
+	// 模型注册表管理 - 需要会话验证
+	r.GET("/api/models", api.AuthTokenMiddleware(), api.GetModelConfigs)
+	r.POST("/api/models", api.AuthTokenMiddleware(), api.SaveModelConfig)
+	r.PUT("/api/models/:id", api.AuthTokenMiddleware(), api.SaveModelConfig)
+	r.DELETE("/api/models/:id", api.AuthTokenMiddleware(), api.DeleteModelConfig)
+
+	// 提示词模板管理 - 需要会话验证
+	r.GET("/api/prompt-templates", api.AuthTokenMiddleware(), api.GetPromptTemplates)
+	r.PUT("/api/prompt-templates/:name", api.AuthTokenMiddleware(), api.SavePromptTemplate)
+	r.DELETE("/api/prompt-templates/:name", api.AuthTokenMiddleware(), api.DeletePromptTemplate)
+	r.POST("/api/prompt-preview", api.AuthTokenMiddleware(), api.PreviewPromptTemplate)
+
+	// 下游API Key管理 - 需要会话验证
+	r.GET("/api/keys", api.AuthTokenMiddleware(), api.GetAPIKeys)
+	r.POST("/api/keys", api.AuthTokenMiddleware(), api.CreateAPIKey)
+	r.PUT("/api/keys/:key", api.AuthTokenMiddleware(), api.UpdateAPIKey)
+	r.DELETE("/api/keys/:key", api.AuthTokenMiddleware(), api.DeleteAPIKey)
+	r.GET("/api/keys/:key/usage", api.AuthTokenMiddleware(), api.GetAPIKeyUsage)
+
+	// token池管理 - 需要会话验证
+	r.GET("/api/token-pools", api.AuthTokenMiddleware(), api.GetTokenPools)
+	r.POST("/api/token-pools", api.AuthTokenMiddleware(), api.CreateTokenPool)
+	r.PUT("/api/token-pools/:name", api.AuthTokenMiddleware(), api.UpdateTokenPool)
+	r.DELETE("/api/token-pools/:name", api.AuthTokenMiddleware(), api.DeleteTokenPool)
+
 	// 回调端点，用于处理授权码 - 需要会话验证
 	r.POST("/callback", api.AuthTokenMiddleware(), func(c *gin.Context) {
 		api.CallbackHandler(c, func(tenantURL, _, code string) (string, error) {
@@ -235,15 +263,42 @@ func setupRouter() *gin.Engine {
 	{
 		// OpenAI兼容的聊天端点
 		chatGroup := authGroup.Group("/")
+		// 响应缓存需在分配token之前查询，命中时不占用token
+		chatGroup.Use(api.ResponseCacheMiddleware())
 		// 并发控制
 		chatGroup.Use(middleware.TokenConcurrencyMiddleware())
 		{
 			chatGroup.POST("/v1/chat/completions", api.ChatCompletionsHandler)
 			chatGroup.POST("/v1", api.ChatCompletionsHandler)
 			chatGroup.POST("/v1/chat", api.ChatCompletionsHandler)
+
+			// Anthropic兼容的消息端点
+			chatGroup.POST("/v1/messages", api.AnthropicMessagesHandler)
+
+			// 文本补全和代码补全（fill-in-the-middle）端点
+			chatGroup.POST("/v1/completions", api.CompletionsHandler)
+			chatGroup.POST("/v1/fim/completions", api.FIMCompletionsHandler)
 		}
 
 		authGroup.GET("/v1/models", api.ModelsHandler)
+
+		// 服务端对话管理
+		authGroup.GET("/v1/conversations", api.ListConversationsHandler)
+		authGroup.POST("/v1/conversations", api.CreateConversationHandler)
+		authGroup.GET("/v1/conversations/:id", api.GetConversationHandler)
+		authGroup.DELETE("/v1/conversations/:id", api.DeleteConversationHandler)
+
+		// Agent记忆管理，AGENT模式请求时发送给Augment
+		authGroup.GET("/v1/memories", api.ListMemoriesHandler)
+		authGroup.POST("/v1/memories", api.CreateMemoryHandler)
+		authGroup.PUT("/v1/memories/:id", api.UpdateMemoryHandler)
+		authGroup.DELETE("/v1/memories/:id", api.DeleteMemoryHandler)
+
+		// 上下文文件
+		authGroup.GET("/v1/files", api.ListFilesHandler)
+		authGroup.POST("/v1/files", api.UploadFileHandler)
+		authGroup.GET("/v1/files/:id", api.GetFileHandler)
+		authGroup.DELETE("/v1/files/:id", api.DeleteFileHandler)
 		authGroup.POST("/api/add/tokens", api.AddTokenHandler)
 	}
 
@@ -299,6 +354,18 @@ func main() {
 		logger.Log.Info("将使用默认配置继续启动")
 	}
 
+	// 初始化模型注册表
+	err = api.InitModelRegistry()
+	if err != nil {
+		logger.Log.Errorf("初始化模型注册表失败: %v", err)
+	}
+
+	// 初始化默认提示词模板
+	err = api.InitPromptTemplates()
+	if err != nil {
+		logger.Log.Errorf("初始化提示词模板失败: %v", err)
+	}
+
 	// token备注字段迁移
 	err = api.MigrateTokensRemark()
 	if err != nil {
@@ -311,6 +378,24 @@ func main() {
 		logger.Log.Error("Token新字段迁移失败: %v", err)
 	}
 
+	// 对话索引迁移
+	err = api.MigrateConversationIndex()
+	if err != nil {
+		logger.Log.Error("对话索引迁移失败: " + err.Error())
+	}
+
+	// 文件索引迁移
+	err = api.MigrateFileIndex()
+	if err != nil {
+		logger.Log.Errorf("文件索引迁移失败: %v", err)
+	}
+
+	// 记忆键迁移
+	err = api.MigrateMemoryScopes()
+	if err != nil {
+		logger.Log.Errorf("记忆键迁移失败: %v", err)
+	}
+
 	// 启动token使用次数重置调度器
 	go api.StartTokenUsageResetScheduler()
 
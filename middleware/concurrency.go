@@ -6,38 +6,35 @@ import (
 	"augment2api/pkg/logger"
 	"net/http"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 )
 
-// 全局锁映射，用于控制每个 token 的并发请求
-var (
-	tokenLocks      = make(map[string]*sync.Mutex)
-	tokenLocksGuard = sync.Mutex{}
-)
-
-// getTokenLock 获取指定 token 的锁
-func getTokenLock(token string) *sync.Mutex {
-	tokenLocksGuard.Lock()
-	defer tokenLocksGuard.Unlock()
+// pooledPathSuffixes 需要从token池分配token并进行并发控制的接口路径
+var pooledPathSuffixes = []string{
+	"/chat/completions",
+	"/v1/messages",
+	"/v1/completions",
+	"/fim/completions",
+}
 
-	if lock, exists := tokenLocks[token]; exists {
-		return lock
+// isPooledPath 判断请求路径是否需要并发控制
+func isPooledPath(path string) bool {
+	for _, suffix := range pooledPathSuffixes {
+		if strings.HasSuffix(path, suffix) {
+			return true
+		}
 	}
-
-	lock := &sync.Mutex{}
-	tokenLocks[token] = lock
-	return lock
+	return false
 }
 
 // TokenConcurrencyMiddleware 控制Redis中token的使用频率
 func TokenConcurrencyMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// 只对聊天完成请求进行并发控制
-		if !strings.HasSuffix(c.Request.URL.Path, "/chat/completions") {
+		// 只对聊天完成请求进行并发控制，命中响应缓存的请求不需要token
+		if !isPooledPath(c.Request.URL.Path) || api.ResponseCacheHit(c) {
 			c.Next()
 			return
 		}
@@ -58,7 +55,7 @@ func TokenConcurrencyMiddleware() gin.HandlerFunc {
 		
 		if !exists || !exists2 {
 			// 如果没有从认证中间件获取到token，则使用token池模式
-			token, tenantURL := api.GetAvailableToken()
+			token, tenantURL := api.SelectPoolToken(c)
 			if token == "No token" {
 				c.JSON(http.StatusTooManyRequests, gin.H{"error": "当前无可用token，请在页面添加"})
 				c.Abort()
@@ -79,31 +76,29 @@ func TokenConcurrencyMiddleware() gin.HandlerFunc {
 		tokenStr, _ := token.(string)
 		tenantURLStr, _ := tenantURL.(string)
 
-		// 获取该token的锁
-		lock := getTokenLock(tokenStr)
-
-		// 尝试获取锁，会阻塞直到获取到锁
-		lock.Lock()
-
-		// 更新请求状态
-		err := api.SetTokenRequestStatus(tokenStr, api.TokenRequestStatus{
-			InProgress:    true,
-			LastRequestAt: time.Now(),
-		})
-
+		// 获取该token的租约，会阻塞直到token空闲
+		lock, err := api.AcquireTokenLease(tokenStr)
 		if err != nil {
-			lock.Unlock()
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "更新token请求状态失败"})
 			c.Abort()
 			return
 		}
 
+		// 等待期间客户端已断开，直接释放租约
+		if c.Request.Context().Err() != nil {
+			api.ReleaseTokenLease(tokenStr, lock)
+			api.RecordRequestOutcome(tokenStr, api.OutcomeCancelled)
+			c.AbortWithStatus(499)
+			return
+		}
+
 		logger.Log.WithFields(logrus.Fields{
 			"token": tokenStr,
 		}).Info("本次请求使用的token: ")
 
-		// 在请求完成后释放锁
+		// 在请求完成后释放锁，token来自token池时允许切换到其他token
 		c.Set("token_lock", lock)
+		c.Set("token_pooled", !exists || !exists2)
 		c.Set("token", tokenStr)
 		c.Set("tenant_url", tenantURLStr)
 
@@ -118,6 +113,11 @@ func TokenConcurrencyMiddleware() gin.HandlerFunc {
 				}).Error("增加token每日使用计数失败")
 			}
 
+			// 请求已切换到其他token时，原token的状态已在切换时更新，且可能已被其他请求使用
+			if current, _ := c.Get("token"); current != tokenStr {
+				return
+			}
+
 			// 更新请求状态为完成
 			err = api.SetTokenRequestStatus(tokenStr, api.TokenRequestStatus{
 				InProgress:    false,
@@ -0,0 +1,221 @@
+package tokenizer
+
+import (
+	_ "embed"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// bpe_merges.txt 为离线训练的字节级BPE合并表，每行"左 右"两个token id，行号即合并优先级，
+// 第n行合并产生的token id为256+n。训练语料为Go、Rust、Python、JavaScript源码及英文文档，
+// 预分词规则与splitPieces一致，词表规模约为cl100k的六分之一。
+//
+// 注意：这不是cl100k_base，也不是Claude的分词器，只是离线的token数量估算器，结果不等于上游计费的token数。
+// 词表较小，常见英文单词会被拆成两个token，估算值只会偏高：单条文本不超过cl100k计数的1.5倍，
+// 整体偏高约20%，bpe_test.go按此误差范围校验。估算值偏高时上下文裁剪会更早发生，但不会超出上游限制。
+//
+//go:embed bpe_merges.txt
+var embeddedMerges string
+
+const (
+	// 单个片段的最大字节数，超长的重复字符（如分隔线）按此长度切分
+	maxPieceBytes = 64
+	// 片段计数缓存的最大条目数，超出后清空重建
+	maxCacheEntries = 1 << 16
+)
+
+// 预分词的字符类别
+const (
+	classLetter = iota
+	classDigit
+	classSpace
+	classCJK
+	classOther
+)
+
+func classOf(r rune) int {
+	switch {
+	case isCJK(r):
+		return classCJK
+	case unicode.IsLetter(r) || unicode.IsMark(r):
+		return classLetter
+	case unicode.IsNumber(r):
+		return classDigit
+	case unicode.IsSpace(r):
+		return classSpace
+	default:
+		return classOther
+	}
+}
+
+// splitPieces 预分词：字母串和符号串可带一个前导空格，数字最多三位一组，
+// 空白单独成片，CJK字符每个单独成片，所有片段不超过maxPieceBytes字节
+func splitPieces(text string, emit func(piece string, cjk bool)) {
+	for i := 0; i < len(text); {
+		start := i
+		r, size := utf8.DecodeRuneInString(text[i:])
+		class := classOf(r)
+
+		// 单个空格后跟字母或符号时，空格并入后面的片段
+		if r == ' ' && i+1 < len(text) {
+			next, nextSize := utf8.DecodeRuneInString(text[i+1:])
+			if nextClass := classOf(next); nextClass == classLetter || nextClass == classOther {
+				i++
+				r, size, class = next, nextSize, nextClass
+			}
+		}
+
+		switch class {
+		case classCJK:
+			emit(text[start:i+size], true)
+			i += size
+			continue
+		case classDigit:
+			for n := 0; n < 3 && i < len(text); n++ {
+				r, size = utf8.DecodeRuneInString(text[i:])
+				if classOf(r) != classDigit {
+					break
+				}
+				i += size
+			}
+		default:
+			for i < len(text) && i-start < maxPieceBytes {
+				r, size = utf8.DecodeRuneInString(text[i:])
+				if classOf(r) != class {
+					break
+				}
+				i += size
+			}
+			// 空白末尾的单个空格留给后面的字母或符号
+			if class == classSpace && i-start > 1 && text[i-1] == ' ' && i < len(text) {
+				next, _ := utf8.DecodeRuneInString(text[i:])
+				if nextClass := classOf(next); nextClass == classLetter || nextClass == classOther {
+					i--
+				}
+			}
+		}
+
+		emit(text[start:i], false)
+	}
+}
+
+// bpeTokenizer 字节级BPE分词器，只估算token数量
+type bpeTokenizer struct {
+	name  string
+	ranks map[uint64]int // (左id<<32 | 右id) -> 合并优先级
+
+	mu    sync.RWMutex
+	cache map[string]int
+}
+
+// newEmbeddedBPE 加载内嵌的合并表
+func newEmbeddedBPE() Tokenizer {
+	return NewBPE(NameBPE, embeddedMerges)
+}
+
+// NewBPE 根据合并表文本创建BPE分词器，格式与内嵌的bpe_merges.txt相同
+func NewBPE(name, merges string) Tokenizer {
+	t := &bpeTokenizer{
+		name:  name,
+		ranks: make(map[uint64]int),
+		cache: make(map[string]int),
+	}
+
+	for _, line := range strings.Split(merges, "\n") {
+		left, right, found := strings.Cut(strings.TrimSpace(line), " ")
+		if !found {
+			continue
+		}
+		a, err1 := strconv.Atoi(left)
+		b, err2 := strconv.Atoi(right)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		t.ranks[pairKey(a, b)] = len(t.ranks)
+	}
+
+	return t
+}
+
+func pairKey(a, b int) uint64 {
+	return uint64(a)<<32 | uint64(b)
+}
+
+func (t *bpeTokenizer) Name() string {
+	return t.name
+}
+
+func (t *bpeTokenizer) Count(text string) int {
+	total := 0
+	splitPieces(text, func(piece string, cjk bool) {
+		if cjk {
+			total++
+			return
+		}
+		total += t.countPiece(piece)
+	})
+	return total
+}
+
+// countPiece 计算单个片段合并后的token数量，结果会被缓存
+func (t *bpeTokenizer) countPiece(piece string) int {
+	if len(piece) <= 1 {
+		return len(piece)
+	}
+
+	t.mu.RLock()
+	count, ok := t.cache[piece]
+	t.mu.RUnlock()
+	if ok {
+		return count
+	}
+
+	count = len(t.merge(piece))
+
+	t.mu.Lock()
+	if len(t.cache) >= maxCacheEntries {
+		t.cache = make(map[string]int)
+	}
+	t.cache[piece] = count
+	t.mu.Unlock()
+
+	return count
+}
+
+// merge 按优先级反复合并相邻token，直到没有可合并的pair
+func (t *bpeTokenizer) merge(piece string) []int {
+	ids := make([]int, len(piece))
+	for i := 0; i < len(piece); i++ {
+		ids[i] = int(piece[i])
+	}
+
+	for len(ids) > 1 {
+		best := -1
+		for i := 0; i < len(ids)-1; i++ {
+			if rank, ok := t.ranks[pairKey(ids[i], ids[i+1])]; ok && (best < 0 || rank < best) {
+				best = rank
+			}
+		}
+		if best < 0 {
+			break
+		}
+
+		merged := ids[:0]
+		for i := 0; i < len(ids); i++ {
+			if i < len(ids)-1 {
+				if rank, ok := t.ranks[pairKey(ids[i], ids[i+1])]; ok && rank == best {
+					merged = append(merged, 256+best)
+					i++
+					continue
+				}
+			}
+			merged = append(merged, ids[i])
+		}
+		ids = merged
+	}
+
+	return ids
+}
@@ -0,0 +1,90 @@
+package tokenizer
+
+import (
+	"strings"
+	"testing"
+)
+
+// 内嵌词表是估算器，估算值不应低于cl100k_base的计数，单条不超过maxSampleError倍，
+// 全部样本合计不超过maxTotalError倍
+const (
+	maxSampleError = 1.5
+	maxTotalError  = 1.25
+)
+
+// cl100kReference 英文和源码样本及其cl100k_base的token数量
+var cl100kReference = []struct {
+	text   string
+	cl100k int
+}{
+	{text: "hello world", cl100k: 2},
+	{text: "Hello, world!", cl100k: 4},
+	{text: "The quick brown fox jumps over the lazy dog.", cl100k: 10},
+	{text: "The cat sat on the mat.", cl100k: 7},
+	{text: "I love programming.", cl100k: 4},
+	{text: "1234567890", cl100k: 4},
+	{text: "package main", cl100k: 2},
+	{text: "import numpy as np", cl100k: 4},
+	{text: "return a + b", cl100k: 4},
+	{text: "for i in range(10):", cl100k: 7},
+	{text: `console.log("hello");`, cl100k: 5},
+}
+
+func TestBPEEstimateError(t *testing.T) {
+	bpe := Get(NameBPE)
+	total, reference := 0, 0
+	for _, tt := range cl100kReference {
+		got := bpe.Count(tt.text)
+		if got < tt.cl100k || float64(got) > maxSampleError*float64(tt.cl100k) {
+			t.Errorf("Count(%q) = %d, 超出cl100k参考值%d的误差范围[1, %.2f]倍", tt.text, got, tt.cl100k, maxSampleError)
+		}
+		total += got
+		reference += tt.cl100k
+	}
+	if float64(total) > maxTotalError*float64(reference) {
+		t.Errorf("样本合计 %d, 超过cl100k参考值合计%d的%.2f倍", total, reference, maxTotalError)
+	}
+}
+
+// 预分词规则决定的计数：CJK字符每个计为1个token，超长的重复字符按maxPieceBytes切分
+var bpeRules = []struct {
+	text  string
+	count int
+}{
+	{text: "", count: 0},
+	{text: "你好，世界", count: 5},
+	{text: strings.Repeat("=", 80), count: 3},
+	{text: "   \n\n\t  ", count: 3},
+}
+
+func TestBPECountRules(t *testing.T) {
+	bpe := Get(NameBPE)
+	for _, tt := range bpeRules {
+		if got := bpe.Count(tt.text); got != tt.count {
+			t.Errorf("Count(%q) = %d, want %d", tt.text, got, tt.count)
+		}
+	}
+}
+
+// benchmarkText 混合英文、源码和中文的请求内容
+var benchmarkText = strings.Repeat("The quick brown fox jumps over the lazy dog. "+
+	"func main() {\n\tfmt.Println(\"hello\")\n}\n"+
+	"请根据上面的代码解释它的输出。\n", 200)
+
+func BenchmarkCount(b *testing.B) {
+	b.Run("cached", func(b *testing.B) {
+		bpe := Get(NameBPE)
+		b.SetBytes(int64(len(benchmarkText)))
+		for i := 0; i < b.N; i++ {
+			bpe.Count(benchmarkText)
+		}
+	})
+	b.Run("uncached", func(b *testing.B) {
+		bpe := newEmbeddedBPE().(*bpeTokenizer)
+		b.SetBytes(int64(len(benchmarkText)))
+		for i := 0; i < b.N; i++ {
+			bpe.cache = make(map[string]int)
+			bpe.Count(benchmarkText)
+		}
+	})
+}
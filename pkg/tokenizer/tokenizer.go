@@ -0,0 +1,73 @@
+package tokenizer
+
+import (
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Tokenizer 计算文本的token数量
+type Tokenizer interface {
+	// Name 分词器名称，用于在系统配置中选择
+	Name() string
+	// Count 返回文本的token数量
+	Count(text string) int
+}
+
+// 内置分词器名称，两者都是估算器：bpe使用内嵌的小词表（见bpe.go），heuristic按空格粗略估算
+const (
+	NameBPE       = "bpe"
+	NameHeuristic = "heuristic"
+)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Tokenizer{}
+)
+
+func init() {
+	Register(heuristicTokenizer{})
+	Register(newEmbeddedBPE())
+}
+
+// Register 注册分词器，同名分词器会被替换
+func Register(t Tokenizer) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[t.Name()] = t
+}
+
+// Get 根据名称获取分词器，名称为空或未注册时返回内置BPE分词器
+func Get(name string) Tokenizer {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	if t, ok := registry[strings.ToLower(name)]; ok {
+		return t
+	}
+	return registry[NameBPE]
+}
+
+// isCJK 判断是否为中日韩文字，这类字符不参与BPE合并，每个字符计为1个token
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// heuristicTokenizer 按空格分词的粗略估算，英文单词计为1个token，中文字符计为0.75个token
+type heuristicTokenizer struct{}
+
+func (heuristicTokenizer) Name() string {
+	return NameHeuristic
+}
+
+func (heuristicTokenizer) Count(text string) int {
+	wordCount := len(strings.Fields(text))
+
+	chineseCount := 0
+	for _, r := range text {
+		if r >= 0x4E00 && r <= 0x9FFF {
+			chineseCount++
+		}
+	}
+
+	return wordCount + int(float64(chineseCount)*0.75)
+}